@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// The consumer half of the order wire contract (the publisher half is in
+// the service): the order fixture must decode to the same order whether it
+// arrives raw or wrapped in the SNS envelope SQS delivers.
+func TestOrderContract_ConsumesFixture(t *testing.T) {
+	data, err := os.ReadFile("../src/orders/testdata/order_full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want Order
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, _ := json.Marshal(snsEnvelope{Type: "Notification", MessageID: "m-1", Message: string(data)})
+	for name, body := range map[string]string{"raw": string(data), "sns": string(wrapped)} {
+		got, err := parseSQSOrder(body)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded order differs:\n got %+v\nwant %+v", name, got, want)
+		}
+	}
+}
@@ -2,4 +2,13 @@ module lambda-order-processor
 
 go 1.23
 
-require github.com/aws/aws-lambda-go v1.47.0
+require (
+	github.com/aws/aws-lambda-go v1.47.0
+	github.com/go-sql-driver/mysql v1.8.1
+	text/main v0.0.0-00010101000000-000000000000
+)
+
+// The shared order domain lives in the service module
+replace text/main => ../src
+
+require filippo.io/edwards25519 v1.1.0 // indirect
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Local mode runs the handlers outside Lambda:
+//
+//	lambda-order-processor local [flags] event.json [more.json ...]   (- reads stdin)
+//	lambda-order-processor local -serve :9000                          (POST events to /invoke)
+//
+// Each file holds one SNS or SQS event, or a JSON array of them. Every
+// event is one simulated invocation with its own request ID and deadline.
+
+// localRunner invokes the handlers like the Lambda runtime would, one
+// invocation at a time even when -serve receives concurrent requests
+type localRunner struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	coldStart string // "first" or "always"
+	count     int
+}
+
+// invocationResult is what local mode prints for each invocation
+type invocationResult struct {
+	RequestID     string   `json:"request_id"`
+	Source        string   `json:"source"`
+	Records       int      `json:"records"`
+	ColdStart     bool     `json:"cold_start"`
+	DurationMs    int64    `json:"duration_ms"`
+	TimedOut      bool     `json:"timed_out,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	BatchFailures []string `json:"batch_item_failures,omitempty"`
+}
+
+// eventSource tells SNS and SQS events apart by their record fields
+func eventSource(raw json.RawMessage) (string, error) {
+	var probe struct {
+		Records []struct {
+			EventSource    string          `json:"EventSource"` // SNS spells it with capitals
+			EventSourceSQS string          `json:"eventSource"`
+			SNS            json.RawMessage `json:"Sns"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return "", err
+	}
+	if len(probe.Records) == 0 {
+		return "", errors.New("event has no Records")
+	}
+	r := probe.Records[0]
+	switch {
+	case r.EventSource == "aws:sns" || r.SNS != nil:
+		return "sns", nil
+	case r.EventSourceSQS == "aws:sqs":
+		return "sqs", nil
+	}
+	return "", errors.New("cannot tell whether the event is from SNS or SQS")
+}
+
+// splitEvents accepts a single event or a JSON array of events
+func splitEvents(data []byte) ([]json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var list []json.RawMessage
+		err := json.Unmarshal(data, &list)
+		return list, err
+	}
+	return []json.RawMessage{data}, nil
+}
+
+// invoke runs one event through the matching handler with a simulated
+// request ID, deadline and cold start
+func (r *localRunner) invoke(raw json.RawMessage) invocationResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	if r.coldStart == "always" {
+		coldStart = true
+		processStart = time.Now()
+	}
+	result := invocationResult{RequestID: fmt.Sprintf("local-%d-%d", time.Now().Unix(), r.count), ColdStart: coldStart}
+
+	source, err := eventSource(raw)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Source = source
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+		AwsRequestID:       result.RequestID,
+		InvokedFunctionArn: "arn:aws:lambda:local:000000000000:function:order-processor",
+	})
+
+	start := time.Now()
+	switch source {
+	case "sns":
+		var event events.SNSEvent
+		if err = json.Unmarshal(raw, &event); err == nil {
+			result.Records = len(event.Records)
+			err = handler(ctx, event)
+		}
+	case "sqs":
+		var event events.SQSEvent
+		if err = json.Unmarshal(raw, &event); err == nil {
+			result.Records = len(event.Records)
+			var response events.SQSEventResponse
+			response, err = sqsHandler(ctx, event)
+			for _, f := range response.BatchItemFailures {
+				result.BatchFailures = append(result.BatchFailures, f.ItemIdentifier)
+			}
+		}
+	}
+	result.DurationMs = time.Since(start).Milliseconds()
+	// Lambda would have killed the invocation at the deadline
+	result.TimedOut = ctx.Err() == context.DeadlineExceeded
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (r *localRunner) runFile(path string) ([]invocationResult, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	eventList, err := splitEvents(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var results []invocationResult
+	for _, raw := range eventList {
+		results = append(results, r.invoke(raw))
+	}
+	return results, nil
+}
+
+func printResult(result invocationResult) {
+	status := "ok"
+	switch {
+	case result.TimedOut:
+		status = "TIMED OUT"
+	case result.Error != "":
+		status = "ERROR: " + result.Error
+	case len(result.BatchFailures) > 0:
+		status = fmt.Sprintf("%d batch item failure(s): %v", len(result.BatchFailures), result.BatchFailures)
+	}
+	fmt.Printf("[%s] %s event, %d record(s), cold start: %t, %dms - %s\n",
+		result.RequestID, result.Source, result.Records, result.ColdStart, result.DurationMs, status)
+}
+
+// POST /invoke - body is an SNS or SQS event (or an array of them)
+func (r *localRunner) serveInvoke(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "POST an SNS or SQS event", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	eventList, err := splitEvents(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := []invocationResult{}
+	for _, raw := range eventList {
+		result := r.invoke(raw)
+		printResult(result)
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// runLocal is the entry point of `lambda-order-processor local`
+func runLocal(args []string) int {
+	flags := flag.NewFlagSet("local", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 30*time.Second, "simulated function timeout per invocation")
+	cold := flags.String("cold-start", "first", `"first" (only the first invocation is cold) or "always"`)
+	delay := flags.Duration("payment-delay", payments.Delay, "simulated payment time per order")
+	serve := flags.String("serve", "", "listen address for an HTTP invoke endpoint instead of reading files")
+	flags.Parse(args)
+
+	if *cold != "first" && *cold != "always" {
+		fmt.Fprintf(os.Stderr, "-cold-start must be first or always\n")
+		return 2
+	}
+	payments.Delay = *delay
+	runner := &localRunner{timeout: *timeout, coldStart: *cold}
+
+	if *serve != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/invoke", runner.serveInvoke)
+		fmt.Printf("Local Lambda runner listening on %s (POST events to /invoke)\n", *serve)
+		if err := http.ListenAndServe(*serve, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "usage: lambda-order-processor local [flags] event.json ... | -serve :9000\n")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	failed := 0
+	var total time.Duration
+	invocations := 0
+	for _, path := range flags.Args() {
+		results, err := runner.runFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed++
+			continue
+		}
+		for _, result := range results {
+			printResult(result)
+			invocations++
+			total += time.Duration(result.DurationMs) * time.Millisecond
+			if result.Error != "" || result.TimedOut || len(result.BatchFailures) > 0 {
+				failed++
+			}
+		}
+	}
+	fmt.Printf("%d invocation(s), %d with failures, total %v\n", invocations, failed, total)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
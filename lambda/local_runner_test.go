@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventSource(t *testing.T) {
+	cases := map[string]string{
+		`{"Records":[{"EventSource":"aws:sns","Sns":{"Message":"{}"}}]}`: "sns",
+		`{"Records":[{"eventSource":"aws:sqs","body":"{}"}]}`:            "sqs",
+	}
+	for event, want := range cases {
+		if got, err := eventSource(json.RawMessage(event)); err != nil || got != want {
+			t.Errorf("eventSource(%s) = %q, %v; want %q", event, got, err, want)
+		}
+	}
+	for _, bad := range []string{`{"Records":[]}`, `{"Records":[{"eventSource":"aws:kinesis"}]}`, `[]`} {
+		if _, err := eventSource(json.RawMessage(bad)); err == nil {
+			t.Errorf("eventSource(%s) should fail", bad)
+		}
+	}
+}
+
+func TestLocalRunner_Fixtures(t *testing.T) {
+	payments.Delay = 0
+	defer func() { payments.Delay = 3 * time.Second }()
+
+	runner := &localRunner{timeout: 10 * time.Second, coldStart: "always"}
+	results, err := runner.runFile("testdata/sns_event.json")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("sns fixture: %v, %+v", err, results)
+	}
+	if r := results[0]; r.Source != "sns" || r.Records != 1 || r.Error != "" || !r.ColdStart {
+		t.Errorf("unexpected sns result: %+v", r)
+	}
+
+	results, err = runner.runFile("testdata/sqs_batch.json")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("sqs fixture: %v, %+v", err, results)
+	}
+	if r := results[0]; r.Source != "sqs" || r.Records != 3 || len(r.BatchFailures) != 1 || r.BatchFailures[0] != "sqs-msg-3" {
+		t.Errorf("unexpected sqs result: %+v", r)
+	}
+
+	// Only the first invocation of an environment is cold
+	runner.coldStart = "first"
+	if r := runner.invoke(json.RawMessage(`{"Records":[{"eventSource":"aws:sqs","messageId":"m","body":"{\"order_id\":\"o\",\"items\":[{\"product_id\":\"1\",\"quantity\":1}]}"}]}`)); r.ColdStart {
+		t.Error("second invocation should be warm")
+	}
+}
+
+func TestLocalRunner_ServeInvoke(t *testing.T) {
+	payments.Delay = 0
+	defer func() { payments.Delay = 3 * time.Second }()
+
+	runner := &localRunner{timeout: 10 * time.Second, coldStart: "first"}
+	w := httptest.NewRecorder()
+	body := `{"Records":[{"eventSource":"aws:sqs","messageId":"m-1","body":"{\"order_id\":\"o-1\",\"items\":[{\"product_id\":\"1\",\"quantity\":1}]}"}]}`
+	runner.serveInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke", strings.NewReader(body)))
+
+	var results []invocationResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if results[0].Source != "sqs" || results[0].Error != "" || results[0].RequestID == "" {
+		t.Errorf("unexpected result: %+v", results[0])
+	}
+}
+
+func TestLocalRunner_ServeInvokeConcurrently(t *testing.T) {
+	payments.Delay = 0
+	defer func() { payments.Delay = 3 * time.Second }()
+
+	runner := &localRunner{timeout: 10 * time.Second, coldStart: "always"}
+	body := `{"Records":[{"eventSource":"aws:sqs","messageId":"m-2","body":"{\"order_id\":\"o-2\",\"items\":[{\"product_id\":\"1\",\"quantity\":1}]}"}]}`
+	responses := make([]*httptest.ResponseRecorder, 4)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			runner.serveInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke", strings.NewReader(body)))
+		}(responses[i])
+	}
+	wg.Wait()
+
+	// Invocations run one at a time, like in a Lambda execution environment
+	seen := make(map[string]bool)
+	for _, w := range responses {
+		var results []invocationResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 1 {
+			t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+		}
+		seen[results[0].RequestID] = true
+	}
+	if len(seen) != len(responses) || runner.count != len(responses) {
+		t.Fatalf("expected %d distinct invocations, got %v (count %d)", len(responses), seen, runner.count)
+	}
+}
@@ -3,70 +3,159 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+
+	"text/main/orders"
 )
 
-// Order structure matching the main application
-type Item struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
-}
+// Order types, validation, lifecycle and the payment simulation come from
+// the service's orders package, so both sides agree on the wire format
+type (
+	Item  = orders.Item
+	Order = orders.Order
+)
+
+// payments simulates the payment provider like the service does: 3 seconds
+// per payment, at most PAYMENT_MAX_CONCURRENT at once
+var payments = orders.NewPaymentProcessor(getEnvInt("PAYMENT_MAX_CONCURRENT", 5))
+
+// errInvalidOrder marks orders that can never be processed
+var errInvalidOrder = errors.New("invalid order")
 
-type Order struct {
-	OrderID    string    `json:"order_id"`
-	CustomerID int       `json:"customer_id"`
-	Status     string    `json:"status"`
-	Items      []Item    `json:"items"`
-	CreatedAt  time.Time `json:"created_at"`
+func getEnvInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
 }
 
+// processOrder claims and charges one order, shared by the SNS and SQS
+// handlers. A duplicate delivery of an order that is already settled or
+// being processed is acknowledged without charging it again; a payment whose
+// result can't be saved is returned as an error so the message is retried.
+func processOrder(ctx context.Context, order *Order, inv invocation) error {
+	if errs := orders.Validate(order, nil, orders.DefaultLimits); len(errs) > 0 {
+		return fmt.Errorf("%w: %s", errInvalidOrder, errs[0].Message)
+	}
 
-func processPayment(order *Order) error {
-	fmt.Printf("Processing payment for order %s (customer: %d)\n", order.OrderID, order.CustomerID)
-	
+	claimed, reason, err := store.claim(ctx, order, inv)
+	if err != nil {
+		return fmt.Errorf("failed to claim order %s: %w", order.OrderID, err)
+	}
+	if !claimed {
+		fmt.Printf("Skipping order %s: %s\n", order.OrderID, reason)
+		return nil
+	}
 
-	time.Sleep(3 * time.Second)
-	
-	fmt.Printf("Payment completed for order %s\n", order.OrderID)
+	fmt.Printf("Lambda processing order: %s (customer: %d, cold start: %t)\n", order.OrderID, order.CustomerID, inv.coldStart)
+	started := time.Now()
+
+	// Authorize (3 seconds) and capture, unless the order is cancelled in between
+	order.Status = orders.StatusProcessing
+	err = orders.Charge(ctx, payments, order, func() error {
+		return store.beginCapture(ctx, order, inv)
+	})
+	if errors.Is(err, orders.ErrCancelled) {
+		fmt.Printf("Order %s cancelled during payment, authorization voided\n", order.OrderID)
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Payment failed for order %s: %v\n", order.OrderID, err)
+		if relErr := store.release(context.Background(), order, inv); relErr != nil {
+			fmt.Printf("Failed to release order %s: %v\n", order.OrderID, relErr)
+		}
+		return err
+	}
+
+	order.Status = orders.StatusCompleted
+	// Record the result even if the invocation is about to time out
+	if err := finishOrder(order, inv, started); err != nil {
+		// Retried rather than acknowledged: the redelivery finds the order
+		// still capturing and leaves it for review instead of charging again
+		fmt.Printf("Failed to record completion of order %s (auth: %s, capture: %s): %v\n",
+			order.OrderID, order.AuthorizationID, order.CaptureID, err)
+		return fmt.Errorf("failed to record completion of order %s: %w", order.OrderID, err)
+	}
+	fmt.Printf("Payment completed for order %s (auth: %s, capture: %s)\n", order.OrderID, order.AuthorizationID, order.CaptureID)
 	return nil
 }
 
+// finishAttempts bounds how often a completed payment's result is saved
+// before the message is handed back
+var finishAttempts = 3
+
+// finishOrder records a completed payment, retrying brief store failures
+func finishOrder(order *Order, inv invocation, started time.Time) error {
+	var err error
+	for attempt := 1; attempt <= finishAttempts; attempt++ {
+		if err = store.finish(context.Background(), order, inv, started); err == nil {
+			return nil
+		}
+		if attempt < finishAttempts {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+	}
+	return err
+}
+
+// handler processes SNS deliveries; one failed payment fails the whole
+// invocation and SNS retries every record in it
 func handler(ctx context.Context, snsEvent events.SNSEvent) error {
 	startTime := time.Now()
-	
+	inv := beginInvocation(ctx)
+
 	for _, record := range snsEvent.Records {
 		snsRecord := record.SNS
-		
+
 		var order Order
 		if err := json.Unmarshal([]byte(snsRecord.Message), &order); err != nil {
 			fmt.Printf("Error parsing order: %v\n", err)
 			continue
 		}
-		
-		fmt.Printf("Lambda processing order: %s (customer: %d)\n", order.OrderID, order.CustomerID)
-		
-		// Process payment (this takes 3 seconds)
-		order.Status = "processing"
-		if err := processPayment(&order); err != nil {
-			order.Status = "failed"
-			fmt.Printf("Payment failed for order %s: %v\n", order.OrderID, err)
+
+		if err := processOrder(ctx, &order, inv); errors.Is(err, errInvalidOrder) {
+			// Retrying can't fix it; drop it like an unparseable message
+			fmt.Printf("Error processing order %s: %v\n", order.OrderID, err)
+			continue
+		} else if err != nil {
 			return err
 		}
-		
-		order.Status = "completed"
+
 		processingTime := time.Since(startTime)
 		fmt.Printf("Order %s completed in %v (including cold start)\n", order.OrderID, processingTime)
 	}
-	
+
 	return nil
 }
 
+// main picks the event source with ORDER_EVENT_SOURCE: "sns" (default)
+// when the function subscribes to the topic, "sqs" when it polls the
+// order queue with ReportBatchItemFailures enabled. `local` runs events
+// from files or HTTP instead (see local_runner.go).
 func main() {
-	lambda.Start(handler)
-}
+	if err := initOrderStore(); err != nil {
+		fmt.Printf("Order store unavailable: %v\n", err)
+		os.Exit(1)
+	}
 
+	if len(os.Args) > 1 && os.Args[1] == "local" {
+		os.Exit(runLocal(os.Args[2:]))
+	}
+
+	switch source := os.Getenv("ORDER_EVENT_SOURCE"); source {
+	case "", "sns":
+		lambda.Start(handler)
+	case "sqs":
+		lambda.Start(sqsHandler)
+	default:
+		fmt.Printf("Unknown ORDER_EVENT_SOURCE %q (expected sns or sqs)\n", source)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	_ "github.com/go-sql-driver/mysql"
+
+	"text/main/orders"
+)
+
+// Order state is written to the service's MySQL orders table so the API
+// (GET /orders/:id, cancel, refund) sees what the Lambda did. Both sides
+// use the orders package types and state machine, so a stored order
+// round-trips without losing fields.
+
+// invocation describes the current Lambda invocation
+type invocation struct {
+	id             string
+	coldStart      bool
+	initDurationMs int64
+	deadline       time.Time
+}
+
+var (
+	processStart = time.Now()
+	coldStart    = true
+)
+
+// beginInvocation is called once per handler call; only the first
+// invocation of a new execution environment is a cold start
+func beginInvocation(ctx context.Context) invocation {
+	inv := invocation{coldStart: coldStart}
+	if coldStart {
+		inv.initDurationMs = time.Since(processStart).Milliseconds()
+		coldStart = false
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		inv.id = lc.AwsRequestID
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		inv.deadline = deadline
+	} else {
+		inv.deadline = time.Now().Add(15 * time.Minute)
+	}
+	return inv
+}
+
+// orderStore records order status. claim must succeed before an order is
+// charged; it returns false (with a reason) for orders that are already
+// settled, cancelled or held by another live invocation, which makes
+// duplicate deliveries harmless. beginCapture returns orders.ErrCancelled
+// if the order was cancelled while it was being authorized.
+type orderStore interface {
+	claim(ctx context.Context, order *Order, inv invocation) (bool, string, error)
+	beginCapture(ctx context.Context, order *Order, inv invocation) error
+	finish(ctx context.Context, order *Order, inv invocation, started time.Time) error
+	release(ctx context.Context, order *Order, inv invocation) error
+}
+
+var store orderStore = noopOrderStore{}
+
+// initOrderStore connects to MySQL when DB_HOST is set, like the service
+func initOrderStore() error {
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		fmt.Println("No DB_HOST configured - order status will not be persisted")
+		return nil
+	}
+	port := os.Getenv("DB_PORT")
+	if port == "" {
+		port = "3306"
+	}
+	name := os.Getenv("DB_NAME")
+	if name == "" {
+		name = "ecommerce"
+	}
+
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), host, port, name)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	// One invocation runs at a time per environment; keep the pool small
+	db.SetMaxOpenConns(2)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	store = &sqlOrderStore{db: db}
+	fmt.Printf("Order status stored in MySQL (%s:%s/%s)\n", host, port, name)
+	return nil
+}
+
+type noopOrderStore struct{}
+
+func (noopOrderStore) claim(context.Context, *Order, invocation) (bool, string, error) {
+	return true, "", nil
+}
+func (noopOrderStore) beginCapture(context.Context, *Order, invocation) error      { return nil }
+func (noopOrderStore) finish(context.Context, *Order, invocation, time.Time) error { return nil }
+func (noopOrderStore) release(context.Context, *Order, invocation) error           { return nil }
+
+type sqlOrderStore struct {
+	db *sql.DB
+}
+
+// update runs fn on the locked order row, inserting it first if the order
+// never reached the service's store (e.g. published without MySQL)
+func (s *sqlOrderStore) update(ctx context.Context, order *Order, fn func(*Order) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pending := *order
+	pending.Status = orders.StatusPending
+	payload, err := json.Marshal(&pending)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT IGNORE INTO orders (order_id, customer_id, status, total, payload, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, NOW())`,
+		order.OrderID, order.CustomerID, pending.Status, order.Total(), payload, order.CreatedAt); err != nil {
+		return err
+	}
+
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, "SELECT payload FROM orders WHERE order_id = ? FOR UPDATE", order.OrderID).Scan(&raw); err != nil {
+		return err
+	}
+	var stored Order
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return fmt.Errorf("failed to parse stored order: %w", err)
+	}
+
+	if err := fn(&stored); err != nil {
+		return err
+	}
+
+	if raw, err = json.Marshal(&stored); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE orders SET status = ?, payload = ?, updated_at = NOW() WHERE order_id = ?",
+		stored.Status, raw, order.OrderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlOrderStore) claim(ctx context.Context, order *Order, inv invocation) (bool, string, error) {
+	claimed, reason := false, ""
+	err := s.update(ctx, order, func(o *Order) error {
+		claimed, reason = claimStored(o, inv, time.Now().UTC())
+		return nil
+	})
+	return claimed, reason, err
+}
+
+// claimStored moves a stored order to processing for inv, or says why not
+func claimStored(o *Order, inv invocation, now time.Time) (bool, string) {
+	// Held until the claiming invocation's deadline; after that it died, and
+	// orders.Claim leaves an order it died capturing for review
+	if (o.Status == orders.StatusProcessing || o.Status == orders.StatusCapturing) &&
+		o.Processing != nil && now.Before(o.Processing.ClaimExpiresAt) {
+		return false, "being processed by invocation " + o.Processing.InvocationID
+	}
+	if !orders.Claim(o) {
+		return false, "already " + o.Status
+	}
+
+	attempts := 1
+	if o.Processing != nil {
+		attempts = o.Processing.Attempts + 1
+	}
+	o.Processing = &orders.OrderProcessing{
+		Processor:      "lambda",
+		InvocationID:   inv.id,
+		ColdStart:      inv.coldStart,
+		InitDurationMs: inv.initDurationMs,
+		Attempts:       attempts,
+		ClaimedAt:      now,
+		ClaimExpiresAt: inv.deadline.UTC(),
+	}
+	return true, ""
+}
+
+// ownedBy reports whether inv holds the order's current claim
+func ownedBy(o *Order, inv invocation) bool {
+	return o.Processing != nil && o.Processing.InvocationID == inv.id
+}
+
+func (s *sqlOrderStore) beginCapture(ctx context.Context, order *Order, inv invocation) error {
+	cancelled := false
+	err := s.update(ctx, order, func(o *Order) error {
+		if !ownedBy(o, inv) {
+			return fmt.Errorf("order %s is no longer claimed by this invocation", order.OrderID)
+		}
+		// The cancellation is saved, so the error is only reported afterwards
+		cancelled = errors.Is(orders.BeginCapture(o), orders.ErrCancelled)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		// Like the service's worker, free the coupons the order redeemed
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM coupon_redemptions WHERE order_id = ?", order.OrderID); err != nil {
+			fmt.Printf("Warning: order %s cancelled but its coupons were not released: %v\n", order.OrderID, err)
+		}
+		return orders.ErrCancelled
+	}
+	return nil
+}
+
+func (s *sqlOrderStore) finish(ctx context.Context, order *Order, inv invocation, started time.Time) error {
+	return s.update(ctx, order, func(o *Order) error {
+		if !ownedBy(o, inv) {
+			return fmt.Errorf("order %s is no longer claimed by this invocation", order.OrderID)
+		}
+		finished := time.Now().UTC()
+		o.Status = order.Status
+		o.AuthorizationID = order.AuthorizationID
+		o.CaptureID = order.CaptureID
+		o.Processing.FinishedAt = &finished
+		o.Processing.DurationMs = finished.Sub(started).Milliseconds()
+		return nil
+	})
+}
+
+// release hands a claimed order back so a retry can process it
+func (s *sqlOrderStore) release(ctx context.Context, order *Order, inv invocation) error {
+	return s.update(ctx, order, func(o *Order) error {
+		if !ownedBy(o, inv) {
+			return nil
+		}
+		o.Status = orders.StatusPending
+		o.Processing.ClaimExpiresAt = time.Now().UTC()
+		return nil
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"text/main/orders"
+)
+
+func TestClaimStored(t *testing.T) {
+	now := time.Now()
+	first := invocation{id: "req-1", coldStart: true, deadline: now.Add(time.Minute)}
+	second := invocation{id: "req-2", deadline: now.Add(time.Minute)}
+
+	o := &Order{Status: "pending"}
+	if ok, reason := claimStored(o, first, now); !ok {
+		t.Fatalf("pending order should be claimed, got %q", reason)
+	}
+	if o.Status != "processing" || o.Processing.InvocationID != "req-1" || !o.Processing.ColdStart || o.Processing.Attempts != 1 {
+		t.Errorf("unexpected claim: %s %+v", o.Status, o.Processing)
+	}
+
+	// A duplicate delivery while the first invocation is still running
+	if ok, _ := claimStored(o, second, now.Add(time.Second)); ok {
+		t.Error("order held by a live invocation must not be claimed twice")
+	}
+
+	// The first invocation timed out without finishing
+	if ok, _ := claimStored(o, second, now.Add(2*time.Minute)); !ok {
+		t.Error("expired claim should be taken over")
+	}
+	if o.Processing.InvocationID != "req-2" || o.Processing.Attempts != 2 {
+		t.Errorf("unexpected takeover: %+v", o.Processing)
+	}
+
+	for _, status := range []string{"completed", "failed", "cancelled", "refunded"} {
+		settled := &Order{Status: status}
+		if ok, _ := claimStored(settled, first, now); ok || settled.Status != status {
+			t.Errorf("%s order must not be claimed", status)
+		}
+	}
+
+	// The invocation died mid-capture: the card may already be charged
+	capturing := &Order{Status: "capturing", AuthorizationID: "auth-1",
+		Processing: &orders.OrderProcessing{InvocationID: "req-1", ClaimExpiresAt: now.Add(time.Minute)}}
+	if ok, _ := claimStored(capturing, second, now); ok || capturing.Status != "capturing" {
+		t.Errorf("capture held by a live invocation must not be touched, got %s", capturing.Status)
+	}
+	if ok, _ := claimStored(capturing, second, now.Add(2*time.Minute)); ok || capturing.Status != "needs_review" {
+		t.Errorf("interrupted capture must be left for review, got %s", capturing.Status)
+	}
+
+	cancelled := &Order{Status: "cancel_requested"}
+	if ok, _ := claimStored(cancelled, first, now); ok || cancelled.Status != "cancelled" {
+		t.Errorf("cancel_requested order should be cancelled, got %s", cancelled.Status)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// snsEnvelope is the SQS body when the queue subscribes to the order topic
+// without raw message delivery
+type snsEnvelope struct {
+	Type      string `json:"Type"`
+	MessageID string `json:"MessageId"`
+	Message   string `json:"Message"`
+}
+
+// paymentBudget is the time left that an order needs to be worth starting;
+// records that can't finish before the deadline are handed back to SQS
+var paymentBudget = 5 * time.Second
+
+// parseSQSOrder accepts both raw order bodies and SNS-wrapped ones
+func parseSQSOrder(body string) (Order, error) {
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	var order Order
+	if err := json.Unmarshal([]byte(body), &order); err != nil {
+		return Order{}, err
+	}
+	if order.OrderID == "" {
+		return Order{}, fmt.Errorf("message has no order_id")
+	}
+	return order, nil
+}
+
+// sqsHandler processes an SQS batch and reports only the records that
+// failed, so SQS deletes the rest and redelivers just those. Unparseable
+// records are reported too, which lets the queue's redrive policy move
+// them to the dead-letter queue instead of losing them.
+func sqsHandler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	startTime := time.Now()
+	inv := beginInvocation(ctx)
+	var response events.SQSEventResponse
+	fail := func(record events.SQSMessage) {
+		response.BatchItemFailures = append(response.BatchItemFailures,
+			events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+	}
+
+	for _, record := range sqsEvent.Records {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < paymentBudget {
+			fmt.Printf("Returning message %s to the queue: %v left before timeout\n",
+				record.MessageId, time.Until(deadline).Round(time.Millisecond))
+			fail(record)
+			continue
+		}
+
+		order, err := parseSQSOrder(record.Body)
+		if err != nil {
+			fmt.Printf("Error parsing message %s: %v\n", record.MessageId, err)
+			fail(record)
+			continue
+		}
+
+		if err := processOrder(ctx, &order, inv); err != nil {
+			fmt.Printf("Error processing message %s: %v\n", record.MessageId, err)
+			fail(record)
+			continue
+		}
+		fmt.Printf("Order %s completed in %v (including cold start)\n", order.OrderID, time.Since(startTime))
+	}
+
+	processed, failed := payments.Stats()
+	fmt.Printf("Processed batch of %d message(s), %d failed (payments so far: %d processed, %d failed)\n",
+		len(sqsEvent.Records), len(response.BatchItemFailures), processed, failed)
+	return response, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestSQSHandler_ReportsOnlyFailedRecords(t *testing.T) {
+	payments.Delay = 0
+	defer func() { payments.Delay = 3 * time.Second }()
+
+	wrapped, _ := json.Marshal(snsEnvelope{Type: "Notification", Message: `{"order_id":"o-2","customer_id":2,"items":[{"product_id":"2","quantity":1,"price":2}]}`})
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m-1", Body: `{"order_id":"o-1","customer_id":1,"items":[{"product_id":"1","quantity":1,"price":1}]}`},
+		{MessageId: "m-2", Body: string(wrapped)},
+		{MessageId: "m-3", Body: `not json`},
+		{MessageId: "m-4", Body: `{"customer_id":4}`},
+	}}
+
+	response, err := sqsHandler(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	var failed []string
+	for _, f := range response.BatchItemFailures {
+		failed = append(failed, f.ItemIdentifier)
+	}
+	if len(failed) != 2 || failed[0] != "m-3" || failed[1] != "m-4" {
+		t.Errorf("expected m-3 and m-4 to fail, got %v", failed)
+	}
+}
+
+func TestSQSHandler_ReturnsRecordsNearDeadline(t *testing.T) {
+	payments.Delay = 0
+	defer func() { payments.Delay = 3 * time.Second }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), paymentBudget/2)
+	defer cancel()
+	event := events.SQSEvent{Records: []events.SQSMessage{{MessageId: "m-1", Body: `{"order_id":"o-1"}`}}}
+
+	response, _ := sqsHandler(ctx, event)
+	if len(response.BatchItemFailures) != 1 {
+		t.Errorf("record should be handed back before the timeout, got %+v", response)
+	}
+}
+
+// unrecordedStore charges orders but can't save their completion
+type unrecordedStore struct {
+	noopOrderStore
+	finishes int
+}
+
+func (s *unrecordedStore) finish(context.Context, *Order, invocation, time.Time) error {
+	s.finishes++
+	return errors.New("connection lost")
+}
+
+func TestSQSHandler_RetriesOrdersItCouldNotRecord(t *testing.T) {
+	payments.Delay = 0
+	defer func() { payments.Delay = 3 * time.Second }()
+	failing := &unrecordedStore{}
+	previous := store
+	store = failing
+	defer func() { store = previous }()
+
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m-1", Body: `{"order_id":"o-1","customer_id":1,"items":[{"product_id":"1","quantity":1,"price":1}]}`},
+	}}
+	response, _ := sqsHandler(context.Background(), event)
+	if len(response.BatchItemFailures) != 1 || failing.finishes != finishAttempts {
+		t.Errorf("charged order must be redelivered when its completion isn't saved, got %+v after %d attempt(s)",
+			response, failing.finishes)
+	}
+}
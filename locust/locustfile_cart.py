@@ -19,6 +19,12 @@ from locust import FastHttpUser, task, between
 import random
 import json
 
+
+def catalog_price(product_id: int) -> float:
+    """Price of a product in the server's generated catalog."""
+    return round(product_id % 500 + 1 - 0.01, 2)
+
+
 class CartUser(FastHttpUser):
     """
     Simulates a user shopping on the e-commerce site.
@@ -57,18 +63,15 @@ class CartUser(FastHttpUser):
         if not self.cart_id:
             return
         
-        product_id = f"prod-{random.randint(1, 1000)}"
-        product_name = f"Product {random.randint(1, 1000)}"
+        product_id = random.randint(1, 1000)
         quantity = random.randint(1, 5)
-        price = round(random.uniform(10.0, 200.0), 2)
         
         response = self.client.post(
             f"/carts/{self.cart_id}/items",
             json={
-                "product_id": product_id,
-                "product_name": product_name,
+                "product_id": str(product_id),
                 "quantity": quantity,
-                "price_per_unit": price
+                "price_per_unit": catalog_price(product_id)
             },
             name="POST /carts/:cart_id/items (add item)"
         )
@@ -189,10 +192,9 @@ class HighLoadCartUser(FastHttpUser):
                 self.client.post(
                     f"/carts/{self.cart_id}/items",
                     json={
-                        "product_id": f"prod-{i}",
-                        "product_name": f"Product {i}",
+                        "product_id": str(i + 1),
                         "quantity": random.randint(1, 3),
-                        "price_per_unit": round(random.uniform(10.0, 100.0), 2)
+                        "price_per_unit": catalog_price(i + 1)
                     },
                     name="Setup: Add items"
                 )
@@ -8,6 +8,11 @@ def random_id(prefix: str = "p") -> str:
     return f"{prefix}-{''.join(random.choices(string.ascii_lowercase + string.digits, k=6))}"
 
 
+def catalog_price(product_id: int) -> float:
+    """Price of a product in the server's generated catalog."""
+    return round(product_id % 500 + 1 - 0.01, 2)
+
+
 class ProductsFastUser(FastHttpUser):
     wait_time = between(0.5, 2.0)
 
@@ -17,12 +22,12 @@ class ProductsFastUser(FastHttpUser):
 
     @task(2)
     def create_product(self):
-        pid = random_id()
+        pid = random.randint(1, 1000)
         payload = {
-            "id": pid,
+            "id": str(pid),
             "name": "Widget",
             "description": "FastHttp load test item",
-            "price": round(random.uniform(1.0, 50.0), 2),
+            "price": catalog_price(pid),
         }
         headers = {"Content-Type": "application/json"}
         self.client.post("/products", json=payload, headers=headers, name="create_product")
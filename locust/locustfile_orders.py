@@ -8,6 +8,12 @@ import os
 USE_ASYNC = os.getenv('ASYNC_MODE', 'false').lower() == 'true'
 ENDPOINT = '/orders/async' if USE_ASYNC else '/orders/sync'
 
+
+def catalog_price(product_id: int) -> float:
+    """Price of a product in the server's generated catalog."""
+    return round(product_id % 500 + 1 - 0.01, 2)
+
+
 class OrderUser(FastHttpUser):
 
     # Wait time between requests (100-500ms as specified)
@@ -19,14 +25,15 @@ class OrderUser(FastHttpUser):
     @task
     def create_order(self):
 
-        # Generate random order data
+        # Generate random order data for a catalog product
+        product_id = random.randint(1, 100)
         order = {
             "customer_id": self.customer_id,
             "items": [
                 {
-                    "product_id": f"prod-{random.randint(1, 100)}",
+                    "product_id": str(product_id),
                     "quantity": random.randint(1, 5),
-                    "price": round(random.uniform(10.0, 200.0), 2)
+                    "price": catalog_price(product_id)
                 }
             ]
         }
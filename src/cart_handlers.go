@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
@@ -181,6 +182,11 @@ func addItemToCart(c *gin.Context) {
 		return
 	}
 
+	if errs := priceCartItem(&req); len(errs) > 0 {
+		rejectInvalidCartItem(c, errs)
+		return
+	}
+
 	// Verify cart exists
 	var exists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM carts WHERE cart_id = ?)", cartID).Scan(&exists)
@@ -195,6 +201,7 @@ func addItemToCart(c *gin.Context) {
 		VALUES (?, ?, ?, ?, ?, NOW(), NOW())
 		ON DUPLICATE KEY UPDATE 
 			quantity = quantity + VALUES(quantity),
+			price_per_unit = VALUES(price_per_unit),
 			updated_at = NOW()`,
 		cartID, req.ProductID, req.ProductName, req.Quantity, req.PricePerUnit)
 
@@ -386,7 +393,8 @@ func deleteCart(c *gin.Context) {
 	})
 }
 
-// checkoutCart marks a cart as checked out
+// checkoutCart converts an active cart into a pending order and queues payment.
+// Cart status, the order and both outbox events commit in one transaction.
 // POST /carts/:cart_id/checkout
 func checkoutCart(c *gin.Context) {
 	if db == nil {
@@ -396,27 +404,105 @@ func checkoutCart(c *gin.Context) {
 
 	cartID := c.Param("cart_id")
 
-	result, err := db.Exec(`
-		UPDATE carts 
-		SET status = 'checked_out', updated_at = NOW()
-		WHERE cart_id = ? AND status = 'active'`,
-		cartID)
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the cart so concurrent checkouts and item changes wait for us
+	var customerID, status string
+	err = tx.QueryRow("SELECT customer_id, status FROM carts WHERE cart_id = ? FOR UPDATE", cartID).Scan(&customerID, &status)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cart not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load cart"})
+		return
+	}
+	if status != "active" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("cart is %s", status)})
+		return
+	}
 
+	rows, err := tx.Query(`
+		SELECT product_id, quantity, price_per_unit
+		FROM cart_items
+		WHERE cart_id = ?
+		ORDER BY item_id`, cartID)
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load cart items"})
+		return
+	}
+	var items []Item
+	for rows.Next() {
+		var item Item
+		if err := rows.Scan(&item.ProductID, &item.Quantity, &item.Price); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan cart items"})
+			return
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load cart items"})
+		return
+	}
+
+	order, err := orderFromCart(cartID, customerID, items)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Coupons are locked and re-checked so usage limits hold under concurrent checkouts
+	coupons, err := redeemCoupons(tx, cartID, customerID, order.OrderID)
+	if err != nil {
+		writeCouponError(c, err)
+		return
+	}
+
+	order.Region = c.Query("region")
+	if errs := prepareOrder(&order, couponPromotions(coupons)...); len(errs) > 0 {
+		rejectInvalidOrder(c, errs)
+		return
+	}
+
+	if err := enqueueOrder(tx, &order); err != nil {
+		fmt.Printf("Error creating order for cart %s: %v\n", cartID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create order"})
+		return
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE carts 
+		SET status = 'checked_out', updated_at = NOW()
+		WHERE cart_id = ?`,
+		cartID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to checkout cart"})
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "cart not found or already checked out"})
+	if cartEventPublisher != nil {
+		event, _ := json.Marshal(gin.H{"cart_id": cartID, "order_id": order.OrderID, "status": "checked_out", "checked_out_at": order.CreatedAt})
+		if err := enqueueOutboxEvent(tx, outboxCartEvents, "cart.checked_out", cartID, event, nil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record checkout event"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "cart checked out successfully",
-		"cart_id": cartID,
-		"status":  "checked_out",
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      "cart checked out, payment queued",
+		"cart_id":      cartID,
+		"status":       "checked_out",
+		"order_id":     order.OrderID,
+		"order_status": order.Status,
+		"total":        order.Total(),
 	})
 }
-
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func postCartItem(body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/carts/:cart_id/items", addItemToCart)
+	req := httptest.NewRequest(http.MethodPost, "/carts/cart-1/items", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAddItemToCart_UsesCatalogPrice(t *testing.T) {
+	catalog := withCatalog(t)
+	p, _ := catalog.lookup("3")
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"price omitted", `{"product_id":"3","quantity":2}`, http.StatusCreated},
+		{"catalog price", fmt.Sprintf(`{"product_id":"3","quantity":2,"price_per_unit":%.2f}`, p.Price), http.StatusCreated},
+		{"wrong price", fmt.Sprintf(`{"product_id":"3","quantity":2,"price_per_unit":%.2f}`, p.Price+5), http.StatusUnprocessableEntity},
+		{"unknown product", `{"product_id":"prod-3","quantity":2,"price_per_unit":9.99}`, http.StatusUnprocessableEntity},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := withFakeSQL(t)
+			fake.onQuery("SELECT EXISTS", []string{"exists"}, []driver.Value{true})
+
+			w := postCartItem(tc.body)
+			if w.Code != tc.status {
+				t.Fatalf("expected %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			inserted := fake.executed("INSERT INTO cart_items")
+			if tc.status != http.StatusCreated {
+				if len(inserted) != 0 {
+					t.Fatal("rejected item was stored")
+				}
+				return
+			}
+			// product_name and price_per_unit come from the catalog
+			if len(inserted) != 1 || inserted[0].args[2] != p.Name || inserted[0].args[4] != p.Price {
+				t.Fatalf("unexpected insert: %+v", inserted)
+			}
+		})
+	}
+}
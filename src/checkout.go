@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errCartEmpty = errors.New("cart has no items")
+
+// orderFromCart snapshots cart lines into a new pending order. Totals are
+// always computed from the snapshot, never taken from the client.
+func orderFromCart(cartID, customerID string, items []Item) (Order, error) {
+	if len(items) == 0 {
+		return Order{}, errCartEmpty
+	}
+
+	snapshot := make([]Item, len(items))
+	copy(snapshot, items)
+
+	return Order{
+		OrderID:     generateOrderID(),
+		CartID:      cartID,
+		CustomerRef: customerID,
+		Status:      "pending",
+		Items:       snapshot,
+		CreatedAt:   time.Now(),
+	}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOrderFromCart(t *testing.T) {
+	if _, err := orderFromCart("cart-1", "cust-1", nil); err != errCartEmpty {
+		t.Fatalf("expected errCartEmpty for empty cart, got %v", err)
+	}
+
+	items := []Item{{ProductID: "1", Quantity: 2, Price: 5}, {ProductID: "2", Quantity: 1, Price: 2.5}}
+	order, err := orderFromCart("cart-1", "cust-1", items)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if order.OrderID == "" || order.Status != "pending" || order.CartID != "cart-1" || order.CustomerRef != "cust-1" {
+		t.Fatalf("unexpected order: %+v", order)
+	}
+	if order.Total() != 12.5 {
+		t.Fatalf("expected total 12.5, got %v", order.Total())
+	}
+
+	// The order keeps its own copy of the lines
+	items[0].Quantity = 100
+	if order.Items[0].Quantity != 2 {
+		t.Fatal("order items should not alias the cart lines")
+	}
+}
+
+func withCatalog(t *testing.T) *productStore {
+	previous := store
+	store = newProductStore()
+	store.generateProducts()
+	t.Cleanup(func() { store = previous })
+	return store
+}
+
+func postCheckout(cartID string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/carts/:cart_id/checkout", checkoutCart)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/carts/"+cartID+"/checkout", nil))
+	return w
+}
+
+// scriptCart answers the checkout's cart and cart item queries
+func scriptCart(fake *fakeSQL, status string, items ...Item) {
+	fake.onQuery("FROM carts WHERE cart_id", []string{"customer_id", "status"}, []driver.Value{"cust-1", status})
+	var rows [][]driver.Value
+	for _, item := range items {
+		rows = append(rows, []driver.Value{item.ProductID, int64(item.Quantity), item.Price})
+	}
+	fake.onQuery("FROM cart_items", []string{"product_id", "quantity", "price_per_unit"}, rows...)
+}
+
+func TestCheckoutCart_CreatesOrderInOneTransaction(t *testing.T) {
+	catalog := withCatalog(t)
+	fake := withFakeSQL(t)
+	p, _ := catalog.lookup("1")
+	scriptCart(fake, "active", Item{ProductID: "1", Quantity: 2, Price: p.Price})
+
+	w := postCheckout("cart-1")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		OrderID string `json:"order_id"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+
+	inserted := fake.executed("INSERT INTO orders")
+	if len(inserted) != 1 || inserted[0].args[0] != body.OrderID || inserted[0].args[2] != "cart-1" || inserted[0].args[3] != "cust-1" {
+		t.Fatalf("unexpected order insert: %+v", inserted)
+	}
+	outbox := fake.executed("INSERT INTO outbox")
+	if len(outbox) != 1 || outbox[0].args[0] != outboxOrders || outbox[0].args[2] != body.OrderID {
+		t.Fatalf("expected one order.created outbox row, got %+v", outbox)
+	}
+	if len(fake.executed("UPDATE carts")) != 1 || fake.commits != 1 {
+		t.Fatalf("expected cart update and commit, got %d commits", fake.commits)
+	}
+}
+
+func TestCheckoutCart_RecordsCartEventWithPublisher(t *testing.T) {
+	catalog := withCatalog(t)
+	fake := withFakeSQL(t)
+	p, _ := catalog.lookup("1")
+	scriptCart(fake, "active", Item{ProductID: "1", Quantity: 1, Price: p.Price})
+	previous := cartEventPublisher
+	cartEventPublisher = &recordingPublisher{}
+	t.Cleanup(func() { cartEventPublisher = previous })
+
+	if w := postCheckout("cart-1"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+	}
+	outbox := fake.executed("INSERT INTO outbox")
+	if len(outbox) != 2 || outbox[1].args[0] != outboxCartEvents || outbox[1].args[1] != "cart.checked_out" {
+		t.Fatalf("expected order and cart outbox rows, got %+v", outbox)
+	}
+}
+
+func TestCheckoutCart_Rejections(t *testing.T) {
+	catalog := withCatalog(t)
+	p, _ := catalog.lookup("1")
+	limited := []driver.Value{"WELCOME10", "percent", 10.0, "", int64(0), int64(0), 0.0, nil, int64(1), true}
+
+	cases := []struct {
+		name   string
+		script func(*fakeSQL)
+		status int
+	}{
+		{"missing cart", func(f *fakeSQL) {}, http.StatusNotFound},
+		{"checked out cart", func(f *fakeSQL) { scriptCart(f, "checked_out", Item{ProductID: "1", Quantity: 1, Price: p.Price}) }, http.StatusConflict},
+		{"empty cart", func(f *fakeSQL) { scriptCart(f, "active") }, http.StatusBadRequest},
+		{"stale price", func(f *fakeSQL) { scriptCart(f, "active", Item{ProductID: "1", Quantity: 1, Price: p.Price + 1}) }, http.StatusUnprocessableEntity},
+		{"coupon used up", func(f *fakeSQL) {
+			scriptCart(f, "active", Item{ProductID: "1", Quantity: 1, Price: p.Price})
+			f.onQuery("FROM cart_coupons", []string{"code", "kind", "value", "product_id", "buy_quantity", "get_quantity",
+				"min_spend", "expires_at", "per_customer_limit", "active"}, limited)
+			f.onQuery("COUNT(*) FROM coupon_redemptions", []string{"count"}, []driver.Value{int64(1)})
+		}, http.StatusUnprocessableEntity},
+		{"order insert fails", func(f *fakeSQL) {
+			scriptCart(f, "active", Item{ProductID: "1", Quantity: 1, Price: p.Price})
+			f.onExec("INSERT INTO orders", 0, errors.New("duplicate entry for unique_cart_order"))
+		}, http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := withFakeSQL(t)
+			tc.script(fake)
+			if w := postCheckout("cart-1"); w.Code != tc.status {
+				t.Fatalf("expected %d, got %d: %s", tc.status, w.Code, w.Body.String())
+			}
+			if fake.commits != 0 || fake.rollbacks != 1 {
+				t.Fatalf("expected rollback only, got %d commits %d rollbacks", fake.commits, fake.rollbacks)
+			}
+		})
+	}
+}
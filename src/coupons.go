@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// coupon is a row of the coupons table
+type coupon struct {
+	Code             string
+	Kind             string // percent, fixed, buy_x_get_y
+	Value            float64
+	ProductID        string
+	BuyQuantity      int
+	GetQuantity      int
+	MinSpend         float64
+	ExpiresAt        sql.NullTime
+	PerCustomerLimit int // 0 means unlimited
+	Active           bool
+}
+
+// couponError is a coupon the customer can't use, with a machine-readable reason
+type couponError struct {
+	Code    string
+	Reason  string
+	Message string
+}
+
+func (e *couponError) Error() string {
+	return fmt.Sprintf("coupon %s: %s", e.Code, e.Message)
+}
+
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const couponColumns = `code, kind, value, COALESCE(product_id, ''), buy_quantity, get_quantity,
+	min_spend, expires_at, per_customer_limit, active`
+
+func scanCoupon(scan func(dest ...interface{}) error) (coupon, error) {
+	var cp coupon
+	err := scan(&cp.Code, &cp.Kind, &cp.Value, &cp.ProductID, &cp.BuyQuantity, &cp.GetQuantity,
+		&cp.MinSpend, &cp.ExpiresAt, &cp.PerCustomerLimit, &cp.Active)
+	return cp, err
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// loadCoupon reads one coupon, or a couponError if the code doesn't exist
+func loadCoupon(q sqlQueryer, code string) (coupon, error) {
+	cp, err := scanCoupon(q.QueryRow("SELECT "+couponColumns+" FROM coupons WHERE code = ?", code).Scan)
+	if err == sql.ErrNoRows {
+		return coupon{}, &couponError{Code: code, Reason: "coupon_not_found", Message: "unknown coupon code"}
+	}
+	return cp, err
+}
+
+// cartCoupons returns the coupons applied to a cart. With lock set the
+// coupon rows are locked FOR UPDATE, serializing concurrent redemptions of
+// the same code so usage limits hold.
+func cartCoupons(q sqlQueryer, cartID string, lock bool) ([]coupon, error) {
+	query := `
+		SELECT ` + couponColumns + `
+		FROM cart_coupons cc
+		JOIN coupons USING (code)
+		WHERE cc.cart_id = ?
+		ORDER BY cc.applied_at, code`
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	rows, err := q.Query(query, cartID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coupons []coupon
+	for rows.Next() {
+		cp, err := scanCoupon(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, cp)
+	}
+	return coupons, rows.Err()
+}
+
+// promotion turns the coupon into a pricing rule
+func (cp coupon) promotion() promotion {
+	switch cp.Kind {
+	case "percent":
+		return percentOff{Name: cp.Code, Percent: cp.Value, MinSubtotal: cp.MinSpend}
+	case "fixed":
+		return fixedOff{Name: cp.Code, Amount: cp.Value, MinSubtotal: cp.MinSpend}
+	default:
+		return buyXGetY{Name: cp.Code, ProductID: cp.ProductID, Buy: cp.BuyQuantity, Get: cp.GetQuantity, MinSubtotal: cp.MinSpend}
+	}
+}
+
+func couponPromotions(coupons []coupon) []promotion {
+	promos := make([]promotion, 0, len(coupons))
+	for _, cp := range coupons {
+		promos = append(promos, cp.promotion())
+	}
+	return promos
+}
+
+// checkUsable verifies the coupon is active, unexpired and under the
+// customer's usage limit. Run it inside the checkout transaction, after
+// locking the coupon, with lock set for the limit to be enforced atomically:
+// the count is then a locking read, so it sees redemptions committed after
+// the transaction's snapshot was taken.
+func (cp coupon) checkUsable(q sqlQueryer, customerID string, now time.Time, lock bool) error {
+	if !cp.Active {
+		return &couponError{Code: cp.Code, Reason: "coupon_inactive", Message: "coupon is no longer active"}
+	}
+	if cp.ExpiresAt.Valid && !now.Before(cp.ExpiresAt.Time) {
+		return &couponError{Code: cp.Code, Reason: "coupon_expired", Message: "coupon has expired"}
+	}
+	if cp.PerCustomerLimit > 0 {
+		query := "SELECT COUNT(*) FROM coupon_redemptions WHERE code = ? AND customer_id = ?"
+		if lock {
+			query += " FOR UPDATE"
+		}
+		var used int
+		if err := q.QueryRow(query, cp.Code, customerID).Scan(&used); err != nil {
+			return err
+		}
+		if used >= cp.PerCustomerLimit {
+			return &couponError{Code: cp.Code, Reason: "coupon_limit_reached",
+				Message: fmt.Sprintf("coupon may be used %d time(s) per customer", cp.PerCustomerLimit)}
+		}
+	}
+	return nil
+}
+
+// redeemCoupons locks and re-checks the cart's coupons, then records their
+// use by the order. It must run in the checkout transaction.
+func redeemCoupons(tx *sql.Tx, cartID, customerID, orderID string) ([]coupon, error) {
+	coupons, err := cartCoupons(tx, cartID, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cart coupons: %w", err)
+	}
+
+	now := time.Now()
+	for _, cp := range coupons {
+		if err := cp.checkUsable(tx, customerID, now, true); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO coupon_redemptions (code, customer_id, order_id)
+			VALUES (?, ?, ?)`,
+			cp.Code, customerID, orderID); err != nil {
+			return nil, fmt.Errorf("failed to record coupon redemption: %w", err)
+		}
+	}
+	return coupons, nil
+}
+
+// releaseCoupons frees the order's redemptions once it is cancelled or its
+// fulfillment compensated, so they stop counting against usage limits.
+// Releasing twice is harmless.
+func releaseCoupons(ctx context.Context, orderID string) error {
+	if db == nil {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM coupon_redemptions WHERE order_id = ?", orderID); err != nil {
+		return fmt.Errorf("failed to release coupon redemptions: %w", err)
+	}
+	return nil
+}
+
+// writeCouponError responds with the coupon problem, or a 500 for anything else
+func writeCouponError(c *gin.Context, err error) {
+	if ce, ok := err.(*couponError); ok {
+		status := http.StatusUnprocessableEntity
+		if ce.Reason == "coupon_not_found" {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"error":   ce.Reason,
+			"code":    ce.Code,
+			"message": ce.Message,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":   "coupon_check_failed",
+		"message": "Failed to verify coupon",
+	})
+}
+
+// ApplyCouponRequest is the body of POST /shopping-carts/:id/coupons
+type ApplyCouponRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// POST /shopping-carts/:id/coupons - Apply a coupon code to an active cart
+func applyCouponToShoppingCart(c *gin.Context) {
+	if db == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "database_unavailable",
+			"message": "Database connection not configured",
+		})
+		return
+	}
+
+	cartID := c.Param("id")
+	var req ApplyCouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "invalid_request",
+			"message": err.Error(),
+		})
+		return
+	}
+	code := normalizeCouponCode(req.Code)
+
+	var customerID, status string
+	err := db.QueryRow("SELECT customer_id, status FROM carts WHERE cart_id = ?", cartID).Scan(&customerID, &status)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "cart_not_found",
+			"message": fmt.Sprintf("Shopping cart with ID '%s' not found", cartID),
+		})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "cart_check_failed",
+			"message": "Failed to verify cart",
+		})
+		return
+	}
+	if status != "active" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "cart_not_active",
+			"message": fmt.Sprintf("Cannot apply coupons to cart with status '%s'", status),
+		})
+		return
+	}
+
+	cp, err := loadCoupon(db, code)
+	if err == nil {
+		err = cp.checkUsable(db, customerID, time.Now(), false)
+	}
+	if err != nil {
+		writeCouponError(c, err)
+		return
+	}
+
+	items, err := shoppingCartLines(db, cartID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "query_failed",
+			"message": "Failed to load cart items",
+		})
+		return
+	}
+	applied, err := cartCoupons(db, cartID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "query_failed",
+			"message": "Failed to load cart coupons",
+		})
+		return
+	}
+	for _, existing := range applied {
+		if existing.Code == cp.Code {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "coupon_already_applied",
+				"code":    cp.Code,
+				"message": "Coupon is already applied to this cart",
+			})
+			return
+		}
+	}
+
+	// Minimum spend is checked now so the customer hears about it; pricing
+	// also re-checks it in case items are removed later
+	pricing := quoteShoppingCart(items, c.Query("region"), couponPromotions(append(applied, cp))...)
+	if pricing.Subtotal < cp.MinSpend {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":   "min_spend_not_met",
+			"code":    cp.Code,
+			"message": fmt.Sprintf("Coupon requires a minimum spend of %.2f", cp.MinSpend),
+		})
+		return
+	}
+
+	if _, err := db.Exec(`
+		INSERT IGNORE INTO cart_coupons (cart_id, code) VALUES (?, ?)`,
+		cartID, cp.Code); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "coupon_apply_failed",
+			"message": "Failed to apply coupon",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Coupon applied",
+		"cart_id": cartID,
+		"code":    cp.Code,
+		"pricing": pricing,
+	})
+}
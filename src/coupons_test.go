@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCouponPromotionAndUsability(t *testing.T) {
+	items := []Item{{ProductID: "a", Quantity: 3, Price: 10}}
+	engine := &pricingEngine{}
+
+	cases := []struct {
+		cp       coupon
+		discount float64
+	}{
+		{coupon{Code: "TEN", Kind: "percent", Value: 10}, 3},
+		{coupon{Code: "FIVE", Kind: "fixed", Value: 5}, 5},
+		{coupon{Code: "B2G1", Kind: "buy_x_get_y", BuyQuantity: 2, GetQuantity: 1}, 10},
+		{coupon{Code: "BIGSPEND", Kind: "fixed", Value: 5, MinSpend: 100}, 0},
+	}
+	for _, tc := range cases {
+		if b := engine.quote(items, "", tc.cp.promotion()); b.Discount != tc.discount {
+			t.Errorf("%s: expected discount %v, got %v", tc.cp.Code, tc.discount, b.Discount)
+		}
+	}
+
+	now := time.Now()
+	expired := coupon{Code: "OLD", Active: true, ExpiresAt: sql.NullTime{Time: now.Add(-time.Hour), Valid: true}}
+	if err, ok := expired.checkUsable(nil, "cust-1", now, false).(*couponError); !ok || err.Reason != "coupon_expired" {
+		t.Fatalf("expected coupon_expired, got %v", err)
+	}
+	inactive := coupon{Code: "OFF"}
+	if err, ok := inactive.checkUsable(nil, "cust-1", now, false).(*couponError); !ok || err.Reason != "coupon_inactive" {
+		t.Fatalf("expected coupon_inactive, got %v", err)
+	}
+	valid := coupon{Code: "OK", Active: true, ExpiresAt: sql.NullTime{Time: now.Add(time.Hour), Valid: true}}
+	if err := valid.checkUsable(nil, "cust-1", now, false); err != nil {
+		t.Fatalf("expected usable coupon, got %v", err)
+	}
+}
+
+func TestRedeemCoupons_LocksTheCustomersRedemptions(t *testing.T) {
+	fake := withFakeSQL(t)
+	fake.onQuery("FROM cart_coupons", []string{"code", "kind", "value", "product_id", "buy_quantity", "get_quantity",
+		"min_spend", "expires_at", "per_customer_limit", "active"},
+		[]driver.Value{"WELCOME10", "percent", 10.0, "", int64(0), int64(0), 0.0, nil, int64(1), true})
+	fake.onQuery("COUNT(*) FROM coupon_redemptions", []string{"count"}, []driver.Value{int64(0)})
+
+	tx, _ := db.Begin()
+	defer tx.Rollback()
+	if _, err := redeemCoupons(tx, "cart-1", "cust-1", "order-1"); err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+	// A plain read would count from the checkout's snapshot and miss a
+	// concurrent checkout's redemption
+	counts := fake.executed("COUNT(*) FROM coupon_redemptions")
+	if len(counts) != 1 || !strings.HasSuffix(counts[0].query, "FOR UPDATE") {
+		t.Fatalf("expected a locking count, got %+v", counts)
+	}
+}
+
+func TestReleaseCoupons_OnCancelAndCompensation(t *testing.T) {
+	ctx := withOrderStore(t)
+	withSagaGateway(t, 1)
+	fake := withFakeSQL(t)
+	released := func(orderID string) bool {
+		for _, stmt := range fake.executed("DELETE FROM coupon_redemptions") {
+			if len(stmt.args) == 1 && stmt.args[0] == orderID {
+				return true
+			}
+		}
+		return false
+	}
+
+	orderStore.Put(ctx, &Order{OrderID: "coupon-cancel", Status: orderPending})
+	if _, err := cancelOrder(ctx, "coupon-cancel"); err != nil || !released("coupon-cancel") {
+		t.Fatalf("cancelled order kept its coupon redemptions: %v", err)
+	}
+
+	// Not enough stock, so fulfillment compensates
+	order := sagaOrder(ctx, "coupon-saga", 2)
+	processOrderMessage(ctx, orderMessage(t, order), 1)
+	if stored, _ := orderStore.Get(ctx, order.OrderID); stored.Status != orderFailed || !released("coupon-saga") {
+		t.Fatalf("compensated order kept its coupon redemptions (status %s)", stored.Status)
+	}
+}
@@ -45,11 +45,13 @@ type CartItem struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 }
 
+// AddItemRequest adds a catalog product to a cart. The price and name come
+// from the catalog; a price_per_unit that doesn't match it is rejected.
 type AddItemRequest struct {
 	ProductID    string  `json:"product_id" binding:"required"`
-	ProductName  string  `json:"product_name" binding:"required"`
+	ProductName  string  `json:"product_name"`
 	Quantity     int     `json:"quantity" binding:"required,gt=0"`
-	PricePerUnit float64 `json:"price_per_unit" binding:"required,gte=0"`
+	PricePerUnit float64 `json:"price_per_unit" binding:"gte=0"`
 }
 
 type UpdateItemRequest struct {
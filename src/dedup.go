@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// SQS delivers at least once and SNS can fan the same message out twice,
+// so the worker claims each delivery in a dedup store before processing:
+// one key for the SNS MessageId and one for the order ID. A claim is a
+// conditional write that only succeeds if the key is free or its lease ran
+// out. Keys are marked completed when the message is done with and forgotten
+// after a TTL.
+
+const (
+	dedupClaimed   = "claimed"
+	dedupCompleted = "completed"
+)
+
+var (
+	// How long a claim blocks other deliveries if the worker dies mid-order
+	dedupClaimLease = time.Duration(getEnvInt("DEDUP_CLAIM_SECONDS", 120)) * time.Second
+	// How long completed messages and orders are remembered
+	dedupRetention = time.Duration(getEnvInt("DEDUP_TTL_HOURS", 96)) * time.Hour
+)
+
+// dedupEntry is the current holder of a key
+type dedupEntry struct {
+	Owner     string
+	Status    string
+	ExpiresAt time.Time
+}
+
+// dedupStore claims keys with a lease. Claim returns true if this owner
+// now holds the key; otherwise it returns the entry that holds it.
+// Complete keeps the key for ttl if owner still holds it (or nobody does),
+// returning errDedupKeyLost otherwise; Release frees it if owner still holds it.
+type dedupStore interface {
+	Claim(ctx context.Context, key, owner string, lease time.Duration) (dedupEntry, bool, error)
+	Complete(ctx context.Context, key, owner string, ttl time.Duration) error
+	Release(ctx context.Context, key, owner string) error
+	Purge(ctx context.Context) error
+}
+
+// orderDedup defaults to process memory, which only catches duplicates
+// within one worker; initOrderDedup switches to DynamoDB or MySQL
+var orderDedup dedupStore = newMemoryDedupStore()
+
+var dedupKind = "memory"
+
+// errDedupKeyLost means another message took the key over after this
+// owner's lease ran out, so this owner must not mark it completed
+var errDedupKeyLost = errors.New("dedup key held by another message")
+
+// initDedupDynamoDB is called from initAWS: DEDUP_DYNAMODB_TABLE selects DynamoDB
+func initDedupDynamoDB(cfg aws.Config) {
+	if table := os.Getenv("DEDUP_DYNAMODB_TABLE"); table != "" {
+		orderDedup = &dynamoDedupStore{client: dynamodb.NewFromConfig(cfg), table: table}
+		dedupKind = "dynamodb:" + table
+	}
+}
+
+// initOrderDedup falls back to MySQL when DynamoDB wasn't configured
+func initOrderDedup() {
+	if dedupKind == "memory" && db != nil {
+		orderDedup = sqlDedupStore{}
+		dedupKind = "mysql"
+	}
+	fmt.Printf("🔁 Order deduplication store: %s (claim lease %v, retention %v)\n", dedupKind, dedupClaimLease, dedupRetention)
+}
+
+// deliveryDecision is what the worker does with a message after claiming
+type deliveryDecision int
+
+const (
+	deliveryProceed deliveryDecision = iota // we hold every key
+	deliverySkip                            // completed, or another message is handling it
+	deliveryRetry                           // an earlier attempt of this same message still holds it
+)
+
+// orderDelivery is one message's claim on its dedup keys
+type orderDelivery struct {
+	owner     string    // queue message ID, the same across redeliveries of one message
+	keys      []string  // message key, then order key
+	heldUntil time.Time // when the earlier attempt's lease runs out, on deliveryRetry
+}
+
+func newOrderDelivery(message QueuedMessage, snsMessageID, orderID string) *orderDelivery {
+	d := &orderDelivery{owner: message.ID}
+	if snsMessageID != "" {
+		d.keys = append(d.keys, "message:"+snsMessageID)
+	}
+	d.keys = append(d.keys, "order:"+orderID)
+	return d
+}
+
+// claim takes every key in turn. If one is taken, the keys already claimed
+// are released and the holder decides between skip and retry.
+func (d *orderDelivery) claim(ctx context.Context) (deliveryDecision, string, error) {
+	for i, key := range d.keys {
+		entry, acquired, err := orderDedup.Claim(ctx, key, d.owner, dedupClaimLease)
+		if err == nil && acquired {
+			continue
+		}
+		d.release(ctx, d.keys[:i])
+		switch {
+		case err != nil:
+			return deliveryRetry, "", err
+		case entry.Status == dedupCompleted:
+			return deliverySkip, fmt.Sprintf("%s already processed", key), nil
+		case entry.Owner == d.owner:
+			// Redelivered while the earlier attempt's lease is live: it may still be running
+			d.heldUntil = entry.ExpiresAt
+			return deliveryRetry, fmt.Sprintf("%s still claimed by an earlier attempt", key), nil
+		default:
+			return deliverySkip, fmt.Sprintf("%s claimed by message %s", key, entry.Owner), nil
+		}
+	}
+	return deliveryProceed, "", nil
+}
+
+// finish marks the keys completed when the message is done with (processed
+// or failed for good) and releases them when it will be retried
+func (d *orderDelivery) finish(ctx context.Context, outcome error) {
+	if outcome != nil && !isPermanent(outcome) {
+		d.release(ctx, d.keys)
+		return
+	}
+	for _, key := range d.keys {
+		if err := orderDedup.Complete(ctx, key, d.owner, dedupRetention); err != nil {
+			fmt.Printf("Warning: failed to mark %s completed: %v\n", key, err)
+		}
+	}
+}
+
+func (d *orderDelivery) release(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := orderDedup.Release(ctx, key, d.owner); err != nil {
+			fmt.Printf("Warning: failed to release %s: %v\n", key, err)
+		}
+	}
+}
+
+type memoryDedupStore struct {
+	mu      sync.Mutex
+	entries map[string]dedupEntry
+}
+
+func newMemoryDedupStore() *memoryDedupStore {
+	return &memoryDedupStore{entries: make(map[string]dedupEntry)}
+}
+
+func (s *memoryDedupStore) Claim(ctx context.Context, key, owner string, lease time.Duration) (dedupEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := s.entries[key]; ok && entry.ExpiresAt.After(now) {
+		return entry, false, nil
+	}
+	entry := dedupEntry{Owner: owner, Status: dedupClaimed, ExpiresAt: now.Add(lease)}
+	s.entries[key] = entry
+	return entry, true, nil
+}
+
+func (s *memoryDedupStore) Complete(ctx context.Context, key, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && entry.Owner != owner && entry.ExpiresAt.After(time.Now()) {
+		return errDedupKeyLost
+	}
+	s.entries[key] = dedupEntry{Owner: owner, Status: dedupCompleted, ExpiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryDedupStore) Release(ctx context.Context, key, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && entry.Owner == owner && entry.Status == dedupClaimed {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *memoryDedupStore) Purge(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, entry := range s.entries {
+		if !entry.ExpiresAt.After(now) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// sqlDedupStore keeps keys in the dedup_keys table. Expired rows are
+// reclaimed in place by Claim and deleted by Purge.
+type sqlDedupStore struct{}
+
+func (sqlDedupStore) Claim(ctx context.Context, key, owner string, lease time.Duration) (dedupEntry, bool, error) {
+	now := time.Now().UTC()
+	// The conditional write: an existing row is only taken over once it has
+	// expired. Columns are assigned in order, so expires_at is compared
+	// before it is overwritten.
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO dedup_keys (dedup_key, owner, status, expires_at)
+		VALUES (?, ?, 'claimed', ?)
+		ON DUPLICATE KEY UPDATE
+			owner = IF(expires_at <= ?, VALUES(owner), owner),
+			status = IF(expires_at <= ?, 'claimed', status),
+			expires_at = IF(expires_at <= ?, VALUES(expires_at), expires_at)`,
+		key, owner, now.Add(lease), now, now, now)
+	if err != nil {
+		return dedupEntry{}, false, err
+	}
+	// 1 row affected for an insert, 2 for a takeover, 0 if the key is held
+	if n, _ := result.RowsAffected(); n > 0 {
+		return dedupEntry{Owner: owner, Status: dedupClaimed, ExpiresAt: now.Add(lease)}, true, nil
+	}
+
+	var entry dedupEntry
+	err = db.QueryRowContext(ctx, "SELECT owner, status, expires_at FROM dedup_keys WHERE dedup_key = ?", key).
+		Scan(&entry.Owner, &entry.Status, &entry.ExpiresAt)
+	return entry, false, err
+}
+
+func (sqlDedupStore) Complete(ctx context.Context, key, owner string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	// Only the owner, or anyone once the key expired, may complete it. The
+	// condition holds or fails the same way for every column: owner only
+	// changes when it already held, and expires_at is assigned last.
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO dedup_keys (dedup_key, owner, status, expires_at)
+		VALUES (?, ?, 'completed', ?)
+		ON DUPLICATE KEY UPDATE
+			status = IF(owner = VALUES(owner) OR expires_at <= ?, 'completed', status),
+			owner = IF(owner = VALUES(owner) OR expires_at <= ?, VALUES(owner), owner),
+			expires_at = IF(owner = VALUES(owner) OR expires_at <= ?, VALUES(expires_at), expires_at)`,
+		key, owner, now.Add(ttl), now, now, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errDedupKeyLost
+	}
+	return nil
+}
+
+func (sqlDedupStore) Release(ctx context.Context, key, owner string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM dedup_keys WHERE dedup_key = ? AND owner = ? AND status = 'claimed'", key, owner)
+	return err
+}
+
+func (sqlDedupStore) Purge(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM dedup_keys WHERE expires_at <= ? LIMIT 1000", time.Now().UTC())
+	return err
+}
+
+// dynamoDedupStore keeps keys in a DynamoDB table with partition key
+// dedup_key and TTL enabled on expires_at (epoch seconds). TTL deletion is
+// lazy, so expired items are also treated as free by Claim.
+type dynamoDedupStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (s *dynamoDedupStore) Claim(ctx context.Context, key, owner string, lease time.Duration) (dedupEntry, bool, error) {
+	now := time.Now()
+	expires := now.Add(lease)
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"dedup_key":  &types.AttributeValueMemberS{Value: key},
+			"owner":      &types.AttributeValueMemberS{Value: owner},
+			"status":     &types.AttributeValueMemberS{Value: dedupClaimed},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(dedup_key) OR expires_at <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	if err == nil {
+		return dedupEntry{Owner: owner, Status: dedupClaimed, ExpiresAt: expires}, true, nil
+	}
+	var conditionFailed *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionFailed) {
+		return dedupEntry{}, false, err
+	}
+
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]types.AttributeValue{"dedup_key": &types.AttributeValueMemberS{Value: key}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return dedupEntry{}, false, err
+	}
+	var entry dedupEntry
+	if v, ok := out.Item["owner"].(*types.AttributeValueMemberS); ok {
+		entry.Owner = v.Value
+	}
+	if v, ok := out.Item["status"].(*types.AttributeValueMemberS); ok {
+		entry.Status = v.Value
+	}
+	if v, ok := out.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		if secs, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			entry.ExpiresAt = time.Unix(secs, 0)
+		}
+	}
+	return entry, false, nil
+}
+
+func (s *dynamoDedupStore) Complete(ctx context.Context, key, owner string, ttl time.Duration) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"dedup_key":  &types.AttributeValueMemberS{Value: key},
+			"owner":      &types.AttributeValueMemberS{Value: owner},
+			"status":     &types.AttributeValueMemberS{Value: dedupCompleted},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(dedup_key) OR #owner = :owner OR expires_at <= :now"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return errDedupKeyLost
+	}
+	return err
+}
+
+func (s *dynamoDedupStore) Release(ctx context.Context, key, owner string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                aws.String(s.table),
+		Key:                      map[string]types.AttributeValue{"dedup_key": &types.AttributeValueMemberS{Value: key}},
+		ConditionExpression:      aws.String("#owner = :owner AND #status = :claimed"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner", "#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":   &types.AttributeValueMemberS{Value: owner},
+			":claimed": &types.AttributeValueMemberS{Value: dedupClaimed},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// Someone else holds it now, or it was completed
+		return nil
+	}
+	return err
+}
+
+// Purge is a no-op: DynamoDB TTL deletes expired items
+func (s *dynamoDedupStore) Purge(ctx context.Context) error {
+	return nil
+}
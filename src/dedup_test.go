@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryDedupStore_Claims(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryDedupStore()
+
+	if _, ok, _ := s.Claim(ctx, "order:1", "m1", time.Minute); !ok {
+		t.Fatal("first claim should succeed")
+	}
+	if entry, ok, _ := s.Claim(ctx, "order:1", "m2", time.Minute); ok || entry.Owner != "m1" {
+		t.Fatalf("live claim was taken over: %+v", entry)
+	}
+
+	s.Release(ctx, "order:1", "m2")
+	if _, ok, _ := s.Claim(ctx, "order:1", "m2", time.Minute); ok {
+		t.Fatal("release by a non-owner must not free the key")
+	}
+	s.Release(ctx, "order:1", "m1")
+	if _, ok, _ := s.Claim(ctx, "order:1", "m2", time.Millisecond); !ok {
+		t.Fatal("released key should be claimable")
+	}
+
+	// An expired lease can be taken over
+	time.Sleep(5 * time.Millisecond)
+	if _, ok, _ := s.Claim(ctx, "order:1", "m3", time.Minute); !ok {
+		t.Fatal("expired claim should be taken over")
+	}
+
+	s.Complete(ctx, "order:1", "m3", time.Millisecond)
+	if entry, ok, _ := s.Claim(ctx, "order:1", "m3", time.Minute); ok || entry.Status != dedupCompleted {
+		t.Fatalf("completed key was claimed again: %+v", entry)
+	}
+	time.Sleep(5 * time.Millisecond)
+	s.Purge(ctx)
+	if len(s.entries) != 0 {
+		t.Fatalf("purge left %d expired entries", len(s.entries))
+	}
+}
+
+func TestDedupStore_CompleteKeepsTakenOverKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryDedupStore()
+
+	// m1's lease ran out and m2 took the key over
+	s.Claim(ctx, "order:1", "m1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	s.Claim(ctx, "order:1", "m2", time.Minute)
+	if err := s.Complete(ctx, "order:1", "m1", time.Hour); err != errDedupKeyLost {
+		t.Fatalf("stale owner completed the key: %v", err)
+	}
+	if entry := s.entries["order:1"]; entry.Owner != "m2" || entry.Status != dedupClaimed {
+		t.Fatalf("takeover overwritten: %+v", entry)
+	}
+	if err := s.Complete(ctx, "order:1", "m2", time.Hour); err != nil {
+		t.Fatalf("owner could not complete: %v", err)
+	}
+
+	// MySQL: the update is conditional, and no row changed means the key was lost
+	fake := withFakeSQL(t)
+	fake.onExec("INSERT INTO dedup_keys", 0, nil)
+	if err := (sqlDedupStore{}).Complete(ctx, "order:2", "m1", time.Hour); err != errDedupKeyLost {
+		t.Fatalf("expected errDedupKeyLost, got %v", err)
+	}
+	if stmts := fake.executed("INSERT INTO dedup_keys"); len(stmts) != 1 || !strings.Contains(stmts[0].query, "owner = VALUES(owner) OR expires_at <=") {
+		t.Fatalf("Complete is not conditional on the owner: %+v", stmts)
+	}
+}
+
+// snsDelivery wraps the order in an SNS envelope delivered as queue message id
+func snsDelivery(t *testing.T, id, snsMessageID string, order *Order) QueuedMessage {
+	orderJSON, _ := json.Marshal(order)
+	body, _ := json.Marshal(snsEnvelope{Type: "Notification", MessageID: snsMessageID, Message: string(orderJSON)})
+	return QueuedMessage{ID: id, Body: string(body), ReceiveCount: 1}
+}
+
+func TestProcessOrderMessage_SkipsDuplicates(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	// Not in the order store, like a separate worker without MySQL: only the
+	// dedup store stands between a duplicate and a second charge
+	order := &Order{OrderID: "dup-1", Status: orderPending, Items: []Item{{ProductID: "7", Quantity: 1, Price: 10}}}
+
+	if err := processOrderMessage(ctx, snsDelivery(t, "sqs-1", "sns-1", order), 1); err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	// SNS fanned the same message out twice
+	if err := processOrderMessage(ctx, snsDelivery(t, "sqs-2", "sns-1", order), 1); err != nil {
+		t.Fatalf("duplicate SNS delivery: %v", err)
+	}
+	// The publisher sent the order again as a new message
+	if err := processOrderMessage(ctx, snsDelivery(t, "sqs-3", "sns-2", order), 1); err != nil {
+		t.Fatalf("republished order: %v", err)
+	}
+	if gateway.authorized != 1 {
+		t.Fatalf("expected one authorization, got %d", gateway.authorized)
+	}
+}
+
+func TestProcessOrderMessage_RetriesWhileClaimed(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	order := sagaOrder(ctx, "dup-2", 1)
+
+	// An earlier attempt of this message still holds the order (worker died mid-payment)
+	orderDedup.Claim(ctx, "order:dup-2", "sqs-9", time.Minute)
+	err := processOrderMessage(ctx, snsDelivery(t, "sqs-9", "sns-9", order), 1)
+	if err == nil || isPermanent(err) || failureReason(err) != "order_claimed" {
+		t.Fatalf("expected transient order_claimed, got %v", err)
+	}
+	if wait, ok := claimWait(err); !ok || wait <= 50*time.Second || wait > time.Minute {
+		t.Fatalf("expected to wait out the rest of the lease, got %v", wait)
+	}
+	if gateway.authorized != 0 {
+		t.Fatal("claimed order must not be charged")
+	}
+	// The message key was released, so the retry isn't mistaken for a duplicate
+	if _, ok, _ := orderDedup.Claim(ctx, "message:sns-9", "sqs-9", time.Minute); !ok {
+		t.Fatal("message key should have been released")
+	}
+}
+
+func TestHandleMessageResult_ClaimedOrdersAreNotDeadLettered(t *testing.T) {
+	queue, dlq := newMemoryQueue("claimed-queue"), newMemoryQueue("claimed-dlq")
+	previousSub, previousDLQ := orderSubscriber, deadLetterPublisher
+	orderSubscriber, deadLetterPublisher = queue, dlq
+	t.Cleanup(func() { orderSubscriber, deadLetterPublisher = previousSub, previousDLQ })
+
+	queue.add("m-1", "{}", nil)
+	received, _ := queue.Receive(context.Background(), 1, 0, time.Millisecond)
+	// Redelivered past maxReceives while a crashed attempt's lease is still live
+	message := received[0]
+	message.ReceiveCount = orderRetryPolicy.maxReceives + 1
+	handleMessageResult(message, 1, claimedError(time.Minute, errors.New("order:1 still claimed")))
+
+	if visible, inFlight, _ := dlq.Depth(context.Background()); visible+inFlight != 0 {
+		t.Fatal("message was dead-lettered while its claim was live")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if visible, inFlight, _ := queue.Depth(context.Background()); visible != 0 || inFlight != 1 {
+		t.Fatalf("message should stay hidden until the lease runs out, got %d visible", visible)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -29,8 +31,14 @@ type DynamoDBCart struct {
 	CreatedAt  string              `dynamodbav:"created_at"`
 	UpdatedAt  string              `dynamodbav:"updated_at"`
 	ExpiresAt  int64               `dynamodbav:"expires_at,omitempty"` // TTL for abandoned carts
+	OrderID    string              `dynamodbav:"order_id,omitempty"`   // set at checkout
+	Version    int64               `dynamodbav:"version"`              // bumped on every write, for optimistic checks
 }
 
+// cartUnchanged holds when the cart is still at the version read as :seen.
+// Carts written before versions were added have none and count as version 0.
+const cartUnchanged = "(attribute_not_exists(version) OR version = :seen)"
+
 type DynamoDBCartItem struct {
 	ProductID    string  `dynamodbav:"product_id"`
 	ProductName  string  `dynamodbav:"product_name"`
@@ -172,32 +180,32 @@ func getShoppingCartDynamoDB(c *gin.Context) {
 		return
 	}
 
-	// Calculate total
-	total := 0.0
+	// Build line items (pricing below)
 	items := []ShoppingCartItem{}
 	for _, item := range cart.Items {
-		subtotal := float64(item.Quantity) * item.PricePerUnit
 		items = append(items, ShoppingCartItem{
 			ProductID:    item.ProductID,
 			ProductName:  item.ProductName,
 			Quantity:     item.Quantity,
 			PricePerUnit: item.PricePerUnit,
-			Subtotal:     subtotal,
+			Subtotal:     float64(item.Quantity) * item.PricePerUnit,
 		})
-		total += subtotal
 	}
 
 	// Parse timestamps
 	createdAt, _ := time.Parse(time.RFC3339, cart.CreatedAt)
 	updatedAt, _ := time.Parse(time.RFC3339, cart.UpdatedAt)
 
+	pricing := quoteShoppingCart(items, c.Query("region"))
+
 	// Build response
 	response := ShoppingCartResponse{
 		CartID:     cart.CartID,
 		CustomerID: cart.CustomerID,
 		Status:     cart.Status,
 		Items:      items,
-		Total:      total,
+		Total:      pricing.Total,
+		Pricing:    pricing,
 		ItemCount:  len(items),
 		CreatedAt:  createdAt,
 		UpdatedAt:  updatedAt,
@@ -234,6 +242,11 @@ func addItemToShoppingCartDynamoDB(c *gin.Context) {
 		return
 	}
 
+	if errs := priceCartItem(&req); len(errs) > 0 {
+		rejectInvalidCartItem(c, errs)
+		return
+	}
+
 	// First, check if cart exists and get current items
 	getResult, err := dynamodbClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
 		TableName: aws.String(dynamodbTableName),
@@ -300,8 +313,10 @@ func addItemToShoppingCartDynamoDB(c *gin.Context) {
 		})
 	}
 
-	// Update timestamp
+	// Update timestamp and version
+	seen := cart.Version
 	cart.UpdatedAt = time.Now().Format(time.RFC3339)
+	cart.Version++
 
 	// Marshal updated cart
 	updatedItem, err := attributevalue.MarshalMap(cart)
@@ -313,12 +328,27 @@ func addItemToShoppingCartDynamoDB(c *gin.Context) {
 		return
 	}
 
-	// Put updated cart back to DynamoDB
+	// Put updated cart back to DynamoDB, unless it was checked out or
+	// changed since we read it
 	_, err = dynamodbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(dynamodbTableName),
-		Item:      updatedItem,
+		TableName:                aws.String(dynamodbTableName),
+		Item:                     updatedItem,
+		ConditionExpression:      aws.String("#status = :active AND " + cartUnchanged),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active": &types.AttributeValueMemberS{Value: "active"},
+			":seen":   &types.AttributeValueMemberN{Value: strconv.FormatInt(seen, 10)},
+		},
 	})
 
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "cart_changed",
+			"message": "Cart was checked out or changed while adding the item, please retry",
+		})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "dynamodb_put_failed",
@@ -402,3 +432,146 @@ func getCustomerCartsDynamoDB(c *gin.Context) {
 	})
 }
 
+// POST /shopping-carts/dynamodb/:id/checkout - Convert cart into an order and queue payment.
+// DynamoDB and MySQL can't share a transaction, so the cart is claimed with a
+// conditional update first and released again if the order can't be queued.
+func checkoutShoppingCartDynamoDB(c *gin.Context) {
+	if dynamodbClient == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "dynamodb_unavailable",
+			"message": "DynamoDB not configured",
+		})
+		return
+	}
+
+	cartID := c.Param("id")
+	ctx := c.Request.Context()
+	key := map[string]types.AttributeValue{
+		"cart_id": &types.AttributeValueMemberS{Value: cartID},
+	}
+
+	result, err := dynamodbClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamodbTableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "dynamodb_get_failed",
+			"message": err.Error(),
+		})
+		return
+	}
+	if result.Item == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "cart_not_found",
+			"message": fmt.Sprintf("Shopping cart with ID '%s' not found", cartID),
+		})
+		return
+	}
+
+	var cart DynamoDBCart
+	if err := attributevalue.UnmarshalMap(result.Item, &cart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "unmarshal_failed",
+			"message": "Failed to parse cart data",
+		})
+		return
+	}
+	if cart.Status != "active" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "cart_not_active",
+			"message": fmt.Sprintf("Cannot checkout cart with status '%s'", cart.Status),
+		})
+		return
+	}
+
+	items := make([]Item, 0, len(cart.Items))
+	for _, item := range cart.Items {
+		items = append(items, Item{ProductID: item.ProductID, Quantity: item.Quantity, Price: item.PricePerUnit})
+	}
+	order, err := orderFromCart(cart.CartID, cart.CustomerID, items)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "cart_empty",
+			"message": err.Error(),
+		})
+		return
+	}
+	order.Region = c.Query("region")
+	if errs := prepareOrder(&order); len(errs) > 0 {
+		rejectInvalidOrder(c, errs)
+		return
+	}
+
+	// Claim the cart only if nobody changed it since our snapshot
+	_, err = dynamodbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(dynamodbTableName),
+		Key:                      key,
+		UpdateExpression:         aws.String("SET #status = :checked_out, order_id = :order_id, updated_at = :now, version = :next"),
+		ConditionExpression:      aws.String("#status = :active AND " + cartUnchanged),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":checked_out": &types.AttributeValueMemberS{Value: "checked_out"},
+			":active":      &types.AttributeValueMemberS{Value: "active"},
+			":order_id":    &types.AttributeValueMemberS{Value: order.OrderID},
+			":now":         &types.AttributeValueMemberS{Value: order.CreatedAt.Format(time.RFC3339)},
+			":seen":        &types.AttributeValueMemberN{Value: strconv.FormatInt(cart.Version, 10)},
+			":next":        &types.AttributeValueMemberN{Value: strconv.FormatInt(cart.Version+1, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "cart_changed",
+			"message": "Cart changed during checkout, please retry",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "dynamodb_update_failed",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := submitOrder(ctx, &order); err != nil {
+		fmt.Printf("Error queueing order %s for cart %s: %v\n", order.OrderID, cartID, err)
+		releaseCheckedOutCart(cartID, order.OrderID)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "order_queue_failed",
+			"message": "Failed to queue order for payment",
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      "Cart checked out, payment queued (DynamoDB)",
+		"cart_id":      cartID,
+		"status":       "checked_out",
+		"order_id":     order.OrderID,
+		"order_status": order.Status,
+		"total":        order.Total(),
+	})
+}
+
+// releaseCheckedOutCart reactivates a cart whose order could not be queued
+func releaseCheckedOutCart(cartID, orderID string) {
+	_, err := dynamodbClient.UpdateItem(context.Background(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(dynamodbTableName),
+		Key: map[string]types.AttributeValue{
+			"cart_id": &types.AttributeValueMemberS{Value: cartID},
+		},
+		UpdateExpression:         aws.String("SET #status = :active REMOVE order_id"),
+		ConditionExpression:      aws.String("order_id = :order_id"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":active":   &types.AttributeValueMemberS{Value: "active"},
+			":order_id": &types.AttributeValueMemberS{Value: orderID},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to release cart %s after checkout error: %v\n", cartID, err)
+	}
+}
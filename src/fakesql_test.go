@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQL is a scripted database/sql driver for handler tests. Queries
+// return the rows of the first rule whose fragment they contain (no rows if
+// none matches); every statement is logged with its arguments.
+type fakeSQL struct {
+	mu        sync.Mutex
+	rules     []*fakeSQLRule
+	log       []fakeStatement
+	commits   int
+	rollbacks int
+}
+
+type fakeSQLRule struct {
+	fragment     string
+	columns      []string
+	rows         [][]driver.Value
+	rowsAffected int64
+	err          error
+}
+
+type fakeStatement struct {
+	query string
+	args  []driver.Value
+}
+
+// withFakeSQL points db at a new fakeSQL for the test
+func withFakeSQL(t *testing.T) *fakeSQL {
+	fake := &fakeSQL{}
+	previous := db
+	db = sql.OpenDB(fake)
+	t.Cleanup(func() {
+		db.Close()
+		db = previous
+	})
+	return fake
+}
+
+// onQuery answers queries containing fragment with rows
+func (f *fakeSQL) onQuery(fragment string, columns []string, rows ...[]driver.Value) *fakeSQLRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule := &fakeSQLRule{fragment: fragment, columns: columns, rows: rows, rowsAffected: 1}
+	f.rules = append(f.rules, rule)
+	return rule
+}
+
+// onExec sets the rows affected (or error) for statements containing fragment
+func (f *fakeSQL) onExec(fragment string, rowsAffected int64, err error) {
+	rule := f.onQuery(fragment, nil)
+	rule.rowsAffected, rule.err = rowsAffected, err
+}
+
+// executed returns logged statements containing fragment
+func (f *fakeSQL) executed(fragment string) []fakeStatement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var matches []fakeStatement
+	for _, stmt := range f.log {
+		if strings.Contains(stmt.query, fragment) {
+			matches = append(matches, stmt)
+		}
+	}
+	return matches
+}
+
+func (f *fakeSQL) run(query string, args []driver.NamedValue) *fakeSQLRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	f.log = append(f.log, fakeStatement{query: query, args: values})
+	for _, rule := range f.rules {
+		if strings.Contains(query, rule.fragment) {
+			return rule
+		}
+	}
+	return &fakeSQLRule{rowsAffected: 1}
+}
+
+func (f *fakeSQL) Connect(context.Context) (driver.Conn, error) { return &fakeSQLConn{f}, nil }
+func (f *fakeSQL) Driver() driver.Driver                        { return nil }
+
+type fakeSQLConn struct{ fake *fakeSQL }
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakeSQL: prepared statements not supported")
+}
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return &fakeSQLTx{c.fake}, nil }
+
+func (c *fakeSQLConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rule := c.fake.run(query, args)
+	if rule.err != nil {
+		return nil, rule.err
+	}
+	return &fakeSQLRows{columns: rule.columns, rows: rule.rows}, nil
+}
+
+func (c *fakeSQLConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rule := c.fake.run(query, args)
+	if rule.err != nil {
+		return nil, rule.err
+	}
+	return driver.RowsAffected(rule.rowsAffected), nil
+}
+
+type fakeSQLTx struct{ fake *fakeSQL }
+
+func (tx *fakeSQLTx) Commit() error {
+	tx.fake.mu.Lock()
+	tx.fake.commits++
+	tx.fake.mu.Unlock()
+	return nil
+}
+
+func (tx *fakeSQLTx) Rollback() error {
+	tx.fake.mu.Lock()
+	tx.fake.rollbacks++
+	tx.fake.mu.Unlock()
+	return nil
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errOutOfStock = errors.New("insufficient stock")
+
+// stockStore holds product stock for orders being fulfilled. Reservations
+// are keyed by order ID, so reserving or releasing the same order twice is
+// harmless: saga steps are retried after failures and crashes.
+type stockStore interface {
+	Reserve(ctx context.Context, orderID string, items []Item) error
+	Release(ctx context.Context, orderID string) error
+	Available(ctx context.Context, productID string) (int, error)
+}
+
+// Products start with PRODUCT_STOCK units until stock is first reserved
+var defaultProductStock = getEnvInt("PRODUCT_STOCK", 1000)
+
+// productStock defaults to process memory; initStockStore switches to MySQL
+var productStock stockStore = newMemoryStockStore(defaultProductStock)
+
+func initStockStore() {
+	if db != nil {
+		productStock = sqlStockStore{initial: defaultProductStock}
+	}
+}
+
+// reservedQuantities sums quantities per product, so repeated lines reserve once
+func reservedQuantities(items []Item) map[string]int {
+	quantities := make(map[string]int)
+	for _, item := range items {
+		quantities[item.ProductID] += item.Quantity
+	}
+	return quantities
+}
+
+type memoryStockStore struct {
+	mu           sync.Mutex
+	initial      int
+	available    map[string]int
+	reservations map[string]map[string]int // order ID -> product ID -> quantity
+}
+
+func newMemoryStockStore(initial int) *memoryStockStore {
+	return &memoryStockStore{
+		initial:      initial,
+		available:    make(map[string]int),
+		reservations: make(map[string]map[string]int),
+	}
+}
+
+func (s *memoryStockStore) level(productID string) int {
+	if n, ok := s.available[productID]; ok {
+		return n
+	}
+	return s.initial
+}
+
+func (s *memoryStockStore) Reserve(ctx context.Context, orderID string, items []Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.reservations[orderID]; ok {
+		return nil
+	}
+	quantities := reservedQuantities(items)
+	for productID, quantity := range quantities {
+		if s.level(productID) < quantity {
+			return fmt.Errorf("%w for product %s", errOutOfStock, productID)
+		}
+	}
+	for productID, quantity := range quantities {
+		s.available[productID] = s.level(productID) - quantity
+	}
+	s.reservations[orderID] = quantities
+	return nil
+}
+
+func (s *memoryStockStore) Release(ctx context.Context, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quantities, ok := s.reservations[orderID]
+	if !ok {
+		return nil
+	}
+	for productID, quantity := range quantities {
+		s.available[productID] = s.level(productID) + quantity
+	}
+	// Keep an empty entry so a late retry of Reserve can't take stock again
+	s.reservations[orderID] = map[string]int{}
+	return nil
+}
+
+func (s *memoryStockStore) Available(ctx context.Context, productID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.level(productID), nil
+}
+
+// sqlStockStore keeps stock levels in product_stock and one row per
+// reserved product in stock_reservations
+type sqlStockStore struct {
+	initial int
+}
+
+func (s sqlStockStore) Reserve(ctx context.Context, orderID string, items []Item) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM stock_reservations WHERE order_id = ?", orderID).Scan(&existing); err != nil {
+		return err
+	}
+	if existing > 0 {
+		return nil
+	}
+
+	for productID, quantity := range reservedQuantities(items) {
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO product_stock (product_id, available) VALUES (?, ?)", productID, s.initial); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `
+			UPDATE product_stock
+			SET available = available - ?
+			WHERE product_id = ? AND available >= ?`,
+			quantity, productID, quantity)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("%w for product %s", errOutOfStock, productID)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO stock_reservations (order_id, product_id, quantity)
+			VALUES (?, ?, ?)`,
+			orderID, productID, quantity); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s sqlStockStore) Release(ctx context.Context, orderID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT product_id, quantity
+		FROM stock_reservations
+		WHERE order_id = ? AND released_at IS NULL
+		FOR UPDATE`, orderID)
+	if err != nil {
+		return err
+	}
+	quantities := make(map[string]int)
+	for rows.Next() {
+		var productID string
+		var quantity int
+		if err := rows.Scan(&productID, &quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		quantities[productID] = quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for productID, quantity := range quantities {
+		if _, err := tx.ExecContext(ctx, "UPDATE product_stock SET available = available + ? WHERE product_id = ?", quantity, productID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE stock_reservations SET released_at = NOW() WHERE order_id = ? AND released_at IS NULL", orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s sqlStockStore) Available(ctx context.Context, productID string) (int, error) {
+	var available int
+	err := db.QueryRowContext(ctx, "SELECT available FROM product_stock WHERE product_id = ?", productID).Scan(&available)
+	if err == sql.ErrNoRows {
+		return s.initial, nil
+	}
+	return available, err
+}
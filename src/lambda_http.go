@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// The API can run as a Lambda function behind API Gateway (REST or HTTP API)
+// or an ALB. Each proxy event is turned into an http.Request, served by the
+// same Gin router as the ECS service, and the buffered response is returned
+// in the shape the caller expects.
+
+// onLambda reports whether the process was started by the Lambda runtime
+func onLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+// Proxy event kinds
+const (
+	eventAPIGatewayV1 = "apigateway-v1"
+	eventAPIGatewayV2 = "apigateway-v2"
+	eventALB          = "alb"
+)
+
+// lambdaHTTPHandler serves proxy events with an http.Handler. afterWrite,
+// if set, runs after every request that isn't a GET or HEAD, before the
+// response is returned and the process frozen.
+type lambdaHTTPHandler struct {
+	handler    http.Handler
+	afterWrite func(ctx context.Context)
+}
+
+func newLambdaHTTPHandler(h http.Handler) *lambdaHTTPHandler {
+	return &lambdaHTTPHandler{handler: h}
+}
+
+// runLambdaHTTP hands the router to the Lambda runtime; it does not return.
+// Background goroutines don't run between invocations, so outbox events
+// written by a request are published before it returns.
+func runLambdaHTTP(ctx context.Context, router http.Handler) {
+	fmt.Printf("Serving the HTTP API as Lambda function %s\n", os.Getenv("AWS_LAMBDA_FUNCTION_NAME"))
+	h := newLambdaHTTPHandler(router)
+	if db != nil {
+		h.afterWrite = func(ctx context.Context) {
+			if err := flushOutbox(ctx); err != nil {
+				fmt.Printf("Outbox flush: %v\n", err)
+			}
+		}
+	}
+	lambda.StartWithOptions(h.handle, lambda.WithContext(ctx))
+}
+
+// proxyEventKind tells the three proxy event formats apart
+func proxyEventKind(raw json.RawMessage) (string, error) {
+	var probe struct {
+		Version        string `json:"version"`
+		HTTPMethod     string `json:"httpMethod"`
+		RequestContext struct {
+			ELB json.RawMessage `json:"elb"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return "", err
+	}
+	switch {
+	case probe.RequestContext.ELB != nil:
+		return eventALB, nil
+	case probe.Version == "2.0":
+		return eventAPIGatewayV2, nil
+	case probe.HTTPMethod != "":
+		return eventAPIGatewayV1, nil
+	}
+	return "", errors.New("not an API Gateway or ALB proxy event")
+}
+
+// handle is the Lambda entry point; it returns the response type matching the event
+func (h *lambdaHTTPHandler) handle(ctx context.Context, raw json.RawMessage) (any, error) {
+	kind, err := proxyEventKind(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case eventAPIGatewayV1:
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return h.serveV1(ctx, event)
+	case eventAPIGatewayV2:
+		var event events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return h.serveV2(ctx, event)
+	default:
+		var event events.ALBTargetGroupRequest
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+		return h.serveALB(ctx, event)
+	}
+}
+
+func (h *lambdaHTTPHandler) serveV1(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// API Gateway hands over decoded query values
+	query := url.Values(event.MultiValueQueryStringParameters)
+	if len(query) == 0 {
+		query = url.Values{}
+		for k, v := range event.QueryStringParameters {
+			query.Set(k, v)
+		}
+	}
+	req, err := newProxyRequest(ctx, event.HTTPMethod, event.Path, query.Encode(),
+		mergeHeaders(event.Headers, event.MultiValueHeaders), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	req.RemoteAddr = event.RequestContext.Identity.SourceIP
+
+	w := h.serve(req)
+	body, encoded := w.encodedBody()
+	return events.APIGatewayProxyResponse{
+		StatusCode:        w.status,
+		MultiValueHeaders: w.header,
+		Body:              body,
+		IsBase64Encoded:   encoded,
+	}, nil
+}
+
+func (h *lambdaHTTPHandler) serveV2(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// HTTP APIs join repeated headers with commas and send cookies separately
+	headers := http.Header{}
+	for k, v := range event.Headers {
+		headers.Set(k, v)
+	}
+	if len(event.Cookies) > 0 {
+		headers.Set("Cookie", strings.Join(event.Cookies, "; "))
+	}
+	path := event.RawPath
+	if path == "" {
+		path = event.RequestContext.HTTP.Path
+	}
+	req, err := newProxyRequest(ctx, event.RequestContext.HTTP.Method, path, event.RawQueryString,
+		headers, event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayV2HTTPResponse{}, err
+	}
+	req.RemoteAddr = event.RequestContext.HTTP.SourceIP
+
+	w := h.serve(req)
+	body, encoded := w.encodedBody()
+	response := events.APIGatewayV2HTTPResponse{
+		StatusCode:      w.status,
+		Headers:         map[string]string{},
+		Body:            body,
+		IsBase64Encoded: encoded,
+		Cookies:         w.header.Values("Set-Cookie"),
+	}
+	for k, v := range w.header {
+		if k != "Set-Cookie" {
+			response.Headers[k] = strings.Join(v, ",")
+		}
+	}
+	return response, nil
+}
+
+func (h *lambdaHTTPHandler) serveALB(ctx context.Context, event events.ALBTargetGroupRequest) (events.ALBTargetGroupResponse, error) {
+	// Unlike API Gateway, the ALB passes query values through still URL-encoded
+	multiValue := len(event.MultiValueHeaders) > 0 || len(event.MultiValueQueryStringParameters) > 0
+	query := event.MultiValueQueryStringParameters
+	if !multiValue {
+		query = map[string][]string{}
+		for k, v := range event.QueryStringParameters {
+			query[k] = []string{v}
+		}
+	}
+	req, err := newProxyRequest(ctx, event.HTTPMethod, event.Path, rawQuery(query),
+		mergeHeaders(event.Headers, event.MultiValueHeaders), event.Body, event.IsBase64Encoded)
+	if err != nil {
+		return events.ALBTargetGroupResponse{}, err
+	}
+
+	w := h.serve(req)
+	body, encoded := w.encodedBody()
+	response := events.ALBTargetGroupResponse{
+		StatusCode:        w.status,
+		StatusDescription: fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		Body:              body,
+		IsBase64Encoded:   encoded,
+	}
+	// The target group's multi-value setting decides which field the ALB reads
+	if multiValue {
+		response.MultiValueHeaders = w.header
+	} else {
+		response.Headers = map[string]string{}
+		for k := range w.header {
+			response.Headers[k] = w.header.Get(k)
+		}
+	}
+	return response, nil
+}
+
+func (h *lambdaHTTPHandler) serve(req *http.Request) *bufferedResponse {
+	w := &bufferedResponse{header: http.Header{}}
+	h.handler.ServeHTTP(w, req)
+	if h.afterWrite != nil && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		h.afterWrite(req.Context())
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w
+}
+
+// newProxyRequest builds the request the router sees from the event fields
+func newProxyRequest(ctx context.Context, method, path, rawQuery string, headers http.Header, body string, base64Body bool) (*http.Request, error) {
+	var data []byte
+	if base64Body {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("decode base64 body: %w", err)
+		}
+		data = decoded
+	} else {
+		data = []byte(body)
+	}
+
+	target := path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers
+	req.Host = headers.Get("Host")
+	req.ContentLength = int64(len(data))
+	req.RequestURI = target
+	return req, nil
+}
+
+// mergeHeaders prefers the multi-value form when the event carries it
+func mergeHeaders(single map[string]string, multi map[string][]string) http.Header {
+	headers := http.Header{}
+	if len(multi) > 0 {
+		for k, values := range multi {
+			for _, v := range values {
+				headers.Add(k, v)
+			}
+		}
+		return headers
+	}
+	for k, v := range single {
+		headers.Set(k, v)
+	}
+	return headers
+}
+
+// rawQuery joins already-encoded query parameters, in a stable order
+func rawQuery(params map[string][]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range params[k] {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// bufferedResponse collects the whole response; proxy integrations cannot stream
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header { return w.header }
+
+func (w *bufferedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// Flush is a no-op so streaming handlers (SSE) still work, delivered in one piece
+func (w *bufferedResponse) Flush() {}
+
+// encodedBody returns the body as text, or base64 when it is binary
+func (w *bufferedResponse) encodedBody() (string, bool) {
+	data := w.body.Bytes()
+	if len(data) == 0 {
+		return "", false
+	}
+	if isTextContent(w.header.Get("Content-Type")) && utf8.Valid(data) {
+		return string(data), false
+	}
+	return base64.StdEncoding.EncodeToString(data), true
+}
+
+func isTextContent(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/gin-gonic/gin"
+)
+
+var pngBytes = []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0xff}
+
+func newEchoHandler() *lambdaHTTPHandler {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Any("/echo", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Header("X-Multi", "a")
+		c.Writer.Header().Add("X-Multi", "b")
+		c.SetCookie("session", "s1", 60, "/", "", false, true)
+		c.SetCookie("theme", "dark", 60, "/", "", false, false)
+		c.JSON(http.StatusCreated, gin.H{
+			"method": c.Request.Method,
+			"tags":   c.QueryArray("tag"),
+			"q":      c.Query("q"),
+			"accept": c.Request.Header.Values("Accept"),
+			"cookie": c.Request.Header.Get("Cookie"),
+			"body":   base64.StdEncoding.EncodeToString(body),
+		})
+	})
+	router.GET("/image", func(c *gin.Context) {
+		c.Data(http.StatusOK, "image/png", pngBytes)
+	})
+	return newLambdaHTTPHandler(router)
+}
+
+func invokeProxy(t *testing.T, h *lambdaHTTPHandler, event string) any {
+	t.Helper()
+	response, err := h.handle(context.Background(), json.RawMessage(event))
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	return response
+}
+
+type echoed struct {
+	Method string   `json:"method"`
+	Tags   []string `json:"tags"`
+	Q      string   `json:"q"`
+	Accept []string `json:"accept"`
+	Cookie string   `json:"cookie"`
+	Body   string   `json:"body"`
+}
+
+func decodeEcho(t *testing.T, body string) echoed {
+	t.Helper()
+	var e echoed
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatalf("decode %q: %v", body, err)
+	}
+	return e
+}
+
+func TestProxyEventKind(t *testing.T) {
+	cases := map[string]string{
+		`{"httpMethod":"GET","path":"/"}`:                                     eventAPIGatewayV1,
+		`{"version":"2.0","rawPath":"/"}`:                                     eventAPIGatewayV2,
+		`{"httpMethod":"GET","requestContext":{"elb":{"targetGroupArn":""}}}`: eventALB,
+	}
+	for event, want := range cases {
+		if got, err := proxyEventKind(json.RawMessage(event)); err != nil || got != want {
+			t.Errorf("%s: got %q, %v; want %q", event, got, err, want)
+		}
+	}
+	if _, err := proxyEventKind(json.RawMessage(`{"Records":[]}`)); err == nil {
+		t.Error("an SNS event should not be accepted as an HTTP event")
+	}
+}
+
+func TestLambdaHTTP_APIGatewayV1(t *testing.T) {
+	h := newEchoHandler()
+	body := base64.StdEncoding.EncodeToString(pngBytes)
+	response := invokeProxy(t, h, `{
+		"httpMethod": "POST", "path": "/echo",
+		"multiValueQueryStringParameters": {"tag": ["a b", "c&d"], "q": ["x"]},
+		"multiValueHeaders": {"Accept": ["application/json", "text/plain"]},
+		"requestContext": {"identity": {"sourceIp": "10.0.0.1"}},
+		"body": "`+body+`", "isBase64Encoded": true
+	}`).(events.APIGatewayProxyResponse)
+
+	if response.StatusCode != http.StatusCreated || response.IsBase64Encoded {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+	e := decodeEcho(t, response.Body)
+	if e.Method != "POST" || strings.Join(e.Tags, "|") != "a b|c&d" || e.Q != "x" {
+		t.Errorf("query not passed through: %+v", e)
+	}
+	if len(e.Accept) != 2 {
+		t.Errorf("multi-value header collapsed: %v", e.Accept)
+	}
+	if e.Body != body {
+		t.Errorf("binary body changed: %s", e.Body)
+	}
+	if got := response.MultiValueHeaders["X-Multi"]; len(got) != 2 {
+		t.Errorf("multi-value response header = %v", got)
+	}
+}
+
+func TestLambdaHTTP_APIGatewayV2(t *testing.T) {
+	h := newEchoHandler()
+	response := invokeProxy(t, h, `{
+		"version": "2.0", "rawPath": "/echo", "rawQueryString": "tag=a%20b&tag=c%26d",
+		"cookies": ["a=1", "b=2"],
+		"headers": {"accept": "application/json,text/plain"},
+		"requestContext": {"http": {"method": "PUT", "path": "/echo", "sourceIp": "10.0.0.2"}},
+		"body": "plain text"
+	}`).(events.APIGatewayV2HTTPResponse)
+
+	e := decodeEcho(t, response.Body)
+	if e.Method != "PUT" || strings.Join(e.Tags, "|") != "a b|c&d" {
+		t.Errorf("raw query not passed through: %+v", e)
+	}
+	if e.Cookie != "a=1; b=2" {
+		t.Errorf("cookies = %q", e.Cookie)
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(e.Body); string(decoded) != "plain text" {
+		t.Errorf("body = %q", decoded)
+	}
+	if len(response.Cookies) != 2 || response.Headers["Set-Cookie"] != "" {
+		t.Errorf("Set-Cookie should be returned as cookies: %+v", response)
+	}
+	if response.Headers["X-Multi"] != "a,b" {
+		t.Errorf("X-Multi = %q", response.Headers["X-Multi"])
+	}
+
+	image := invokeProxy(t, h, `{"version":"2.0","rawPath":"/image","requestContext":{"http":{"method":"GET"}}}`).(events.APIGatewayV2HTTPResponse)
+	if !image.IsBase64Encoded || image.Body != base64.StdEncoding.EncodeToString(pngBytes) {
+		t.Errorf("binary response not base64-encoded: %+v", image)
+	}
+}
+
+func TestLambdaHTTP_ALB(t *testing.T) {
+	h := newEchoHandler()
+
+	// Multi-value target group: query values arrive still encoded
+	response := invokeProxy(t, h, `{
+		"httpMethod": "GET", "path": "/echo",
+		"multiValueQueryStringParameters": {"tag": ["a%20b", "c%26d"]},
+		"multiValueHeaders": {"accept": ["application/json", "text/plain"]},
+		"requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:tg"}},
+		"body": "", "isBase64Encoded": false
+	}`).(events.ALBTargetGroupResponse)
+
+	if response.StatusDescription != "201 Created" {
+		t.Errorf("status description = %q", response.StatusDescription)
+	}
+	e := decodeEcho(t, response.Body)
+	if strings.Join(e.Tags, "|") != "a b|c&d" || len(e.Accept) != 2 {
+		t.Errorf("unexpected request: %+v", e)
+	}
+	if response.Headers != nil || len(response.MultiValueHeaders["X-Multi"]) != 2 {
+		t.Errorf("multi-value target group should get multi-value headers: %+v", response)
+	}
+
+	single := invokeProxy(t, h, `{
+		"httpMethod": "GET", "path": "/echo",
+		"queryStringParameters": {"q": "hello%20world"},
+		"headers": {"accept": "application/json"},
+		"requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:tg"}}
+	}`).(events.ALBTargetGroupResponse)
+	if e := decodeEcho(t, single.Body); e.Q != "hello world" {
+		t.Errorf("q = %q", e.Q)
+	}
+	if single.MultiValueHeaders != nil || single.Headers["Content-Type"] == "" {
+		t.Errorf("single-value target group should get plain headers: %+v", single)
+	}
+}
+
+func TestLambdaHTTP_ProductsGeneratedOnDemand(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := store
+	store = newProductStore()
+	store.onDemand = true
+	defer func() { store = previous }()
+
+	h := newLambdaHTTPHandler(newRouter())
+	health := invokeProxy(t, h, `{"version":"2.0","rawPath":"/health","requestContext":{"http":{"method":"GET"}}}`).(events.APIGatewayV2HTTPResponse)
+	if health.StatusCode != http.StatusOK || len(store.products) != 0 {
+		t.Fatalf("health check should not generate the catalog (status %d, %d products)", health.StatusCode, len(store.products))
+	}
+
+	product := invokeProxy(t, h, `{"version":"2.0","rawPath":"/products/42","requestContext":{"http":{"method":"GET"}}}`).(events.APIGatewayV2HTTPResponse)
+	if product.StatusCode != http.StatusOK || !strings.Contains(product.Body, `"id":"42"`) {
+		t.Fatalf("product lookup: %d %s", product.StatusCode, product.Body)
+	}
+}
+
+func TestLambdaHTTP_FlushesAfterWrites(t *testing.T) {
+	h := newEchoHandler()
+	flushes := 0
+	h.afterWrite = func(context.Context) { flushes++ }
+
+	invokeProxy(t, h, `{"version":"2.0","rawPath":"/echo","requestContext":{"http":{"method":"GET"}}}`)
+	invokeProxy(t, h, `{"version":"2.0","rawPath":"/echo","body":"{}","requestContext":{"http":{"method":"POST"}}}`)
+	if flushes != 1 {
+		t.Fatalf("expected one flush after the POST, got %d", flushes)
+	}
+}
+
+func TestLambdaHTTP_NoEventStream(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_RUNTIME_API", "127.0.0.1:9001")
+	ctx := withOrderStore(t)
+	orderStore.Put(ctx, &Order{OrderID: "sse-lambda", Status: orderPending})
+
+	h := newLambdaHTTPHandler(newRouter())
+	response := invokeProxy(t, h, `{"version":"2.0","rawPath":"/orders/sse-lambda/events","requestContext":{"http":{"method":"GET"}}}`).(events.APIGatewayV2HTTPResponse)
+	if response.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 for the event stream on Lambda, got %d %s", response.StatusCode, response.Body)
+	}
+}
@@ -2,31 +2,31 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/gin-gonic/gin"
+
+	"text/main/orders"
 )
 
 type product struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Category    string `json:"category"`
-	Description string `json:"description"`
-	Brand       string `json:"brand"`
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Category    string  `json:"category"`
+	Description string  `json:"description"`
+	Brand       string  `json:"brand"`
+	Price       float64 `json:"price"`
 }
 
 type searchResponse struct {
@@ -36,73 +36,88 @@ type searchResponse struct {
 	ProductsChecked int       `json:"products_checked"`
 }
 
-// Order structures for HW7 - Synchronous vs Async Processing
-type Item struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
-}
-
-type Order struct {
-	OrderID    string    `json:"order_id"`
-	CustomerID int       `json:"customer_id"`
-	Status     string    `json:"status"` // pending, processing, completed, failed
-	Items      []Item    `json:"items"`
-	CreatedAt  time.Time `json:"created_at"`
-}
-
-// PaymentProcessor simulates a payment service with limited throughput
-type PaymentProcessor struct {
-	semaphore chan struct{}
-	mu        sync.Mutex
-	processed int
-	failed    int
-}
+// Order types live in the shared orders package, which the Lambda order
+// processor also uses
+type (
+	Item             = orders.Item
+	Order            = orders.Order
+	PaymentProcessor = orders.PaymentProcessor
+)
 
+// newPaymentProcessor returns the simulated payment service, the default PaymentGateway
 func newPaymentProcessor(maxConcurrent int) *PaymentProcessor {
-	return &PaymentProcessor{
-		semaphore: make(chan struct{}, maxConcurrent),
-	}
+	return orders.NewPaymentProcessor(maxConcurrent)
 }
 
-func (pp *PaymentProcessor) processPayment(order *Order) error {
-	// Try to acquire semaphore (this will block if at capacity)
-	pp.semaphore <- struct{}{}
-	defer func() { <-pp.semaphore }()
-
-	// Simulate 3-second payment verification delay
-	time.Sleep(3 * time.Second)
-
-	pp.mu.Lock()
-	pp.processed++
-	pp.mu.Unlock()
+// Simple UUID generator without external dependencies
+func generateOrderID() string {
+	return generateID("order")
+}
 
-	return nil
+func generateID(prefix string) string {
+	return orders.NewID(prefix)
 }
 
-func (pp *PaymentProcessor) stats() (int, int) {
-	pp.mu.Lock()
-	defer pp.mu.Unlock()
-	return pp.processed, pp.failed
+// getEnv reads a string setting, falling back to def
+func getEnv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
 }
 
-// Simple UUID generator without external dependencies
-func generateOrderID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return fmt.Sprintf("order-%s", hex.EncodeToString(b)[:16])
+// getEnvInt reads a positive integer setting, falling back to def
+func getEnvInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
 }
 
 type productStore struct {
+	once     sync.Once // guards generation
+	onDemand bool      // generate on first use instead of at startup (Lambda)
 	mu       sync.RWMutex
 	products []product
+	byID     map[string]int // product ID -> index in products
 }
 
 func newProductStore() *productStore {
-	return &productStore{products: make([]product, 0, 100000)}
+	return &productStore{products: make([]product, 0, 100000), byID: make(map[string]int)}
+}
+
+// lookup returns the catalog entry for id
+func (s *productStore) lookup(id string) (product, bool) {
+	s.ensureProducts()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return product{}, false
+	}
+	return s.products[i], true
 }
 
+// generateProducts fills the catalog the first time it is called
 func (s *productStore) generateProducts() {
+	s.once.Do(func() {
+		fmt.Println("Generating 100,000 products...")
+		start := time.Now()
+		s.fill()
+		fmt.Printf("Generated %d products in %v\n", len(s.products), time.Since(start))
+	})
+}
+
+// ensureProducts generates the catalog on first use when it is generated on demand
+func (s *productStore) ensureProducts() {
+	if s.onDemand {
+		s.generateProducts()
+	}
+}
+
+func (s *productStore) fill() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -121,12 +136,15 @@ func (s *productStore) generateProducts() {
 			Category:    category,
 			Description: fmt.Sprintf("%s - %s", description, brand),
 			Brand:       brand,
+			Price:       float64(i%500+1) - 0.01,
 		}
+		s.byID[p.ID] = len(s.products)
 		s.products = append(s.products, p)
 	}
 }
 
 func (s *productStore) search(query string, maxResults int) searchResponse {
+	s.ensureProducts()
 	start := time.Now()
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -172,6 +190,10 @@ var (
 	sqsClient        *sqs.Client
 	snsTopicArn      = "arn:aws:sns:us-west-2:891377339099:order-processing-events"
 	sqsQueueURL      = "https://sqs.us-west-2.amazonaws.com/891377339099/order-processing-queue"
+	sqsDLQURL        = "https://sqs.us-west-2.amazonaws.com/891377339099/order-processing-dlq"
+
+	// How long in-flight requests and orders get to finish after SIGTERM
+	shutdownGracePeriod = time.Duration(getEnvInt("SHUTDOWN_GRACE_SECONDS", 25)) * time.Second
 )
 
 func initAWS() {
@@ -186,14 +208,26 @@ func initAWS() {
 	
 	// Initialize DynamoDB client
 	InitDynamoDB(cfg)
+	initDedupDynamoDB(cfg)
 	
 	fmt.Println("AWS SDK initialized successfully")
 }
 
 func main() {
+	// Cancelled on SIGINT/SIGTERM (ECS sends SIGTERM when stopping a task)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize AWS SDK
 	initAWS()
 
+	// Select payment gateway (simulator unless PAYMENT_GATEWAY_URL is set)
+	initPaymentGateway()
+
+	// Select order message bus (AWS SNS/SQS, in-memory, file or no-op)
+	initMessageBus()
+	defer closeMessageBus()
+
 	// Initialize Database (MySQL RDS)
 	fmt.Println("Initializing database connection...")
 	if err := InitDB(); err != nil {
@@ -201,20 +235,69 @@ func main() {
 		fmt.Println("Continuing without database (cart endpoints will be unavailable)")
 	}
 	defer CloseDB()
+	initOrderStore()
+	initWebhooks()
+	initStockStore()
+	initOrderDedup()
+
+	// Generate 100,000 products at startup. On Lambda they are generated by
+	// the first request that needs the catalog, keeping other cold starts fast
+	if onLambda() && os.Getenv("PRODUCTS_EAGER") != "true" {
+		store.onDemand = true
+	} else {
+		store.generateProducts()
+	}
 
-	// Generate 100,000 products at startup
-	fmt.Println("Generating 100,000 products...")
-	start := time.Now()
-	store.generateProducts()
-	fmt.Printf("Generated %d products in %v\n", 100000, time.Since(start))
+	// Deliver order webhooks; stopped after the worker so its last events go out.
+	// On Lambda nothing runs between invocations, so the API function runs no
+	// background work: no webhook deliveries, outbox relay or worker.
+	if !onLambda() {
+		orderWebhooks.start()
+		defer orderWebhooks.stop()
+	}
 
 	// Start order processor worker if in worker mode
 	if os.Getenv("WORKER_MODE") == "true" {
-		fmt.Println("Starting in WORKER MODE - will process orders from SQS")
-		startOrderProcessor() // This will block forever
+		fmt.Printf("Starting in WORKER MODE - will process orders from %s queue\n", orderBusKind)
+		startOrderProcessor(ctx) // Blocks until shutdown completes
+		return
+	}
+
+	// Relay outbox events to the message bus (stopped before the DB is closed);
+	// on Lambda each write request flushes the outbox instead
+	if db != nil && !onLambda() {
+		relayDone := startOutboxRelay(ctx)
+		defer func() { <-relayDone }()
+	}
+
+	// In-memory and file queues only exist inside this process, so run the worker alongside the API
+	if runsWorkerInProcess() && onLambda() {
+		fmt.Printf("⚠️  %s order bus on Lambda: orders will not be processed (use SNS/SQS)\n", orderBusKind)
+	} else if runsWorkerInProcess() {
+		workerDone := make(chan struct{})
+		go func() {
+			defer close(workerDone)
+			startOrderProcessor(ctx)
+		}()
+		defer func() { <-workerDone }()
+	}
+
+	router := newRouter()
+
+	// Behind API Gateway or an ALB the runtime delivers requests as events
+	if onLambda() {
+		runLambdaHTTP(ctx, router)
 		return
 	}
 
+	fmt.Println("Starting server on :8080")
+	fmt.Println("📦 Product search endpoints: /products/search")
+	fmt.Println("🛒 Shopping cart endpoints: /carts")
+	runServer(ctx, &http.Server{Addr: ":8080", Handler: router})
+}
+
+// newRouter registers every API route; shared by the HTTP server and the Lambda entry point
+func newRouter() *gin.Engine {
 	router := gin.Default()
 
 	// Health check endpoint for ALB
@@ -234,6 +317,16 @@ func main() {
 	router.POST("/orders/sync", postOrderSync)
 	router.POST("/orders/async", postOrderAsync)
 	router.GET("/orders/stats", getOrderStats)
+	router.GET("/orders/:id", getOrder)
+	router.POST("/orders/:id/cancel", postOrderCancel)
+	router.POST("/orders/:id/refund", postOrderRefund)
+	router.GET("/orders/:id/events", getOrderEvents)
+	router.GET("/orders/:id/webhooks", getOrderWebhookDeliveries)
+
+	// Order webhook endpoints, keyed by customer ID (numeric or cart customer ID)
+	router.POST("/customers/:customer_id/webhooks", registerWebhook)
+	router.GET("/customers/:customer_id/webhooks", listWebhooks)
+	router.DELETE("/customers/:customer_id/webhooks/:webhook_id", deleteWebhook)
 
 	// HW8: Shopping Cart endpoints (MySQL-backed)
 	// Legacy endpoints (backward compatibility)
@@ -250,17 +343,44 @@ func main() {
 	router.POST("/shopping-carts", createShoppingCart)
 	router.GET("/shopping-carts/:id", getShoppingCart)
 	router.POST("/shopping-carts/:id/items", addItemToShoppingCart)
+	router.POST("/shopping-carts/:id/coupons", applyCouponToShoppingCart)
 
 	// Part 3b: Shopping Cart API endpoints (DynamoDB)
 	router.POST("/shopping-carts/dynamodb", createShoppingCartDynamoDB)
 	router.GET("/shopping-carts/dynamodb/:id", getShoppingCartDynamoDB)
 	router.POST("/shopping-carts/dynamodb/:id/items", addItemToShoppingCartDynamoDB)
+	router.POST("/shopping-carts/dynamodb/:id/checkout", checkoutShoppingCartDynamoDB)
 	router.GET("/customers/dynamodb/:customer_id/carts", getCustomerCartsDynamoDB)
 
-	fmt.Println("Starting server on :8080")
-	fmt.Println("📦 Product search endpoints: /products/search")
-	fmt.Println("🛒 Shopping cart endpoints: /carts")
-	router.Run(":8080")
+	return router
+}
+
+// runServer serves until ctx is cancelled, then lets in-flight requests
+// (including blocking sync payments) finish within the grace period
+func runServer(ctx context.Context, srv *http.Server) {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Server error: %v\n", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	fmt.Printf("Shutdown signal received, draining HTTP requests (grace period %v)...\n", shutdownGracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("HTTP server did not shut down cleanly: %v\n", err)
+		return
+	}
+	fmt.Println("HTTP server stopped")
 }
 
 func searchProducts(c *gin.Context) {
@@ -276,6 +396,7 @@ func searchProducts(c *gin.Context) {
 
 func getProducts(c *gin.Context) {
 	// Return first 100 products for compatibility
+	store.ensureProducts()
 	store.mu.RLock()
 	defer store.mu.RUnlock()
 
@@ -298,6 +419,7 @@ func getProductByID(c *gin.Context) {
 		return
 	}
 
+	store.ensureProducts()
 	store.mu.RLock()
 	defer store.mu.RUnlock()
 
@@ -320,23 +442,40 @@ func postOrderSync(c *gin.Context) {
 		return
 	}
 
-	// Generate order ID if not provided
-	if order.OrderID == "" {
-		order.OrderID = generateOrderID()
-	}
+	// Always a fresh ID: the order is recorded with an upsert, so a
+	// client-supplied ID could overwrite an existing order
+	order.OrderID = generateOrderID()
 	order.CreatedAt = time.Now()
 	order.Status = "pending"
 
+	// Reprice against the catalog before any payment is attempted
+	if errs := prepareOrder(&order); len(errs) > 0 {
+		rejectInvalidOrder(c, errs)
+		return
+	}
+
+	// Bounded wait for a payment slot; shed load instead of stalling the server
+	release, reason, retryAfter := syncAdmission.acquire(c.Request.Context())
+	if release == nil {
+		rejectOverloaded(c, reason, retryAfter)
+		return
+	}
+	defer release()
+	paymentMetrics.recordQueueWait(time.Since(order.CreatedAt))
+
 	// Synchronous payment processing - THIS BLOCKS!
 	order.Status = "processing"
 	startTime := time.Now()
 
-	if err := paymentProcessor.processPayment(&order); err != nil {
+	err := chargeOrder(c.Request.Context(), paymentGateway, &order)
+	paymentMetrics.recordPayment(sourceSync, 0, time.Since(startTime), err)
+	if err != nil {
 		order.Status = "failed"
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":         "payment processing failed",
-			"order_id":      order.OrderID,
-			"processing_ms": time.Since(startTime).Milliseconds(),
+			"error":            "payment processing failed",
+			"order_id":         order.OrderID,
+			"authorization_id": order.AuthorizationID,
+			"processing_ms":    time.Since(startTime).Milliseconds(),
 		})
 		return
 	}
@@ -344,22 +483,40 @@ func postOrderSync(c *gin.Context) {
 	order.Status = "completed"
 	processingTime := time.Since(startTime)
 
+	// Keep a record so the order can be looked up and refunded later
+	if err := orderStore.Put(c.Request.Context(), &order); err != nil {
+		fmt.Printf("Warning: failed to record order %s: %v\n", order.OrderID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"order_id":      order.OrderID,
-		"status":        order.Status,
-		"customer_id":   order.CustomerID,
-		"processing_ms": processingTime.Milliseconds(),
-		"message":       "order processed successfully",
+		"order_id":         order.OrderID,
+		"status":           order.Status,
+		"customer_id":      order.CustomerID,
+		"authorization_id": order.AuthorizationID,
+		"capture_id":       order.CaptureID,
+		"processing_ms":    processingTime.Milliseconds(),
+		"message":          "order processed successfully",
 	})
 }
 
 // Get payment processor statistics
 func getOrderStats(c *gin.Context) {
-	processed, failed := paymentProcessor.stats()
+	processed, failed := paymentProcessor.Stats()
+	admission := syncAdmission.snapshot()
 	c.JSON(http.StatusOK, gin.H{
 		"processed":      processed,
 		"failed":         failed,
-		"max_concurrent": 5,
+		"max_concurrent": paymentProcessor.Capacity(),
+		"payment_slots": gin.H{
+			"in_use":   paymentProcessor.InUse(),
+			"capacity": paymentProcessor.Capacity(),
+		},
+		"rejected":       admission["rejected"],
+		"payments":       paymentMetrics.snapshot(time.Now()),
+		"sync_admission": admission,
+		"worker":         orderWorkerStats.snapshot(),
+		"outbox":         orderOutbox.snapshot(),
+		"webhooks":       orderWebhooks.snapshot(),
 	})
 }
 
@@ -371,6 +528,15 @@ func postOrderAsync(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if order.CallbackURL != "" && !validCallbackURL(order.CallbackURL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "callback_url must be an absolute http or https URL on a public host"})
+		return
+	}
+	wait, err := parseOrderWait(c.Query("wait"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid wait: " + err.Error()})
+		return
+	}
 
 	// Generate order ID if not provided
 	if order.OrderID == "" {
@@ -379,120 +545,47 @@ func postOrderAsync(c *gin.Context) {
 	order.CreatedAt = time.Now()
 	order.Status = "pending"
 
-	// Publish to SNS immediately - NO BLOCKING!
-	orderJSON, err := json.Marshal(order)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to serialize order"})
+	// Reprice against the catalog before any payment is attempted
+	if errs := prepareOrder(&order); len(errs) > 0 {
+		rejectInvalidOrder(c, errs)
 		return
 	}
 
-	if snsClient != nil {
-		_, err = snsClient.Publish(context.TODO(), &sns.PublishInput{
-			TopicArn: aws.String(snsTopicArn),
-			Message:  aws.String(string(orderJSON)),
-		})
+	// Queue the order for the payment worker immediately - NO BLOCKING!
+	if err := submitOrder(c.Request.Context(), &order); err != nil {
+		fmt.Printf("Error queueing order %s: %v\n", order.OrderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to queue order"})
+		return
+	}
 
+	// Long-poll: hold the response until payment settles or the wait runs out
+	status := order.Status
+	if wait > 0 {
+		latest, err := waitForSettled(c.Request.Context(), order.OrderID, wait)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to publish order"})
+			fmt.Printf("Warning: failed to follow order %s: %v\n", order.OrderID, err)
+		}
+		if latest != nil && orderSettled(latest.Status) {
+			c.JSON(http.StatusOK, gin.H{
+				"order_id":  latest.OrderID,
+				"status":    latest.Status,
+				"message":   "order " + latest.Status,
+				"order":     latest,
+				"timestamp": order.CreatedAt,
+			})
 			return
 		}
+		if latest != nil {
+			status = latest.Status
+		}
 	}
 
-	// Return immediately with 202 Accepted
+	// Return with 202 Accepted; the client can follow GET /orders/:id/events
 	c.JSON(http.StatusAccepted, gin.H{
 		"order_id":  order.OrderID,
-		"status":    "pending",
+		"status":    status,
 		"message":   "order received and queued for processing",
+		"events":    "/orders/" + order.OrderID + "/events",
 		"timestamp": order.CreatedAt,
 	})
 }
-
-// Background worker that polls SQS and processes orders
-func startOrderProcessor() {
-	// Get number of worker goroutines from environment (default: 1)
-	numWorkers := 1
-	if w := os.Getenv("NUM_WORKERS"); w != "" {
-		if n, err := strconv.Atoi(w); err == nil && n > 0 {
-			numWorkers = n
-		}
-	}
-
-	fmt.Printf("Order processor started with %d worker goroutines, polling SQS queue...\n", numWorkers)
-
-	// Create a channel for messages
-	messagesChan := make(chan types.Message, 100)
-
-	// Start worker goroutines
-	for i := 0; i < numWorkers; i++ {
-		go func(workerID int) {
-			for message := range messagesChan {
-				processOrderMessage(message, workerID)
-			}
-		}(i + 1)
-	}
-
-	// Main polling loop
-	for {
-		// Long polling - wait up to 20 seconds for messages
-		result, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
-			QueueUrl:            aws.String(sqsQueueURL),
-			MaxNumberOfMessages: 10,
-			WaitTimeSeconds:     20,
-			VisibilityTimeout:   30,
-		})
-
-		if err != nil {
-			fmt.Printf("Error receiving messages from SQS: %v\n", err)
-			time.Sleep(5 * time.Second)
-			continue
-		}
-
-		// Send messages to worker pool
-		for _, message := range result.Messages {
-			messagesChan <- message
-		}
-	}
-}
-
-func processOrderMessage(message types.Message, workerID int) {
-	// Parse SNS message wrapper
-	var snsMessage struct {
-		Message string `json:"Message"`
-	}
-
-	if err := json.Unmarshal([]byte(*message.Body), &snsMessage); err != nil {
-		fmt.Printf("Error parsing SNS message: %v\n", err)
-		return
-	}
-
-	// Parse the actual order
-	var order Order
-	if err := json.Unmarshal([]byte(snsMessage.Message), &order); err != nil {
-		fmt.Printf("Error parsing order: %v\n", err)
-		return
-	}
-
-	fmt.Printf("[Worker %d] Processing order: %s (customer: %d)\n", workerID, order.OrderID, order.CustomerID)
-
-	// Process payment (this takes 3 seconds)
-	order.Status = "processing"
-	if err := paymentProcessor.processPayment(&order); err != nil {
-		order.Status = "failed"
-		fmt.Printf("[Worker %d] Payment failed for order %s: %v\n", workerID, order.OrderID, err)
-	} else {
-		order.Status = "completed"
-		fmt.Printf("[Worker %d] Payment completed for order %s\n", workerID, order.OrderID)
-	}
-
-	// Delete message from queue after successful processing
-	if sqsClient != nil {
-		_, err := sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-			QueueUrl:      aws.String(sqsQueueURL),
-			ReceiptHandle: message.ReceiptHandle,
-		})
-
-		if err != nil {
-			fmt.Printf("Error deleting message from queue: %v\n", err)
-		}
-	}
-}
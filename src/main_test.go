@@ -125,3 +125,29 @@ func TestGetProduct_NotFound(t *testing.T) {
 		t.Fatalf("expected 404, got %d", w.Code)
 	}
 }
+
+func TestPostOrderSync_IgnoresClientOrderID(t *testing.T) {
+	ctx := withOrderStore(t)
+	withSagaGateway(t, 10)
+	withCatalog(t)
+	existing := &Order{OrderID: "taken", Status: orderCompleted, CaptureID: "cap-1", Items: []Item{{ProductID: "1", Quantity: 1, Price: 5}}}
+	orderStore.Put(ctx, existing)
+
+	router := gin.New()
+	router.POST("/orders/sync", postOrderSync)
+	body := []byte(`{"order_id":"taken","customer_id":7,"items":[{"product_id":"1","quantity":3}]}`)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/orders/sync", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["order_id"] == "taken" {
+		t.Fatal("client-supplied order ID was kept")
+	}
+	if stored, _ := orderStore.Get(ctx, "taken"); stored.CaptureID != "cap-1" || stored.Items[0].Quantity != 1 {
+		t.Fatalf("existing order was overwritten: %+v", stored)
+	}
+}
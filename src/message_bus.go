@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// QueuedMessage is a message received from a Subscriber. ReceiptHandle
+// identifies this particular delivery and changes on every receive.
+type QueuedMessage struct {
+	ID            string
+	Body          string
+	ReceiptHandle string
+	ReceiveCount  int
+	Attributes    map[string]string
+}
+
+// Publisher sends a message to a topic or queue and returns its message ID
+type Publisher interface {
+	Publish(ctx context.Context, body string, attributes map[string]string) (string, error)
+}
+
+// Subscriber is a queue with SQS semantics: received messages stay
+// invisible for the visibility timeout and reappear unless deleted.
+type Subscriber interface {
+	Receive(ctx context.Context, maxMessages int, wait, visibility time.Duration) ([]QueuedMessage, error)
+	ChangeVisibility(ctx context.Context, message QueuedMessage, timeout time.Duration) error
+	DeleteBatch(ctx context.Context, messages []QueuedMessage) ([]DeleteFailure, error)
+	Depth(ctx context.Context) (visible int, inFlight int, err error)
+}
+
+// DeleteFailure describes one entry of a DeleteBatch call that was not deleted
+type DeleteFailure struct {
+	Index     int
+	Code      string
+	Message   string
+	Retryable bool
+}
+
+// Order message bus wiring. postOrderAsync publishes to orderPublisher, the
+// worker consumes orderSubscriber and forwards failures to deadLetterPublisher.
+var (
+	orderPublisher      Publisher  = noopPublisher{}
+	orderSubscriber     Subscriber = noopSubscriber{}
+	deadLetterPublisher Publisher  = noopPublisher{}
+	orderBusKind                   = "noop"
+	orderBusClosers     []func() error
+)
+
+// initMessageBus selects the bus from MESSAGE_BUS (aws, memory, file or noop).
+// It defaults to aws when AWS clients are available and noop otherwise.
+func initMessageBus() {
+	kind := os.Getenv("MESSAGE_BUS")
+	if kind == "" {
+		kind = "noop"
+		if snsClient != nil && sqsClient != nil {
+			kind = "aws"
+		}
+	}
+
+	switch kind {
+	case "aws":
+		// Point these at ".fifo" resources for per-customer ordering
+		orderPublisher = &snsPublisher{client: snsClient, topicArn: getEnv("ORDER_TOPIC_ARN", snsTopicArn)}
+		orderSubscriber = &sqsSubscriber{client: sqsClient, queueURL: getEnv("ORDER_QUEUE_URL", sqsQueueURL)}
+		deadLetterPublisher = &sqsPublisher{client: sqsClient, queueURL: getEnv("ORDER_DLQ_URL", sqsDLQURL)}
+	case "memory":
+		topic := newMemoryTopic("order-processing-events")
+		queue := newMemoryQueue("order-processing-queue")
+		topic.subscribe(queue)
+		orderPublisher = topic
+		orderSubscriber = queue
+		deadLetterPublisher = newMemoryQueue("order-processing-dlq")
+	case "file":
+		if err := initFileBus(); err != nil {
+			fmt.Printf("⚠️  File queue unavailable: %v, falling back to noop\n", err)
+			kind = "noop"
+			orderPublisher = noopPublisher{}
+			orderSubscriber = noopSubscriber{}
+			deadLetterPublisher = noopPublisher{}
+		}
+	case "noop":
+		orderPublisher = noopPublisher{}
+		orderSubscriber = noopSubscriber{}
+		deadLetterPublisher = noopPublisher{}
+	default:
+		fmt.Printf("⚠️  Unknown MESSAGE_BUS %q, falling back to noop\n", kind)
+		kind = "noop"
+		orderPublisher = noopPublisher{}
+		orderSubscriber = noopSubscriber{}
+		deadLetterPublisher = noopPublisher{}
+	}
+
+	orderBusKind = kind
+	fmt.Printf("📨 Order message bus: %s\n", kind)
+
+	if arn := os.Getenv("CART_EVENTS_TOPIC_ARN"); arn != "" && snsClient != nil {
+		cartEventPublisher = &snsPublisher{client: snsClient, topicArn: arn}
+		fmt.Printf("📨 Cart events: %s\n", arn)
+	}
+}
+
+// initFileBus opens durable queues under QUEUE_DIR (default data/order-queue)
+func initFileBus() error {
+	dir := os.Getenv("QUEUE_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "order-queue")
+	}
+	segmentBytes := int64(getEnvInt("QUEUE_SEGMENT_BYTES", defaultSegmentBytes))
+
+	queue, err := openFileQueue(filepath.Join(dir, "orders"), segmentBytes)
+	if err != nil {
+		return err
+	}
+	dlq, err := openFileQueue(filepath.Join(dir, "dlq"), segmentBytes)
+	if err != nil {
+		queue.Close()
+		return err
+	}
+
+	topic := newMemoryTopic("order-processing-events")
+	topic.subscribe(queue)
+	orderPublisher = topic
+	orderSubscriber = queue
+	deadLetterPublisher = dlq
+	orderBusClosers = append(orderBusClosers, queue.Close, dlq.Close)
+
+	visible, _, _ := queue.Depth(context.Background())
+	fmt.Printf("📂 File queue at %s (%d pending orders recovered)\n", dir, visible)
+	return nil
+}
+
+// runsWorkerInProcess reports whether the bus only exists inside this
+// process, so the API has to run the order worker itself
+func runsWorkerInProcess() bool {
+	return orderBusKind == "memory" || orderBusKind == "file"
+}
+
+// closeMessageBus releases bus resources such as open queue files
+func closeMessageBus() {
+	for _, closeFn := range orderBusClosers {
+		if err := closeFn(); err != nil {
+			fmt.Printf("Warning: failed to close message bus: %v\n", err)
+		}
+	}
+	orderBusClosers = nil
+}
+
+// noopPublisher drops messages; used when no bus is configured
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	id := generateID("noop")
+	fmt.Printf("Message bus disabled, discarding message %s\n", id)
+	return id, nil
+}
+
+// noopSubscriber never delivers anything
+type noopSubscriber struct{}
+
+func (noopSubscriber) Receive(ctx context.Context, maxMessages int, wait, visibility time.Duration) ([]QueuedMessage, error) {
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+	return nil, nil
+}
+
+func (noopSubscriber) ChangeVisibility(ctx context.Context, message QueuedMessage, timeout time.Duration) error {
+	return nil
+}
+
+func (noopSubscriber) DeleteBatch(ctx context.Context, messages []QueuedMessage) ([]DeleteFailure, error) {
+	return nil, nil
+}
+
+func (noopSubscriber) Depth(ctx context.Context) (int, int, error) {
+	return 0, 0, nil
+}
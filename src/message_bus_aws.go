@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// snsPublisher publishes to an SNS topic; subscribed SQS queues receive the
+// message wrapped in an SNS notification envelope
+type snsPublisher struct {
+	client   *sns.Client
+	topicArn string
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	input := &sns.PublishInput{
+		TopicArn: aws.String(p.topicArn),
+		Message:  aws.String(body),
+	}
+	if isFIFO(p.topicArn) {
+		input.MessageGroupId, input.MessageDeduplicationId = fifoParams(attributes)
+	}
+	if len(attributes) > 0 {
+		input.MessageAttributes = make(map[string]snstypes.MessageAttributeValue, len(attributes))
+		for name, value := range attributes {
+			input.MessageAttributes[name] = snstypes.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+	}
+
+	result, err := p.client.Publish(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(result.MessageId), nil
+}
+
+// sqsPublisher sends directly to an SQS queue (used for the DLQ)
+type sqsPublisher struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(p.queueURL),
+		MessageBody:       aws.String(body),
+		MessageAttributes: toSQSAttributes(attributes),
+	}
+	if isFIFO(p.queueURL) {
+		input.MessageGroupId, input.MessageDeduplicationId = fifoParams(attributes)
+	}
+	result, err := p.client.SendMessage(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(result.MessageId), nil
+}
+
+// isFIFO reports whether a topic ARN or queue URL names a FIFO topic or queue
+func isFIFO(target string) bool {
+	return strings.HasSuffix(target, ".fifo")
+}
+
+// fifoParams returns the group and deduplication IDs for a FIFO topic or
+// queue. Without a deduplication ID the topic or queue must have
+// content-based deduplication enabled.
+func fifoParams(attributes map[string]string) (group, dedup *string) {
+	group = aws.String("default")
+	if id := attributes[attrMessageGroupID]; id != "" {
+		group = aws.String(id)
+	}
+	if id := attributes[attrDeduplicationID]; id != "" {
+		dedup = aws.String(id)
+	}
+	return group, dedup
+}
+
+// sqsSubscriber consumes an SQS queue
+type sqsSubscriber struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func (s *sqsSubscriber) Receive(ctx context.Context, maxMessages int, wait, visibility time.Duration) ([]QueuedMessage, error) {
+	result, err := s.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(s.queueURL),
+		MaxNumberOfMessages:   int32(maxMessages),
+		WaitTimeSeconds:       int32(wait.Seconds()),
+		VisibilityTimeout:     int32(visibility.Seconds()),
+		MessageAttributeNames: []string{"All"},
+		MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+			types.MessageSystemAttributeNameApproximateReceiveCount,
+		},
+	})
+	if result == nil {
+		return nil, err
+	}
+
+	messages := make([]QueuedMessage, 0, len(result.Messages))
+	for _, m := range result.Messages {
+		receiveCount, _ := strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+		attributes := make(map[string]string, len(m.MessageAttributes))
+		for name, value := range m.MessageAttributes {
+			attributes[name] = aws.ToString(value.StringValue)
+		}
+		messages = append(messages, QueuedMessage{
+			ID:            aws.ToString(m.MessageId),
+			Body:          aws.ToString(m.Body),
+			ReceiptHandle: aws.ToString(m.ReceiptHandle),
+			ReceiveCount:  receiveCount,
+			Attributes:    attributes,
+		})
+	}
+	return messages, err
+}
+
+func (s *sqsSubscriber) ChangeVisibility(ctx context.Context, message QueuedMessage, timeout time.Duration) error {
+	_, err := s.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.queueURL),
+		ReceiptHandle:     aws.String(message.ReceiptHandle),
+		VisibilityTimeout: int32(timeout.Seconds()),
+	})
+	return err
+}
+
+func (s *sqsSubscriber) DeleteBatch(ctx context.Context, messages []QueuedMessage) ([]DeleteFailure, error) {
+	input := &sqs.DeleteMessageBatchInput{QueueUrl: aws.String(s.queueURL)}
+	for i, m := range messages {
+		input.Entries = append(input.Entries, types.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: aws.String(m.ReceiptHandle),
+		})
+	}
+
+	output, err := s.client.DeleteMessageBatch(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := make([]DeleteFailure, 0, len(output.Failed))
+	for _, failed := range output.Failed {
+		i, convErr := strconv.Atoi(aws.ToString(failed.Id))
+		if convErr != nil || i < 0 || i >= len(messages) {
+			continue
+		}
+		failures = append(failures, DeleteFailure{
+			Index:     i,
+			Code:      aws.ToString(failed.Code),
+			Message:   aws.ToString(failed.Message),
+			Retryable: !failed.SenderFault,
+		})
+	}
+	return failures, nil
+}
+
+func (s *sqsSubscriber) Depth(ctx context.Context) (int, int, error) {
+	result, err := s.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(s.queueURL),
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	visible, _ := strconv.Atoi(result.Attributes[string(types.QueueAttributeNameApproximateNumberOfMessages)])
+	notVisible, _ := strconv.Atoi(result.Attributes[string(types.QueueAttributeNameApproximateNumberOfMessagesNotVisible)])
+	return visible, notVisible, nil
+}
+
+func toSQSAttributes(attributes map[string]string) map[string]types.MessageAttributeValue {
+	if len(attributes) == 0 {
+		return nil
+	}
+	values := make(map[string]types.MessageAttributeValue, len(attributes))
+	for name, value := range attributes {
+		values[name] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	return values
+}
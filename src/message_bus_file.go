@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileQueue is a durable, append-only queue for running the order flow
+// without AWS. Messages are appended to numbered segment files and
+// acknowledgements to acks.log; on open, every message without an ack is
+// loaded back. Visibility timeouts and receive counts live in memory (via
+// the embedded memoryQueue), so a restart makes in-flight messages visible
+// again with a fresh receive count. Segments whose messages are all
+// acknowledged are deleted by compaction.
+type fileQueue struct {
+	*memoryQueue
+
+	dir             string
+	maxSegmentBytes int64
+
+	mu         sync.Mutex // guards the files and live counts below
+	active     *os.File
+	activeSeg  int
+	activeSize int64
+	acks       *os.File
+	live       map[int]int // segment number -> unacknowledged messages
+}
+
+// fileRecord is one line of a segment file
+type fileRecord struct {
+	Body       string            `json:"body"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+}
+
+const (
+	defaultSegmentBytes = 4 << 20
+	ackLogName          = "acks.log"
+)
+
+// openFileQueue opens (or creates) the queue stored in dir
+func openFileQueue(dir string, maxSegmentBytes int64) (*fileQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	q := &fileQueue{
+		memoryQueue:     newMemoryQueue(filepath.Base(dir)),
+		dir:             dir,
+		maxSegmentBytes: maxSegmentBytes,
+		live:            make(map[int]int),
+	}
+
+	acked, err := q.readAcks()
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := q.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		if err := q.loadSegment(seg, acked); err != nil {
+			return nil, err
+		}
+	}
+
+	q.acks, err = os.OpenFile(filepath.Join(dir, ackLogName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ack log: %w", err)
+	}
+
+	next := 1
+	if len(segments) > 0 {
+		next = segments[len(segments)-1]
+	}
+	if err := q.openSegment(next); err != nil {
+		return nil, err
+	}
+
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func segmentName(seg int) string {
+	return fmt.Sprintf("segment-%08d.log", seg)
+}
+
+// messageID encodes where the message lives so acks can find its segment
+func messageID(seg int, offset int64) string {
+	return fmt.Sprintf("%08d-%012d", seg, offset)
+}
+
+func segmentOf(id string) (int, bool) {
+	prefix, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, false
+	}
+	seg, err := strconv.Atoi(prefix)
+	return seg, err == nil
+}
+
+func (q *fileQueue) listSegments() ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(q.dir, "segment-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, path := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "segment-"), ".log")
+		if seg, err := strconv.Atoi(name); err == nil {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (q *fileQueue) readAcks() (map[string]bool, error) {
+	acked := make(map[string]bool)
+	f, err := os.Open(filepath.Join(q.dir, ackLogName))
+	if os.IsNotExist(err) {
+		return acked, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ack log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			acked[id] = true
+		}
+	}
+	return acked, scanner.Err()
+}
+
+// loadSegment enqueues every unacknowledged record. A torn final line from
+// a crash mid-append is truncated away.
+func (q *fileQueue) loadSegment(seg int, acked map[string]bool) error {
+	path := filepath.Join(q.dir, segmentName(seg))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", segmentName(seg), err)
+	}
+
+	q.live[seg] = 0
+	var offset int64
+	for offset < int64(len(data)) {
+		end := bytes.IndexByte(data[offset:], '\n')
+		var record fileRecord
+		if end < 0 || json.Unmarshal(data[offset:offset+int64(end)], &record) != nil {
+			fmt.Printf("⚠️  Truncating corrupt tail of %s at offset %d\n", segmentName(seg), offset)
+			return os.Truncate(path, offset)
+		}
+
+		id := messageID(seg, offset)
+		if !acked[id] {
+			q.memoryQueue.add(id, record.Body, record.Attributes)
+			q.live[seg]++
+		}
+		offset += int64(end) + 1
+	}
+	return nil
+}
+
+// openSegment makes seg the segment new messages are appended to
+func (q *fileQueue) openSegment(seg int) error {
+	f, err := os.OpenFile(filepath.Join(q.dir, segmentName(seg)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if q.active != nil {
+		q.active.Close()
+	}
+	q.active, q.activeSeg, q.activeSize = f, seg, info.Size()
+	if _, ok := q.live[seg]; !ok {
+		q.live[seg] = 0
+	}
+	return nil
+}
+
+// Publish durably appends the message before making it visible
+func (q *fileQueue) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	line, err := json.Marshal(fileRecord{Body: body, Attributes: attributes, EnqueuedAt: time.Now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	if q.activeSize > 0 && q.activeSize+int64(len(line)) > q.maxSegmentBytes {
+		previous := q.activeSeg
+		if err := q.openSegment(previous + 1); err != nil {
+			q.mu.Unlock()
+			return "", err
+		}
+		if q.live[previous] <= 0 {
+			if err := q.compactLocked(); err != nil {
+				fmt.Printf("Warning: queue compaction failed: %v\n", err)
+			}
+		}
+	}
+
+	id := messageID(q.activeSeg, q.activeSize)
+	if _, err := q.active.Write(line); err != nil {
+		q.mu.Unlock()
+		return "", fmt.Errorf("failed to append message: %w", err)
+	}
+	if err := q.active.Sync(); err != nil {
+		q.mu.Unlock()
+		return "", fmt.Errorf("failed to sync segment: %w", err)
+	}
+	q.activeSize += int64(len(line))
+	q.live[q.activeSeg]++
+	q.mu.Unlock()
+
+	q.memoryQueue.add(id, body, attributes)
+	return id, nil
+}
+
+// DeleteBatch removes the messages and records their acknowledgements
+func (q *fileQueue) DeleteBatch(ctx context.Context, messages []QueuedMessage) ([]DeleteFailure, error) {
+	failures, err := q.memoryQueue.DeleteBatch(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[int]bool, len(failures))
+	for _, f := range failures {
+		failed[f.Index] = true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var buf strings.Builder
+	drained := false
+	for i, m := range messages {
+		if failed[i] {
+			continue
+		}
+		buf.WriteString(m.ID + "\n")
+		if seg, ok := segmentOf(m.ID); ok {
+			q.live[seg]--
+			drained = drained || (q.live[seg] <= 0 && seg != q.activeSeg)
+		}
+	}
+
+	if buf.Len() > 0 {
+		if _, err := io.WriteString(q.acks, buf.String()); err != nil {
+			return nil, fmt.Errorf("failed to record acks: %w", err)
+		}
+		if err := q.acks.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync ack log: %w", err)
+		}
+	}
+
+	if drained {
+		if err := q.compactLocked(); err != nil {
+			fmt.Printf("Warning: queue compaction failed: %v\n", err)
+		}
+	}
+	return failures, nil
+}
+
+func (q *fileQueue) compact() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.compactLocked()
+}
+
+// compactLocked deletes fully acknowledged segments (never the active one)
+// and rewrites the ack log without their entries
+func (q *fileQueue) compactLocked() error {
+	removed := false
+	for seg, count := range q.live {
+		if count > 0 || seg == q.activeSeg {
+			continue
+		}
+		if err := os.Remove(filepath.Join(q.dir, segmentName(seg))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(q.live, seg)
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+
+	acked, err := q.readAcks()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(q.dir, ackLogName+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for id := range acked {
+		if seg, ok := segmentOf(id); ok {
+			if _, stillPresent := q.live[seg]; stillPresent {
+				w.WriteString(id + "\n")
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, filepath.Join(q.dir, ackLogName)); err != nil {
+		return err
+	}
+
+	// Reopen so later appends go to the rewritten log
+	if q.acks != nil {
+		q.acks.Close()
+	}
+	q.acks, err = os.OpenFile(filepath.Join(q.dir, ackLogName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	return err
+}
+
+// segmentCount reports how many segment files are on disk
+func (q *fileQueue) segmentCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.live)
+}
+
+// Close releases the open segment and ack log files
+func (q *fileQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.acks != nil {
+		q.acks.Close()
+	}
+	if q.active != nil {
+		return q.active.Close()
+	}
+	return nil
+}
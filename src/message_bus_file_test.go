@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQueue_SurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	q, err := openFileQueue(dir, defaultSegmentBytes)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		if _, err := q.Publish(ctx, body, map[string]string{"k": body}); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+
+	received, _ := q.Receive(ctx, 2, 0, time.Minute)
+	if len(received) != 2 || received[0].Body != "a" {
+		t.Fatalf("expected a and b, got %+v", received)
+	}
+	if failures, err := q.DeleteBatch(ctx, received[:1]); err != nil || len(failures) != 0 {
+		t.Fatalf("ack failed: %v %+v", failures, err)
+	}
+	q.Close()
+
+	// b was in flight and c never received: both come back after reopening
+	reopened, err := openFileQueue(dir, defaultSegmentBytes)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	recovered, _ := reopened.Receive(ctx, 10, 0, time.Minute)
+	if len(recovered) != 2 || recovered[0].Body != "b" || recovered[1].Body != "c" || recovered[1].Attributes["k"] != "c" {
+		t.Fatalf("expected b and c after restart, got %+v", recovered)
+	}
+}
+
+func TestFileQueue_CompactsAckedSegments(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// Tiny segments so every message rolls to a new file
+	q, err := openFileQueue(dir, 10)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 4; i++ {
+		q.Publish(ctx, "order", nil)
+	}
+	if q.segmentCount() != 4 {
+		t.Fatalf("expected 4 segments, got %d", q.segmentCount())
+	}
+
+	received, _ := q.Receive(ctx, 10, 0, time.Minute)
+	q.DeleteBatch(ctx, received[:3])
+
+	if q.segmentCount() != 1 {
+		t.Fatalf("expected acked segments to be compacted, %d remain", q.segmentCount())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 segment file on disk, got %v", files)
+	}
+}
+
+func TestFileQueue_TruncatesTornWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	q, _ := openFileQueue(dir, defaultSegmentBytes)
+	q.Publish(ctx, "complete", nil)
+	q.Close()
+
+	f, _ := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.WriteString(`{"body":"half`)
+	f.Close()
+
+	reopened, err := openFileQueue(dir, defaultSegmentBytes)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	received, _ := reopened.Receive(ctx, 10, 0, time.Minute)
+	if len(received) != 1 || received[0].Body != "complete" {
+		t.Fatalf("expected only the complete record, got %+v", received)
+	}
+	if _, err := reopened.Publish(ctx, "next", nil); err != nil {
+		t.Fatalf("publish after truncation failed: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// snsEnvelope mirrors the JSON SNS wraps around messages delivered to SQS
+type snsEnvelope struct {
+	Type              string                          `json:"Type"`
+	MessageID         string                          `json:"MessageId"`
+	TopicArn          string                          `json:"TopicArn"`
+	Message           string                          `json:"Message"`
+	Timestamp         string                          `json:"Timestamp"`
+	MessageAttributes map[string]snsEnvelopeAttribute `json:"MessageAttributes,omitempty"`
+}
+
+type snsEnvelopeAttribute struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// memoryTopic fans published messages out to subscribed queues, wrapping
+// each one in an SNS envelope like SNS→SQS delivery does
+type memoryTopic struct {
+	name   string
+	mu     sync.RWMutex
+	queues []Publisher
+}
+
+func newMemoryTopic(name string) *memoryTopic {
+	return &memoryTopic{name: name}
+}
+
+func (t *memoryTopic) subscribe(q Publisher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queues = append(t.queues, q)
+}
+
+func (t *memoryTopic) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	envelope := snsEnvelope{
+		Type:      "Notification",
+		MessageID: generateID("msg"),
+		TopicArn:  "arn:aws:sns:local:000000000000:" + t.name,
+		Message:   body,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if len(attributes) > 0 {
+		envelope.MessageAttributes = make(map[string]snsEnvelopeAttribute, len(attributes))
+		for name, value := range attributes {
+			envelope.MessageAttributes[name] = snsEnvelopeAttribute{Type: "String", Value: value}
+		}
+	}
+
+	wrapped, err := json.Marshal(envelope)
+	if err != nil {
+		return "", fmt.Errorf("failed to build SNS envelope: %w", err)
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, q := range t.queues {
+		if _, err := q.Publish(ctx, string(wrapped), nil); err != nil {
+			return "", err
+		}
+	}
+	return envelope.MessageID, nil
+}
+
+// memoryQueue is an in-process queue with SQS-style visibility timeouts
+type memoryQueue struct {
+	name     string
+	mu       sync.Mutex
+	messages []*memoryMessage
+	notify   chan struct{} // closed and replaced whenever a message may have become available
+}
+
+type memoryMessage struct {
+	id             string
+	body           string
+	attributes     map[string]string
+	receiveCount   int
+	receipt        string
+	invisibleUntil time.Time
+}
+
+func newMemoryQueue(name string) *memoryQueue {
+	return &memoryQueue{name: name, notify: make(chan struct{})}
+}
+
+// wake must be called with q.mu held
+func (q *memoryQueue) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+func (q *memoryQueue) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	id := generateID("msg")
+	q.add(id, body, attributes)
+	return id, nil
+}
+
+// add enqueues a message under a caller-chosen ID
+func (q *memoryQueue) add(id, body string, attributes map[string]string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.messages = append(q.messages, &memoryMessage{id: id, body: body, attributes: attributes})
+	q.wake()
+}
+
+func (q *memoryQueue) Receive(ctx context.Context, maxMessages int, wait, visibility time.Duration) ([]QueuedMessage, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		var received []QueuedMessage
+		var nextVisible time.Time
+		for _, m := range q.messages {
+			if len(received) >= maxMessages {
+				break
+			}
+			if now.Before(m.invisibleUntil) {
+				if nextVisible.IsZero() || m.invisibleUntil.Before(nextVisible) {
+					nextVisible = m.invisibleUntil
+				}
+				continue
+			}
+			m.receiveCount++
+			m.receipt = generateID("rcpt")
+			m.invisibleUntil = now.Add(visibility)
+			received = append(received, QueuedMessage{
+				ID:            m.id,
+				Body:          m.body,
+				ReceiptHandle: m.receipt,
+				ReceiveCount:  m.receiveCount,
+				Attributes:    m.attributes,
+			})
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		if len(received) > 0 || !now.Before(deadline) {
+			return received, nil
+		}
+
+		// Sleep until a publish, the next visibility expiry or the wait deadline
+		sleep := deadline.Sub(now)
+		if !nextVisible.IsZero() && nextVisible.Sub(now) < sleep {
+			sleep = nextVisible.Sub(now)
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-notify:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// find returns the message currently held under receipt; must be called with q.mu held
+func (q *memoryQueue) find(receipt string) (int, *memoryMessage) {
+	for i, m := range q.messages {
+		if m.receipt == receipt && receipt != "" {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+func (q *memoryQueue) ChangeVisibility(ctx context.Context, message QueuedMessage, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, m := q.find(message.ReceiptHandle)
+	if m == nil {
+		return fmt.Errorf("receipt handle for message %s is invalid", message.ID)
+	}
+	m.invisibleUntil = time.Now().Add(timeout)
+	if timeout == 0 {
+		q.wake()
+	}
+	return nil
+}
+
+func (q *memoryQueue) DeleteBatch(ctx context.Context, messages []QueuedMessage) ([]DeleteFailure, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var failures []DeleteFailure
+	for i, message := range messages {
+		idx, m := q.find(message.ReceiptHandle)
+		if m == nil {
+			failures = append(failures, DeleteFailure{
+				Index:   i,
+				Code:    "ReceiptHandleIsInvalid",
+				Message: fmt.Sprintf("message %s is not held under this receipt handle", message.ID),
+			})
+			continue
+		}
+		q.messages = append(q.messages[:idx], q.messages[idx+1:]...)
+	}
+	return failures, nil
+}
+
+func (q *memoryQueue) Depth(ctx context.Context) (int, int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	visible, inFlight := 0, 0
+	for _, m := range q.messages {
+		if now.Before(m.invisibleUntil) {
+			inFlight++
+		} else {
+			visible++
+		}
+	}
+	return visible, inFlight, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMemoryQueue_VisibilityAndDelete(t *testing.T) {
+	ctx := context.Background()
+	q := newMemoryQueue("test")
+	q.Publish(ctx, "hello", nil)
+
+	first, _ := q.Receive(ctx, 10, 0, 50*time.Millisecond)
+	if len(first) != 1 || first[0].ReceiveCount != 1 {
+		t.Fatalf("expected one first delivery, got %+v", first)
+	}
+	if again, _ := q.Receive(ctx, 10, 0, time.Second); len(again) != 0 {
+		t.Fatalf("message should be invisible, got %+v", again)
+	}
+
+	// Visibility expires while waiting, so the message is redelivered
+	second, _ := q.Receive(ctx, 10, time.Second, time.Second)
+	if len(second) != 1 || second[0].ReceiveCount != 2 {
+		t.Fatalf("expected redelivery, got %+v", second)
+	}
+
+	failures, _ := q.DeleteBatch(ctx, []QueuedMessage{first[0], second[0]})
+	if len(failures) != 1 || failures[0].Index != 0 || failures[0].Retryable {
+		t.Fatalf("expected stale first receipt to fail permanently, got %+v", failures)
+	}
+	if visible, inFlight, _ := q.Depth(ctx); visible != 0 || inFlight != 0 {
+		t.Fatalf("expected empty queue, got visible=%d inFlight=%d", visible, inFlight)
+	}
+}
+
+func TestMemoryBus_AsyncOrderFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	topic := newMemoryTopic("orders")
+	queue := newMemoryQueue("orders-queue")
+	dlq := newMemoryQueue("orders-dlq")
+	topic.subscribe(queue)
+
+	pp := newPaymentProcessor(5)
+	pp.Delay = 0
+	defer func(p Publisher, s Subscriber, d Publisher, g PaymentGateway) {
+		orderPublisher, orderSubscriber, deadLetterPublisher, paymentGateway = p, s, d, g
+	}(orderPublisher, orderSubscriber, deadLetterPublisher, paymentGateway)
+	orderPublisher, orderSubscriber, deadLetterPublisher, paymentGateway = topic, queue, dlq, pp
+
+	ctx, cancel := context.WithCancel(context.Background())
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		startOrderProcessor(ctx)
+	}()
+
+	store = newProductStore()
+	store.generateProducts()
+
+	router := gin.New()
+	router.POST("/orders/async", postOrderAsync)
+
+	body := []byte(`{"customer_id":42,"items":[{"product_id":"1","quantity":2}]}`)
+	req := httptest.NewRequest(http.MethodPost, "/orders/async", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d; body=%s", w.Code, w.Body.String())
+	}
+
+	// A malformed message goes straight to the DLQ
+	queue.Publish(ctx, "not an envelope", nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		processed, _ := pp.Stats()
+		visible, inFlight, _ := queue.Depth(ctx)
+		dead, _, _ := dlq.Depth(ctx)
+		if processed == 1 && visible == 0 && inFlight == 0 && dead == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order not processed: processed=%d visible=%d inFlight=%d dead=%d", processed, visible, inFlight, dead)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-workerDone
+
+	dead, _ := dlq.Receive(context.Background(), 1, 0, time.Second)
+	if len(dead) != 1 || dead[0].Attributes["failure_reason"] != "invalid_envelope" {
+		t.Fatalf("expected dead-lettered message with metadata, got %+v", dead)
+	}
+
+	var envelope snsEnvelope
+	topic.Publish(context.Background(), `{"order_id":"x"}`, nil)
+	delivered, _ := queue.Receive(context.Background(), 1, 0, time.Second)
+	if len(delivered) != 1 || json.Unmarshal([]byte(delivered[0].Body), &envelope) != nil || envelope.Message != `{"order_id":"x"}` {
+		t.Fatalf("expected SNS-wrapped delivery, got %+v", delivered)
+	}
+}
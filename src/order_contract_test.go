@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The publisher half of the order wire contract (the consumer half is in
+// the Lambda): what submitOrder puts on the topic must decode back to the
+// same order from the SNS envelope subscribers receive.
+func TestOrderContract_PublishedMessage(t *testing.T) {
+	data, err := os.ReadFile("orders/testdata/order_full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		t.Fatal(err)
+	}
+
+	topic := newMemoryTopic("orders")
+	queue := newMemoryQueue("orders-queue")
+	topic.subscribe(queue)
+	defer func(p Publisher) { orderPublisher = p }(orderPublisher)
+	orderPublisher = topic
+	withOrderStore(t)
+
+	ctx := context.Background()
+	if err := submitOrder(ctx, &order); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := queue.Receive(ctx, 1, 0, time.Second)
+	if len(messages) != 1 {
+		t.Fatalf("expected one published message, got %d", len(messages))
+	}
+
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(messages[0].Body), &envelope); err != nil || envelope.Type != "Notification" {
+		t.Fatalf("message is not an SNS notification: %v", err)
+	}
+	var received Order
+	if err := json.Unmarshal([]byte(envelope.Message), &received); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, order) {
+		t.Errorf("consumer would see a different order:\n got %+v\nwant %+v", received, order)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"text/main/orders"
+)
+
+// Live order status. Writes through orderStore are broadcast to watchers in
+// this process; watchers also re-read the store every orderEventsPoll so
+// changes made by a separate worker process (MySQL store) show up too.
+
+var (
+	orderEventsPoll      = time.Duration(getEnvInt("ORDER_EVENTS_POLL_MS", 1000)) * time.Millisecond
+	orderEventsHeartbeat = 15 * time.Second
+	orderMaxLongPoll     = time.Duration(getEnvInt("ORDER_MAX_WAIT_SECONDS", 30)) * time.Second
+)
+
+// orderWatchers fans out order changes to subscribers by order ID
+type orderWatchers struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Order]struct{}
+}
+
+var orderChanges = &orderWatchers{subs: make(map[string]map[chan Order]struct{})}
+
+// watch subscribes to changes of one order until cancel is called
+func (w *orderWatchers) watch(orderID string) (<-chan Order, func()) {
+	ch := make(chan Order, 16)
+	w.mu.Lock()
+	if w.subs[orderID] == nil {
+		w.subs[orderID] = make(map[chan Order]struct{})
+	}
+	w.subs[orderID][ch] = struct{}{}
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.subs[orderID], ch)
+		if len(w.subs[orderID]) == 0 {
+			delete(w.subs, orderID)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// publish never blocks: a slow subscriber misses the update and catches
+// up on its next poll
+func (w *orderWatchers) publish(order *Order) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs[order.OrderID] {
+		select {
+		case ch <- *order:
+		default:
+		}
+	}
+}
+
+// watchedOrderStore publishes every successful write to orderChanges
+type watchedOrderStore struct {
+	OrderStore
+}
+
+func (s watchedOrderStore) Put(ctx context.Context, order *Order) error {
+	if err := s.OrderStore.Put(ctx, order); err != nil {
+		return err
+	}
+	orderChanges.publish(order)
+	return nil
+}
+
+func (s watchedOrderStore) Update(ctx context.Context, orderID string, fn func(*Order) error) (*Order, error) {
+	order, err := s.OrderStore.Update(ctx, orderID, fn)
+	if err == nil {
+		orderChanges.publish(order)
+	}
+	return order, err
+}
+
+// orderSettled reports whether payment for the order is over, one way or another
+func orderSettled(status string) bool {
+	return orders.Settled(status)
+}
+
+// followOrder calls onChange with the current order and then with every
+// status change, until the order settles, onChange returns false or ctx
+// ends. It returns the last order seen.
+func followOrder(ctx context.Context, orderID string, onChange func(*Order) bool) (*Order, error) {
+	changes, cancel := orderChanges.watch(orderID)
+	defer cancel()
+
+	// Subscribe before the first read so no change slips in between
+	last, err := orderStore.Get(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !onChange(last) || orderSettled(last.Status) {
+		return last, nil
+	}
+
+	poll := time.NewTicker(orderEventsPoll)
+	defer poll.Stop()
+
+	for {
+		var current *Order
+		select {
+		case <-ctx.Done():
+			return last, nil
+		case order := <-changes:
+			current = &order
+		case <-poll.C:
+			current, err = orderStore.Get(ctx, orderID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return last, nil
+				}
+				return last, err
+			}
+		}
+
+		if current.Status == last.Status {
+			continue
+		}
+		last = current
+		if !onChange(current) || orderSettled(current.Status) {
+			return last, nil
+		}
+	}
+}
+
+// orderStatusEvent is the data of each SSE "status" event
+type orderStatusEvent struct {
+	OrderID string    `json:"order_id"`
+	Status  string    `json:"status"`
+	Settled bool      `json:"settled"`
+	At      time.Time `json:"at"`
+	Order   *Order    `json:"order,omitempty"` // included once settled
+}
+
+// GET /orders/:id/events - Server-sent events, one per status change.
+// The stream ends once the order settles.
+func getOrderEvents(c *gin.Context) {
+	// Lambda buffers the whole response, so the stream would never arrive
+	if onLambda() {
+		c.JSON(http.StatusNotImplemented, gin.H{
+			"error":   "event stream not available on Lambda",
+			"message": "poll GET /orders/" + c.Param("id") + " instead",
+		})
+		return
+	}
+	orderID := c.Param("id")
+	if _, err := orderStore.Get(c.Request.Context(), orderID); errors.Is(err, errOrderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load order"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // don't let proxies buffer the stream
+
+	heartbeat := time.NewTicker(orderEventsHeartbeat)
+	defer heartbeat.Stop()
+	var mu sync.Mutex // heartbeats and events share the writer
+
+	// The heartbeat goroutine must be gone before the handler returns and
+	// gin reuses the writer
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	heartbeatDone := make(chan struct{})
+	defer func() {
+		cancel()
+		<-heartbeatDone
+	}()
+	go func() {
+		defer close(heartbeatDone)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				mu.Lock()
+				c.Writer.WriteString(": keep-alive\n\n")
+				c.Writer.Flush()
+				mu.Unlock()
+			}
+		}
+	}()
+
+	_, err := followOrder(ctx, orderID, func(order *Order) bool {
+		event := orderStatusEvent{OrderID: order.OrderID, Status: order.Status, Settled: orderSettled(order.Status), At: time.Now().UTC()}
+		if event.Settled {
+			event.Order = order
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		c.SSEvent("status", event)
+		c.Writer.Flush()
+		return true
+	})
+	if err != nil {
+		mu.Lock()
+		c.SSEvent("error", gin.H{"error": "failed to load order"})
+		c.Writer.Flush()
+		mu.Unlock()
+	}
+}
+
+// parseOrderWait reads ?wait= as a Go duration ("10s") or whole seconds ("10")
+func parseOrderWait(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(raw)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(raw)
+		if convErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, errors.New("wait must not be negative")
+	}
+	if wait > orderMaxLongPoll {
+		wait = orderMaxLongPoll
+	}
+	return wait, nil
+}
+
+// waitForSettled blocks until the order settles or wait elapses
+func waitForSettled(ctx context.Context, orderID string, wait time.Duration) (*Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	return followOrder(ctx, orderID, func(*Order) bool { return true })
+}
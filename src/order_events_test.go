@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// advanceOrder walks a stored order through statuses, pausing between each
+func advanceOrder(ctx context.Context, orderID string, statuses ...string) {
+	for _, status := range statuses {
+		time.Sleep(10 * time.Millisecond)
+		orderStore.Update(ctx, orderID, func(o *Order) error {
+			o.Status = status
+			return nil
+		})
+	}
+}
+
+func TestOrderEvents_StreamsEachTransition(t *testing.T) {
+	ctx := withOrderStore(t)
+	orderStore.Put(ctx, &Order{OrderID: "sse-1", Status: orderPending})
+	go advanceOrder(ctx, "sse-1", orderProcessing, orderCapturing, orderCompleted)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/orders/:id/events", getOrderEvents)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/orders/sse-1/events", nil)
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(w, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream did not end after the order settled")
+	}
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := w.Body.String()
+	last := -1
+	for _, status := range []string{orderPending, orderProcessing, orderCapturing, orderCompleted} {
+		i := strings.Index(body, `"status":"`+status+`"`)
+		if i <= last {
+			t.Fatalf("status %s missing or out of order in stream:\n%s", status, body)
+		}
+		last = i
+	}
+	if strings.Count(body, "event:status") != 4 {
+		t.Errorf("expected 4 status events:\n%s", body)
+	}
+}
+
+func TestOrderEvents_UnknownOrder(t *testing.T) {
+	withOrderStore(t)
+	router := gin.New()
+	router.GET("/orders/:id/events", getOrderEvents)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders/missing/events", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestWaitForSettled(t *testing.T) {
+	ctx := withOrderStore(t)
+	orderStore.Put(ctx, &Order{OrderID: "wait-1", Status: orderPending})
+	go advanceOrder(ctx, "wait-1", orderProcessing, orderFailed)
+
+	order, err := waitForSettled(ctx, "wait-1", time.Second)
+	if err != nil || order.Status != orderFailed {
+		t.Fatalf("expected failed order, got %+v, %v", order, err)
+	}
+
+	// Times out with the status it last saw
+	orderStore.Put(ctx, &Order{OrderID: "wait-2", Status: orderPending})
+	go advanceOrder(ctx, "wait-2", orderProcessing)
+	order, err = waitForSettled(ctx, "wait-2", 100*time.Millisecond)
+	if err != nil || order.Status != orderProcessing {
+		t.Fatalf("expected processing order after timeout, got %+v, %v", order, err)
+	}
+}
+
+func TestParseOrderWait(t *testing.T) {
+	cases := map[string]time.Duration{"": 0, "10s": 10 * time.Second, "5": 5 * time.Second, "1h": orderMaxLongPoll}
+	for raw, want := range cases {
+		got, err := parseOrderWait(raw)
+		if err != nil || got != want {
+			t.Errorf("parseOrderWait(%q) = %v, %v; want %v", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"soon", "-1s"} {
+		if _, err := parseOrderWait(raw); err == nil {
+			t.Errorf("parseOrderWait(%q) should fail", raw)
+		}
+	}
+}
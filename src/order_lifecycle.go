@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"text/main/orders"
+)
+
+// Order lifecycle; the state machine itself is in the shared orders package.
+//
+//	pending -> processing -> capturing -> completed -> partially_refunded -> refunded
+//	pending -> cancelled
+//	processing -> cancel_requested -> cancelled (authorization voided by the worker)
+//	processing -> failed
+//	capturing -> needs_review (interrupted mid-capture)
+const (
+	orderPending           = orders.StatusPending
+	orderProcessing        = orders.StatusProcessing
+	orderCapturing         = orders.StatusCapturing
+	orderCompleted         = orders.StatusCompleted
+	orderFailed            = orders.StatusFailed
+	orderCancelRequested   = orders.StatusCancelRequested
+	orderCancelled         = orders.StatusCancelled
+	orderPartiallyRefunded = orders.StatusPartiallyRefunded
+	orderRefunded          = orders.StatusRefunded
+	orderNeedsReview       = orders.StatusNeedsReview
+)
+
+var (
+	errOrderCancelled = orders.ErrCancelled
+	errInvalidRefund  = orders.ErrInvalidRefund
+)
+
+// A refund still pending after this long lost its outcome (the process died
+// between the gateway call and recording it); it is marked unknown and stops
+// counting against the refundable amount. Well past the gateway timeout.
+var refundOutcomeTimeout = time.Duration(getEnvInt("REFUND_PENDING_SECONDS", 300)) * time.Second
+
+type (
+	Refund          = orders.Refund
+	OrderProcessing = orders.OrderProcessing
+	lifecycleError  = orders.LifecycleError
+)
+
+// claimOrder moves the order to processing before the worker charges it.
+// It returns false when the order must not be charged: it was cancelled,
+// a redelivered message finds it already settled, or an earlier attempt
+// died mid-capture and the order needs review.
+func claimOrder(ctx context.Context, orderID string) (bool, error) {
+	interrupted := false
+	order, err := orderStore.Update(ctx, orderID, func(o *Order) error {
+		capturing := o.Status == orderCapturing
+		orders.Claim(o)
+		interrupted = capturing && o.Status == orderNeedsReview
+		return nil
+	})
+	if errors.Is(err, errOrderNotFound) {
+		// Not tracked by this process (e.g. separate worker without MySQL)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if interrupted {
+		fmt.Printf("Warning: order %s was interrupted mid-capture; marked %s instead of capturing again\n", orderID, orderNeedsReview)
+	}
+	return order.Status == orderProcessing || order.Status == orderCapturing, nil
+}
+
+// beginCapture is the last point a cancellation can win. Whichever of this
+// and cancelOrder updates the order first decides the outcome.
+func beginCapture(ctx context.Context, orderID string) error {
+	cancelled := false
+	_, err := orderStore.Update(ctx, orderID, func(o *Order) error {
+		// The cancellation is saved, so the error is only reported afterwards
+		cancelled = errors.Is(orders.BeginCapture(o), errOrderCancelled)
+		return nil
+	})
+	if errors.Is(err, errOrderNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		return errOrderCancelled
+	}
+	return nil
+}
+
+// abortCapture hands the order back to processing after a failed capture
+func abortCapture(ctx context.Context, orderID string) error {
+	_, err := orderStore.Update(ctx, orderID, func(o *Order) error {
+		orders.AbortCapture(o)
+		return nil
+	})
+	if errors.Is(err, errOrderNotFound) {
+		return nil
+	}
+	return err
+}
+
+// recordPaymentResult saves the outcome of charging the order
+func recordPaymentResult(ctx context.Context, paid *Order, status string) {
+	_, err := orderStore.Update(ctx, paid.OrderID, func(o *Order) error {
+		o.Status = status
+		o.AuthorizationID = paid.AuthorizationID
+		o.CaptureID = paid.CaptureID
+		return nil
+	})
+	if err != nil && !errors.Is(err, errOrderNotFound) {
+		fmt.Printf("Warning: failed to record %s status for order %s: %v\n", status, paid.OrderID, err)
+	}
+}
+
+// cancelOrder cancels a pending order outright, or asks the worker to
+// cancel one it is already processing; the worker then releases its coupons
+// when it compensates
+func cancelOrder(ctx context.Context, orderID string) (*Order, error) {
+	order, err := orderStore.Update(ctx, orderID, orders.Cancel)
+	if err == nil && order.Status == orderCancelled {
+		if relErr := releaseCoupons(ctx, orderID); relErr != nil {
+			fmt.Printf("Warning: order %s cancelled but its coupons were not released: %v\n", orderID, relErr)
+		}
+	}
+	return order, err
+}
+
+// refundableUnit is what one unit of a line refunds: its share of the
+// discounted, taxed line total
+func refundableUnit(o *Order, productID string) float64 {
+	if o.Pricing != nil {
+		for _, line := range o.Pricing.Lines {
+			if line.ProductID == productID && line.Quantity > 0 {
+				return line.Total / float64(line.Quantity)
+			}
+		}
+	}
+	for _, item := range o.Items {
+		if item.ProductID == productID {
+			return item.Price
+		}
+	}
+	return 0
+}
+
+// refunded sums refunds that haven't failed or been abandoned, by amount and per product
+func refunded(o *Order) (float64, map[string]int) {
+	amount := 0.0
+	quantities := make(map[string]int)
+	for _, r := range o.Refunds {
+		if r.Status == "failed" || r.Status == "unknown" {
+			continue
+		}
+		amount += r.Amount
+		for _, line := range r.Lines {
+			quantities[line.ProductID] += line.Quantity
+		}
+	}
+	return roundCents(amount), quantities
+}
+
+// planRefund works out a refund of lines, or of everything left (including
+// shipping) when lines is empty
+func planRefund(o *Order, lines []Item) (Refund, error) {
+	alreadyAmount, alreadyQty := refunded(o)
+	remaining := roundCents(o.Total() - alreadyAmount)
+
+	refund := Refund{RefundID: generateID("rfd"), Status: "pending", CreatedAt: time.Now()}
+	if len(lines) == 0 {
+		for _, item := range o.Items {
+			if left := item.Quantity - alreadyQty[item.ProductID]; left > 0 {
+				refund.Lines = append(refund.Lines, Item{ProductID: item.ProductID, Quantity: left, Price: roundCents(refundableUnit(o, item.ProductID))})
+			}
+		}
+		refund.Amount = remaining
+	} else {
+		ordered := make(map[string]int)
+		for _, item := range o.Items {
+			ordered[item.ProductID] += item.Quantity
+		}
+		requested := make(map[string]int)
+		for _, line := range lines {
+			requested[line.ProductID] += line.Quantity
+			if line.Quantity < 1 {
+				return Refund{}, fmt.Errorf("%w: quantity for product %s must be positive", errInvalidRefund, line.ProductID)
+			}
+			if requested[line.ProductID] > ordered[line.ProductID]-alreadyQty[line.ProductID] {
+				return Refund{}, fmt.Errorf("%w: product %s has %d unit(s) left to refund", errInvalidRefund, line.ProductID,
+					ordered[line.ProductID]-alreadyQty[line.ProductID])
+			}
+			unit := refundableUnit(o, line.ProductID)
+			refund.Lines = append(refund.Lines, Item{ProductID: line.ProductID, Quantity: line.Quantity, Price: roundCents(unit)})
+			refund.Amount += unit * float64(line.Quantity)
+		}
+		refund.Amount = math.Min(roundCents(refund.Amount), remaining)
+	}
+
+	if refund.Amount <= 0 {
+		return Refund{}, fmt.Errorf("%w: nothing left to refund", errInvalidRefund)
+	}
+	return refund, nil
+}
+
+// refundOrder reserves the refund on the order, asks the gateway for it and
+// records the outcome
+func refundOrder(ctx context.Context, orderID string, lines []Item) (*Order, Refund, error) {
+	var refund Refund
+	order, err := orderStore.Update(ctx, orderID, func(o *Order) error {
+		if o.Status != orderCompleted && o.Status != orderPartiallyRefunded {
+			return &lifecycleError{Action: "refund", Status: o.Status}
+		}
+		if o.CaptureID == "" {
+			return &lifecycleError{Action: "refund", Status: "missing a capture"}
+		}
+		abandonStaleRefunds(o, time.Now())
+		planned, err := planRefund(o, lines)
+		if err != nil {
+			return err
+		}
+		refund = planned
+		o.Refunds = append(o.Refunds, refund)
+		return nil
+	})
+	if err != nil {
+		return order, refund, err
+	}
+
+	captureID := order.CaptureID
+	transactionID, gwErr := paymentGateway.Refund(ctx, captureID, refund.Amount)
+
+	order, err = orderStore.Update(context.Background(), orderID, func(o *Order) error {
+		for i := range o.Refunds {
+			if o.Refunds[i].RefundID != refund.RefundID {
+				continue
+			}
+			if gwErr != nil {
+				o.Refunds[i].Status = "failed"
+				o.Refunds[i].Error = gwErr.Error()
+			} else {
+				o.Refunds[i].Status = "succeeded"
+				o.Refunds[i].TransactionID = transactionID
+			}
+			refund = o.Refunds[i]
+		}
+		if amount, _ := refunded(o); amount >= roundCents(o.Total()) {
+			o.Status = orderRefunded
+		} else if amount > 0 {
+			o.Status = orderPartiallyRefunded
+		}
+		return nil
+	})
+	if err != nil {
+		// The gateway already answered; the refund stays pending until abandoned
+		fmt.Printf("Error recording refund %s of order %s (capture %s, transaction %q, gateway error %v): %v\n",
+			refund.RefundID, orderID, captureID, transactionID, gwErr, err)
+		return order, refund, err
+	}
+	if gwErr != nil {
+		return order, refund, fmt.Errorf("refund: %w", gwErr)
+	}
+	return order, refund, nil
+}
+
+// abandonStaleRefunds marks refunds pending for longer than
+// refundOutcomeTimeout as unknown, to be reconciled with the gateway
+func abandonStaleRefunds(o *Order, now time.Time) {
+	for i := range o.Refunds {
+		r := &o.Refunds[i]
+		if r.Status != "pending" || now.Sub(r.CreatedAt) < refundOutcomeTimeout {
+			continue
+		}
+		r.Status = "unknown"
+		r.Error = "outcome was never recorded; reconcile with the payment gateway"
+		fmt.Printf("Warning: refund %s of %.2f on order %s (capture %s) has no recorded outcome, marked unknown\n",
+			r.RefundID, r.Amount, o.OrderID, o.CaptureID)
+	}
+}
+
+// GET /orders/:id
+func getOrder(c *gin.Context) {
+	order, err := orderStore.Get(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, errOrderNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load order"})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// POST /orders/:id/cancel
+func postOrderCancel(c *gin.Context) {
+	order, err := cancelOrder(c.Request.Context(), c.Param("id"))
+	var lcErr *lifecycleError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	case errors.As(err, &lcErr):
+		c.JSON(http.StatusConflict, gin.H{"error": lcErr.Error(), "status": lcErr.Status})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel order"})
+	case order.Status == orderCancelRequested:
+		c.JSON(http.StatusAccepted, gin.H{
+			"order_id": order.OrderID,
+			"status":   order.Status,
+			"message":  "payment in progress; the order will be cancelled before capture",
+		})
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"order_id": order.OrderID,
+			"status":   order.Status,
+			"message":  "order cancelled",
+		})
+	}
+}
+
+// RefundRequest is the optional body of POST /orders/:id/refund; no lines
+// refunds everything not yet refunded
+type RefundRequest struct {
+	Lines []struct {
+		ProductID string `json:"product_id" binding:"required"`
+		Quantity  int    `json:"quantity" binding:"required,gt=0"`
+	} `json:"lines"`
+}
+
+// POST /orders/:id/refund
+func postOrderRefund(c *gin.Context) {
+	var req RefundRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var lines []Item
+	for _, line := range req.Lines {
+		lines = append(lines, Item{ProductID: line.ProductID, Quantity: line.Quantity})
+	}
+
+	order, refund, err := refundOrder(c.Request.Context(), c.Param("id"), lines)
+	var lcErr *lifecycleError
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "order not found"})
+	case errors.As(err, &lcErr):
+		c.JSON(http.StatusConflict, gin.H{"error": lcErr.Error(), "status": lcErr.Status})
+	case errors.Is(err, errInvalidRefund):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case err != nil && refund.Status == "failed":
+		c.JSON(http.StatusBadGateway, gin.H{"error": "payment gateway refund failed", "refund": refund})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record refund", "refund": refund})
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"order_id": order.OrderID,
+			"status":   order.Status,
+			"refund":   refund,
+		})
+	}
+}
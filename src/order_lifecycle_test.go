@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// cancellingGateway cancels the order while it is being authorized,
+// simulating a customer racing the worker
+type cancellingGateway struct {
+	*PaymentProcessor
+	authorized int
+	voided     bool
+}
+
+func (g *cancellingGateway) Authorize(ctx context.Context, order *Order) (string, error) {
+	if _, err := cancelOrder(ctx, order.OrderID); err != nil {
+		return "", err
+	}
+	g.authorized++
+	return g.PaymentProcessor.Authorize(ctx, order)
+}
+
+func (g *cancellingGateway) Void(ctx context.Context, authorizationID string) error {
+	g.voided = true
+	return g.PaymentProcessor.Void(ctx, authorizationID)
+}
+
+func withOrderStore(t *testing.T) context.Context {
+	previous, previousDedup := orderStore, orderDedup
+	orderStore, orderDedup = watchedOrderStore{newMemoryOrderStore()}, newMemoryDedupStore()
+	t.Cleanup(func() { orderStore, orderDedup = previous, previousDedup })
+	return context.Background()
+}
+
+func orderMessage(t *testing.T, order *Order) QueuedMessage {
+	orderJSON, _ := json.Marshal(order)
+	body, _ := json.Marshal(snsEnvelope{Type: "Notification", Message: string(orderJSON)})
+	return QueuedMessage{ID: "m-" + order.OrderID, Body: string(body), ReceiveCount: 1}
+}
+
+func TestCancelRacesWorker(t *testing.T) {
+	ctx := withOrderStore(t)
+	pp := newPaymentProcessor(1)
+	pp.Delay = 0
+	gateway := &cancellingGateway{PaymentProcessor: pp}
+	defer func(g PaymentGateway) { paymentGateway = g }(paymentGateway)
+	paymentGateway = gateway
+
+	order := &Order{OrderID: "race-1", Status: orderPending, Items: []Item{{ProductID: "1", Quantity: 1, Price: 10}}}
+	orderStore.Put(ctx, order)
+
+	// Cancellation lands after the worker claimed the order but before capture
+	if err := processOrderMessage(ctx, orderMessage(t, order), 1); err != nil {
+		t.Fatalf("cancelled order should be acknowledged, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	if stored.Status != orderCancelled || !gateway.voided {
+		t.Fatalf("expected cancelled order with voided authorization, got %s (voided=%v)", stored.Status, gateway.voided)
+	}
+
+	// Redelivery of the same message must not charge it
+	if err := processOrderMessage(ctx, orderMessage(t, order), 1); err != nil {
+		t.Fatalf("redelivered cancelled order should be acknowledged, got %v", err)
+	}
+	if gateway.authorized != 1 {
+		t.Fatalf("expected only the first authorization, got %d", gateway.authorized)
+	}
+}
+
+func TestCancelAfterCaptureStarts(t *testing.T) {
+	ctx := withOrderStore(t)
+	orderStore.Put(ctx, &Order{OrderID: "o1", Status: orderPending})
+
+	if claimed, err := claimOrder(ctx, "o1"); !claimed || err != nil {
+		t.Fatalf("expected claim, got %v %v", claimed, err)
+	}
+	if err := beginCapture(ctx, "o1"); err != nil {
+		t.Fatalf("expected capture to start, got %v", err)
+	}
+
+	var lcErr *lifecycleError
+	if _, err := cancelOrder(ctx, "o1"); !errors.As(err, &lcErr) {
+		t.Fatalf("expected lifecycle error once capture started, got %v", err)
+	}
+
+	orderStore.Put(ctx, &Order{OrderID: "o2", Status: orderPending})
+	if order, err := cancelOrder(ctx, "o2"); err != nil || order.Status != orderCancelled {
+		t.Fatalf("expected pending order to cancel immediately, got %+v %v", order, err)
+	}
+	if claimed, _ := claimOrder(ctx, "o2"); claimed {
+		t.Fatal("worker must not claim a cancelled order")
+	}
+}
+
+func TestRefundOrder(t *testing.T) {
+	ctx := withOrderStore(t)
+	pp := newPaymentProcessor(1)
+	pp.Delay = 0
+	defer func(g PaymentGateway) { paymentGateway = g }(paymentGateway)
+	paymentGateway = pp
+
+	order := &Order{OrderID: "r1", Items: []Item{{ProductID: "a", Quantity: 2, Price: 10}, {ProductID: "b", Quantity: 1, Price: 30}}}
+	order.Pricing = (&pricingEngine{shipping: shippingRule{FlatRate: 5, FreeThreshold: 100}}).quote(order.Items, "")
+	if err := chargeOrder(ctx, pp, order); err != nil {
+		t.Fatalf("charge failed: %v", err)
+	}
+
+	order.Status = orderPending
+	orderStore.Put(ctx, order)
+	if _, _, err := refundOrder(ctx, "r1", nil); err == nil {
+		t.Fatal("expected refund of unpaid order to be rejected")
+	}
+
+	order.Status = orderCompleted
+	orderStore.Put(ctx, order)
+
+	updated, refund, err := refundOrder(ctx, "r1", []Item{{ProductID: "a", Quantity: 1}})
+	if err != nil || refund.Amount != 10 || updated.Status != orderPartiallyRefunded {
+		t.Fatalf("expected 10 refunded, got %+v %+v %v", updated, refund, err)
+	}
+	if _, _, err := refundOrder(ctx, "r1", []Item{{ProductID: "a", Quantity: 2}}); !errors.Is(err, errInvalidRefund) {
+		t.Fatalf("expected over-refund to be rejected, got %v", err)
+	}
+
+	// The rest, including shipping
+	updated, refund, err = refundOrder(ctx, "r1", nil)
+	if err != nil || refund.Amount != 45 || updated.Status != orderRefunded {
+		t.Fatalf("expected remaining 45 refunded, got %+v %+v %v", updated, refund, err)
+	}
+	if _, _, err := refundOrder(ctx, "r1", nil); err == nil {
+		t.Fatal("expected fully refunded order to reject further refunds")
+	}
+}
+
+func TestRefundOrder_AbandonsStalePendingRefunds(t *testing.T) {
+	ctx := withOrderStore(t)
+	pp := newPaymentProcessor(1)
+	pp.Delay = 0
+	defer func(g PaymentGateway) { paymentGateway = g }(paymentGateway)
+	paymentGateway = pp
+
+	order := &Order{OrderID: "r2", Items: []Item{{ProductID: "a", Quantity: 2, Price: 10}}}
+	if err := chargeOrder(ctx, pp, order); err != nil {
+		t.Fatalf("charge failed: %v", err)
+	}
+	// One refund died before its outcome was recorded, another is in flight
+	order.Status = orderCompleted
+	order.Refunds = []Refund{
+		{RefundID: "rfd-lost", Amount: 10, Status: "pending", CreatedAt: time.Now().Add(-time.Hour),
+			Lines: []Item{{ProductID: "a", Quantity: 1, Price: 10}}},
+		{RefundID: "rfd-live", Amount: 5, Status: "pending", CreatedAt: time.Now()},
+	}
+	orderStore.Put(ctx, order)
+
+	updated, refund, err := refundOrder(ctx, "r2", nil)
+	if err != nil || refund.Amount != 15 {
+		t.Fatalf("expected the 15 not held by the live refund, got %+v %v", refund, err)
+	}
+	if updated.Refunds[0].Status != "unknown" || updated.Refunds[1].Status != "pending" {
+		t.Fatalf("expected only the stale refund abandoned, got %+v", updated.Refunds)
+	}
+}
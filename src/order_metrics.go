@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBucketsMs are the histogram upper bounds; the last bucket is unbounded
+var latencyBucketsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// latencyHistogram counts durations into fixed buckets. Percentiles are
+// interpolated within the bucket they fall in.
+type latencyHistogram struct {
+	counts []int // len(latencyBucketsMs)+1, last is overflow
+	count  int
+	sumMs  float64
+	maxMs  float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int, len(latencyBucketsMs)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := sort.SearchFloat64s(latencyBucketsMs, ms)
+	h.counts[i]++
+	h.count++
+	h.sumMs += ms
+	if ms > h.maxMs {
+		h.maxMs = ms
+	}
+}
+
+// percentile estimates the q-th quantile (0 < q <= 1) in milliseconds
+func (h *latencyHistogram) percentile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	cumulative := 0
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		if float64(cumulative+n) >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBucketsMs[i-1]
+			}
+			upper := h.maxMs
+			if i < len(latencyBucketsMs) && latencyBucketsMs[i] < upper {
+				upper = latencyBucketsMs[i]
+			}
+			if upper < lower {
+				return upper
+			}
+			return lower + (upper-lower)*(rank-float64(cumulative))/float64(n)
+		}
+		cumulative += n
+	}
+	return h.maxMs
+}
+
+func (h *latencyHistogram) snapshot() map[string]interface{} {
+	buckets := make(map[string]int, len(h.counts))
+	for i, n := range h.counts {
+		label := "inf"
+		if i < len(latencyBucketsMs) {
+			label = strconv.FormatFloat(latencyBucketsMs[i], 'f', -1, 64)
+		}
+		buckets["le_"+label] = n
+	}
+	mean := 0.0
+	if h.count > 0 {
+		mean = h.sumMs / float64(h.count)
+	}
+	return map[string]interface{}{
+		"count":   h.count,
+		"mean_ms": round1(mean),
+		"p50_ms":  round1(h.percentile(0.50)),
+		"p95_ms":  round1(h.percentile(0.95)),
+		"p99_ms":  round1(h.percentile(0.99)),
+		"max_ms":  round1(h.maxMs),
+		"buckets": buckets,
+	}
+}
+
+func round1(x float64) float64 {
+	return float64(int64(x*10+0.5)) / 10
+}
+
+// slidingWindow counts outcomes per second over the last windowSeconds
+const windowSeconds = 15 * 60
+
+type windowBucket struct {
+	second    int64
+	completed int
+	failed    int
+}
+
+type slidingWindow struct {
+	buckets [windowSeconds]windowBucket
+}
+
+func (w *slidingWindow) add(now time.Time, failed bool) {
+	sec := now.Unix()
+	b := &w.buckets[sec%windowSeconds]
+	if b.second != sec {
+		*b = windowBucket{second: sec}
+	}
+	if failed {
+		b.failed++
+	} else {
+		b.completed++
+	}
+}
+
+// sum totals the last `seconds` seconds, including the current one
+func (w *slidingWindow) sum(now time.Time, seconds int) (completed, failed int) {
+	cutoff := now.Unix() - int64(seconds)
+	for _, b := range w.buckets {
+		if b.second > cutoff && b.second <= now.Unix() {
+			completed += b.completed
+			failed += b.failed
+		}
+	}
+	return completed, failed
+}
+
+type paymentTally struct {
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+}
+
+// orderMetrics is shared by the sync endpoint and the queue worker so both
+// paths report the same numbers
+type orderMetrics struct {
+	mu             sync.Mutex
+	queueWait      *latencyHistogram
+	paymentLatency *latencyHistogram
+	window         slidingWindow
+	bySource       map[string]*paymentTally
+	byWorker       map[int]*paymentTally
+}
+
+// Order sources
+const (
+	sourceSync   = "sync"
+	sourceWorker = "worker"
+)
+
+func newOrderMetrics() *orderMetrics {
+	return &orderMetrics{
+		queueWait:      newLatencyHistogram(),
+		paymentLatency: newLatencyHistogram(),
+		bySource:       make(map[string]*paymentTally),
+		byWorker:       make(map[int]*paymentTally),
+	}
+}
+
+var paymentMetrics = newOrderMetrics()
+
+// recordQueueWait is the time between an order being accepted and its payment starting
+func (m *orderMetrics) recordQueueWait(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	m.mu.Lock()
+	m.queueWait.observe(d)
+	m.mu.Unlock()
+}
+
+// recordPayment records one charge attempt. workerID is 0 for the sync path.
+func (m *orderMetrics) recordPayment(source string, workerID int, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paymentLatency.observe(d)
+	m.window.add(time.Now(), err != nil)
+
+	tallies := []*paymentTally{m.tally(m.bySource, source)}
+	if workerID > 0 {
+		if m.byWorker[workerID] == nil {
+			m.byWorker[workerID] = &paymentTally{}
+		}
+		tallies = append(tallies, m.byWorker[workerID])
+	}
+	for _, t := range tallies {
+		if err != nil {
+			t.Failed++
+		} else {
+			t.Processed++
+		}
+	}
+}
+
+func (m *orderMetrics) tally(tallies map[string]*paymentTally, key string) *paymentTally {
+	if tallies[key] == nil {
+		tallies[key] = &paymentTally{}
+	}
+	return tallies[key]
+}
+
+func (m *orderMetrics) snapshot(now time.Time) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	throughput := make(map[string]interface{})
+	for _, w := range []struct {
+		label   string
+		seconds int
+	}{{"1m", 60}, {"5m", 300}, {"15m", 900}} {
+		completed, failed := m.window.sum(now, w.seconds)
+		throughput[w.label] = map[string]interface{}{
+			"completed":  completed,
+			"failed":     failed,
+			"per_second": round1(float64(completed+failed) / float64(w.seconds)),
+		}
+	}
+
+	bySource := make(map[string]paymentTally, len(m.bySource))
+	for source, t := range m.bySource {
+		bySource[source] = *t
+	}
+	byWorker := make(map[string]paymentTally, len(m.byWorker))
+	for id, t := range m.byWorker {
+		byWorker[fmt.Sprintf("worker-%d", id)] = *t
+	}
+
+	return map[string]interface{}{
+		"queue_wait": m.queueWait.snapshot(),
+		"payment":    m.paymentLatency.snapshot(),
+		"throughput": throughput,
+		"by_source":  bySource,
+		"by_worker":  byWorker,
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram_Percentiles(t *testing.T) {
+	h := newLatencyHistogram()
+	for i := 0; i < 90; i++ {
+		h.observe(20 * time.Millisecond) // 10-25ms bucket
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(3 * time.Second) // 2500-5000ms bucket
+	}
+
+	if p50 := h.percentile(0.50); p50 <= 10 || p50 > 25 {
+		t.Fatalf("p50 should fall in the 10-25ms bucket, got %v", p50)
+	}
+	if p95 := h.percentile(0.95); p95 <= 2500 || p95 > 3000 {
+		t.Fatalf("p95 should fall between 2500ms and the max, got %v", p95)
+	}
+	if p99 := h.percentile(0.99); p99 > h.maxMs {
+		t.Fatalf("p99 %v exceeds max %v", p99, h.maxMs)
+	}
+	if newLatencyHistogram().percentile(0.5) != 0 {
+		t.Fatal("empty histogram should report 0")
+	}
+}
+
+func TestOrderMetrics_SharedAcrossSources(t *testing.T) {
+	m := newOrderMetrics()
+	m.recordPayment(sourceSync, 0, 100*time.Millisecond, nil)
+	m.recordPayment(sourceWorker, 2, 200*time.Millisecond, nil)
+	m.recordPayment(sourceWorker, 2, 300*time.Millisecond, errors.New("declined"))
+
+	snap := m.snapshot(time.Now())
+	bySource := snap["by_source"].(map[string]paymentTally)
+	if bySource[sourceSync].Processed != 1 || bySource[sourceWorker].Processed != 1 || bySource[sourceWorker].Failed != 1 {
+		t.Fatalf("unexpected per-source tallies: %+v", bySource)
+	}
+	if w := snap["by_worker"].(map[string]paymentTally)["worker-2"]; w.Processed != 1 || w.Failed != 1 {
+		t.Fatalf("unexpected worker tally: %+v", w)
+	}
+	oneMinute := snap["throughput"].(map[string]interface{})["1m"].(map[string]interface{})
+	if oneMinute["completed"] != 2 || oneMinute["failed"] != 1 {
+		t.Fatalf("unexpected 1m throughput: %v", oneMinute)
+	}
+	if snap["payment"].(map[string]interface{})["count"] != 3 {
+		t.Fatalf("expected 3 payment latency samples, got %v", snap["payment"])
+	}
+}
+
+func TestSlidingWindow_Expires(t *testing.T) {
+	var w slidingWindow
+	start := time.Unix(1_000_000, 0)
+	w.add(start, false)
+	w.add(start.Add(2*time.Minute), true)
+
+	later := start.Add(2 * time.Minute)
+	if c, f := w.sum(later, 60); c != 0 || f != 1 {
+		t.Fatalf("1m window: expected 0/1, got %d/%d", c, f)
+	}
+	if c, f := w.sum(later, 300); c != 1 || f != 1 {
+		t.Fatalf("5m window: expected 1/1, got %d/%d", c, f)
+	}
+	// A bucket is reused once the window wraps around
+	w.add(start.Add(windowSeconds*time.Second), false)
+	if c, _ := w.sum(start.Add(windowSeconds*time.Second), windowSeconds); c != 1 {
+		t.Fatalf("expected wrapped bucket to be reset, got %d", c)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"text/main/orders"
+)
+
+// The worker fulfills an order as a saga: reserve stock, authorize payment,
+// capture, then mark the cart checked out. Each step's state is saved on the
+// order before and after it runs, so a message redelivered after a crash or
+// a transient failure resumes at the first unfinished step. When a step
+// fails for good (declined payment, no stock, cancellation, retries used
+// up) the completed steps are compensated in reverse order.
+//
+// A crash between a gateway call and saving its result means the step runs
+// again on redelivery; stock reservations are idempotent per order, payment
+// calls are not.
+
+// sagaStep is one step of the fulfillment saga; compensate is nil when
+// there is nothing to undo
+type sagaStep struct {
+	name       string
+	run        func(ctx context.Context, order *Order) error
+	compensate func(ctx context.Context, order *Order) error
+}
+
+var fulfillmentSaga = []sagaStep{
+	{orders.StepReserveStock, reserveStock, releaseStock},
+	{orders.StepAuthorize, authorizePayment, voidAuthorization},
+	{orders.StepCapture, capturePayment, refundCapture},
+	{orders.StepCheckoutCart, checkoutOrderCart, nil},
+}
+
+// sagaCancelled is the compensation reason for cancelled orders
+const sagaCancelled = "cancelled"
+
+func newFulfillmentSaga() *orders.Saga {
+	names := make([]string, len(fulfillmentSaga))
+	for i, step := range fulfillmentSaga {
+		names[i] = step.name
+	}
+	return orders.NewSaga(names...)
+}
+
+func reserveStock(ctx context.Context, order *Order) error {
+	if err := productStock.Reserve(ctx, order.OrderID, order.Items); err != nil {
+		if errors.Is(err, errOutOfStock) {
+			return permanentError("out_of_stock", err)
+		}
+		return transientError("stock_store_failed", err)
+	}
+	return nil
+}
+
+func releaseStock(ctx context.Context, order *Order) error {
+	return productStock.Release(ctx, order.OrderID)
+}
+
+func authorizePayment(ctx context.Context, order *Order) error {
+	authID, err := paymentGateway.Authorize(ctx, order)
+	if err != nil {
+		return paymentError(err)
+	}
+	order.AuthorizationID = authID
+	return nil
+}
+
+// voidAuthorization releases the held funds. A gateway that rejects the
+// void (already voided or expired) has nothing left to release. A captured
+// authorization can't be voided; refundCapture returns its funds instead.
+func voidAuthorization(ctx context.Context, order *Order) error {
+	if order.AuthorizationID == "" || order.CaptureID != "" {
+		return nil
+	}
+	err := paymentGateway.Void(ctx, order.AuthorizationID)
+	var gwErr *gatewayError
+	if errors.As(err, &gwErr) && gwErr.declined() {
+		fmt.Printf("Warning: gateway refused to void authorization %s: %v\n", order.AuthorizationID, err)
+		return nil
+	}
+	return err
+}
+
+// capturePayment is where a cancellation loses: beginCapture returns
+// errOrderCancelled if one was requested first. The order stays capturing
+// until the result is saved, so a crash in between leaves it for review.
+func capturePayment(ctx context.Context, order *Order) error {
+	if err := beginCapture(ctx, order.OrderID); err != nil {
+		if errors.Is(err, errOrderCancelled) {
+			return err
+		}
+		return transientError("order_store_failed", err)
+	}
+	captureID, err := paymentGateway.Capture(ctx, order.AuthorizationID)
+	if err != nil {
+		// The gateway answered, so nothing was captured and a retry is safe
+		if abortErr := abortCapture(ctx, order.OrderID); abortErr != nil {
+			return transientError("order_store_failed", abortErr)
+		}
+		return paymentError(err)
+	}
+	order.CaptureID = captureID
+	return nil
+}
+
+// refundCapture returns the captured amount when a later step fails for
+// good. A gateway that rejects the refund (already refunded) has nothing
+// left to return.
+func refundCapture(ctx context.Context, order *Order) error {
+	if order.CaptureID == "" {
+		return nil
+	}
+	refundID, err := paymentGateway.Refund(ctx, order.CaptureID, order.Total())
+	var gwErr *gatewayError
+	if errors.As(err, &gwErr) && gwErr.declined() {
+		fmt.Printf("Warning: gateway refused to refund capture %s: %v\n", order.CaptureID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Refunded capture %s of order %s (refund: %s)\n", order.CaptureID, order.OrderID, refundID)
+	return nil
+}
+
+// checkoutOrderCart marks the order's MySQL cart checked out. Checkout
+// normally did this already, so it only changes carts left active. DynamoDB
+// carts are marked by their own checkout handler and match no row here.
+func checkoutOrderCart(ctx context.Context, order *Order) error {
+	if order.CartID == "" || db == nil {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE carts
+		SET status = 'checked_out', updated_at = NOW()
+		WHERE cart_id = ? AND status = 'active'`,
+		order.CartID); err != nil {
+		return transientError("cart_update_failed", err)
+	}
+	return nil
+}
+
+// paymentError classifies a gateway failure: declines are permanent
+func paymentError(err error) error {
+	var gwErr *gatewayError
+	if errors.As(err, &gwErr) && gwErr.declined() {
+		return permanentError("payment_declined", err)
+	}
+	return transientError("payment_failed", err)
+}
+
+// loadSaga picks up the saga state saved by an earlier attempt
+func loadSaga(ctx context.Context, order *Order) error {
+	stored, err := orderStore.Get(ctx, order.OrderID)
+	if errors.Is(err, errOrderNotFound) {
+		// Not tracked by this process, so the saga can't be resumed after a crash
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stored.Saga != nil {
+		order.Saga = stored.Saga
+		order.AuthorizationID = stored.AuthorizationID
+		order.CaptureID = stored.CaptureID
+	}
+	return nil
+}
+
+// saveSaga persists saga progress and the payment IDs, leaving the status
+// alone so a concurrent cancellation isn't overwritten
+func saveSaga(ctx context.Context, order *Order) error {
+	_, err := orderStore.Update(ctx, order.OrderID, func(o *Order) error {
+		o.Saga = order.Saga
+		o.AuthorizationID = order.AuthorizationID
+		o.CaptureID = order.CaptureID
+		return nil
+	})
+	if errors.Is(err, errOrderNotFound) {
+		return nil
+	}
+	return err
+}
+
+// runFulfillment runs the saga's remaining steps. It returns nil once the
+// saga completed or compensated a cancellation, the failing step's error
+// once it compensated anything else, and a transient error when a step or
+// compensation should be retried on redelivery. order.Saga tells which.
+func runFulfillment(ctx context.Context, order *Order, receiveCount int, workerID int) error {
+	if order.Saga == nil {
+		order.Saga = newFulfillmentSaga()
+	}
+	if order.Saga.Status == orders.SagaCompensating {
+		fmt.Printf("[Worker %d] Resuming compensation of order %s (%s)\n", workerID, order.OrderID, order.Saga.Reason)
+		return compensateFulfillment(ctx, order, workerID, nil)
+	}
+
+	var paymentStart time.Time
+	for _, step := range fulfillmentSaga {
+		state := order.Saga.Step(step.name)
+		if state == nil {
+			// Saved by a version without this step
+			order.Saga.Steps = append(order.Saga.Steps, orders.SagaStep{Name: step.name, Status: orders.SagaPending})
+			state = &order.Saga.Steps[len(order.Saga.Steps)-1]
+		}
+		if state.Status == orders.SagaDone {
+			continue
+		}
+
+		state.Status = orders.SagaRunning
+		state.Attempts++
+		state.UpdatedAt = time.Now()
+		if err := saveSaga(ctx, order); err != nil {
+			return transientError("order_store_failed", err)
+		}
+
+		if paymentStart.IsZero() && (step.name == orders.StepAuthorize || step.name == orders.StepCapture) {
+			paymentStart = time.Now()
+		}
+		err := step.run(ctx, order)
+		state.UpdatedAt = time.Now()
+		cancelled := errors.Is(err, errOrderCancelled)
+		if (step.name == orders.StepAuthorize && err != nil) || (step.name == orders.StepCapture && !cancelled) {
+			paymentMetrics.recordPayment(sourceWorker, workerID, time.Since(paymentStart), err)
+		}
+
+		if err == nil {
+			state.Status = orders.SagaDone
+			state.Error = ""
+			if err := saveSaga(ctx, order); err != nil {
+				return transientError("order_store_failed", err)
+			}
+			continue
+		}
+
+		state.Status = orders.SagaPending
+		state.Error = err.Error()
+		fmt.Printf("[Worker %d] Step %s failed for order %s: %v\n", workerID, step.name, order.OrderID, err)
+		if cancelled || isPermanent(err) || orderRetryPolicy.exhausted(receiveCount) {
+			order.Saga.Reason = failureReason(err)
+			if cancelled {
+				order.Saga.Reason = sagaCancelled
+			}
+			return compensateFulfillment(ctx, order, workerID, err)
+		}
+		if saveErr := saveSaga(ctx, order); saveErr != nil {
+			fmt.Printf("[Worker %d] Warning: failed to save saga state for order %s: %v\n", workerID, order.OrderID, saveErr)
+		}
+		return err
+	}
+
+	order.Saga.Status = orders.SagaCompleted
+	if err := saveSaga(ctx, order); err != nil {
+		fmt.Printf("[Worker %d] Warning: failed to save saga state for order %s: %v\n", workerID, order.OrderID, err)
+	}
+	return nil
+}
+
+// compensateFulfillment undoes completed steps in reverse order. Steps left
+// running by a crash may have taken effect, so they are undone too; every
+// compensation is safe to repeat. cause is the step failure that started it.
+func compensateFulfillment(ctx context.Context, order *Order, workerID int, cause error) error {
+	order.Saga.Status = orders.SagaCompensating
+	if err := saveSaga(ctx, order); err != nil {
+		return transientError("order_store_failed", err)
+	}
+
+	for i := len(fulfillmentSaga) - 1; i >= 0; i-- {
+		step := fulfillmentSaga[i]
+		state := order.Saga.Step(step.name)
+		if step.compensate == nil || state == nil || (state.Status != orders.SagaDone && state.Status != orders.SagaRunning) {
+			continue
+		}
+		if err := step.compensate(ctx, order); err != nil {
+			state.Error = "compensation failed: " + err.Error()
+			state.UpdatedAt = time.Now()
+			if saveErr := saveSaga(ctx, order); saveErr != nil {
+				fmt.Printf("[Worker %d] Warning: failed to save saga state for order %s: %v\n", workerID, order.OrderID, saveErr)
+			}
+			return transientError("compensation_failed", err)
+		}
+		state.Status = orders.SagaCompensated
+		state.UpdatedAt = time.Now()
+		if err := saveSaga(ctx, order); err != nil {
+			return transientError("order_store_failed", err)
+		}
+		fmt.Printf("[Worker %d] Compensated %s for order %s\n", workerID, step.name, order.OrderID)
+	}
+
+	// The order won't be placed, so its coupons can be used again
+	if err := releaseCoupons(ctx, order.OrderID); err != nil {
+		return transientError("compensation_failed", err)
+	}
+
+	order.Saga.Status = orders.SagaCompensated
+	if err := saveSaga(ctx, order); err != nil {
+		return transientError("order_store_failed", err)
+	}
+	if order.Saga.Reason == sagaCancelled {
+		return nil
+	}
+	if cause == nil {
+		// Resumed after a crash; the original error wasn't saved
+		cause = permanentError(order.Saga.Reason, errors.New("order fulfillment compensated"))
+	}
+	return cause
+}
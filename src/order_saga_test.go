@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"text/main/orders"
+)
+
+// sagaGateway counts calls and fails them on demand
+type sagaGateway struct {
+	*PaymentProcessor
+	authorized   int
+	captured     int
+	voided       int
+	refunded     int
+	captureErrs  []error // returned by successive Capture calls
+	authorizeErr error
+}
+
+func (g *sagaGateway) Authorize(ctx context.Context, order *Order) (string, error) {
+	if g.authorizeErr != nil {
+		return "", g.authorizeErr
+	}
+	g.authorized++
+	return g.PaymentProcessor.Authorize(ctx, order)
+}
+
+func (g *sagaGateway) Capture(ctx context.Context, authorizationID string) (string, error) {
+	if len(g.captureErrs) > 0 {
+		err := g.captureErrs[0]
+		g.captureErrs = g.captureErrs[1:]
+		return "", err
+	}
+	g.captured++
+	return g.PaymentProcessor.Capture(ctx, authorizationID)
+}
+
+func (g *sagaGateway) Void(ctx context.Context, authorizationID string) error {
+	g.voided++
+	return g.PaymentProcessor.Void(ctx, authorizationID)
+}
+
+func (g *sagaGateway) Refund(ctx context.Context, captureID string, amount float64) (string, error) {
+	g.refunded++
+	return g.PaymentProcessor.Refund(ctx, captureID, amount)
+}
+
+func withSagaGateway(t *testing.T, stock int) *sagaGateway {
+	pp := newPaymentProcessor(1)
+	pp.Delay = 0
+	gateway := &sagaGateway{PaymentProcessor: pp}
+	previousGateway, previousStock := paymentGateway, productStock
+	paymentGateway, productStock = gateway, newMemoryStockStore(stock)
+	t.Cleanup(func() { paymentGateway, productStock = previousGateway, previousStock })
+	return gateway
+}
+
+func sagaOrder(ctx context.Context, id string, quantity int) *Order {
+	order := &Order{OrderID: id, Status: orderPending, Items: []Item{{ProductID: "7", Quantity: quantity, Price: 10}}}
+	orderStore.Put(ctx, order)
+	return order
+}
+
+func stepStatuses(saga *orders.Saga) map[string]string {
+	statuses := make(map[string]string)
+	for _, step := range saga.Steps {
+		statuses[step.Name] = step.Status
+	}
+	return statuses
+}
+
+func TestSaga_Completes(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	order := sagaOrder(ctx, "saga-ok", 3)
+
+	if err := processOrderMessage(ctx, orderMessage(t, order), 1); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	if stored.Status != orderCompleted || stored.Saga.Status != orders.SagaCompleted || stored.CaptureID == "" {
+		t.Fatalf("unexpected order: %+v", stored)
+	}
+	for name, status := range stepStatuses(stored.Saga) {
+		if status != orders.SagaDone {
+			t.Errorf("step %s is %s", name, status)
+		}
+	}
+	if left, _ := productStock.Available(ctx, "7"); left != 7 || gateway.authorized != 1 {
+		t.Errorf("stock left %d, authorizations %d", left, gateway.authorized)
+	}
+}
+
+func TestSaga_DeclinedCaptureCompensates(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	gateway.captureErrs = []error{&gatewayError{Path: "/capture", StatusCode: http.StatusPaymentRequired, Message: "declined"}}
+	order := sagaOrder(ctx, "saga-declined", 4)
+
+	err := processOrderMessage(ctx, orderMessage(t, order), 1)
+	if !isPermanent(err) || failureReason(err) != "payment_declined" {
+		t.Fatalf("expected permanent payment_declined, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	statuses := stepStatuses(stored.Saga)
+	if stored.Status != orderFailed || stored.Saga.Status != orders.SagaCompensated ||
+		statuses[orders.StepReserveStock] != orders.SagaCompensated || statuses[orders.StepAuthorize] != orders.SagaCompensated {
+		t.Fatalf("unexpected order: %s %+v", stored.Status, stored.Saga)
+	}
+	if left, _ := productStock.Available(ctx, "7"); left != 10 || gateway.voided != 1 {
+		t.Errorf("stock left %d, voids %d", left, gateway.voided)
+	}
+}
+
+func TestSaga_OutOfStockSkipsPayment(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 2)
+	order := sagaOrder(ctx, "saga-stock", 3)
+
+	if err := processOrderMessage(ctx, orderMessage(t, order), 1); failureReason(err) != "out_of_stock" {
+		t.Fatalf("expected out_of_stock, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	if stored.Status != orderFailed || gateway.authorized != 0 {
+		t.Fatalf("expected failed order without payment, got %s (authorized %d)", stored.Status, gateway.authorized)
+	}
+}
+
+func TestSaga_ResumesAfterTransientFailure(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	gateway.captureErrs = []error{errors.New("connection reset")}
+	order := sagaOrder(ctx, "saga-resume", 1)
+
+	err := processOrderMessage(ctx, orderMessage(t, order), 1)
+	if err == nil || isPermanent(err) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	if statuses := stepStatuses(stored.Saga); statuses[orders.StepAuthorize] != orders.SagaDone || statuses[orders.StepCapture] != orders.SagaPending {
+		t.Fatalf("unexpected saga after failed capture: %+v", stored.Saga)
+	}
+
+	// The redelivered message picks up at capture with the saved authorization
+	message := orderMessage(t, order)
+	message.ReceiveCount = 2
+	if err := processOrderMessage(ctx, message, 1); err != nil {
+		t.Fatalf("expected resumed saga to complete, got %v", err)
+	}
+	stored, _ = orderStore.Get(ctx, order.OrderID)
+	if stored.Status != orderCompleted || gateway.authorized != 1 || stored.Saga.Step(orders.StepCapture).Attempts != 2 {
+		t.Fatalf("expected completion with one authorization, got %s (authorized %d) %+v", stored.Status, gateway.authorized, stored.Saga)
+	}
+	if left, _ := productStock.Available(ctx, "7"); left != 9 {
+		t.Errorf("stock reserved twice: %d left", left)
+	}
+}
+
+func TestSaga_ResumesInterruptedCompensation(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	order := sagaOrder(ctx, "saga-crash", 2)
+
+	// A worker reserved stock and authorized, then crashed while compensating a cancellation
+	productStock.Reserve(ctx, order.OrderID, order.Items)
+	authID, _ := gateway.PaymentProcessor.Authorize(ctx, order)
+	saga := newFulfillmentSaga()
+	saga.Status, saga.Reason = orders.SagaCompensating, sagaCancelled
+	saga.Step(orders.StepReserveStock).Status = orders.SagaDone
+	saga.Step(orders.StepAuthorize).Status = orders.SagaDone
+	orderStore.Update(ctx, order.OrderID, func(o *Order) error {
+		o.Status, o.Saga, o.AuthorizationID = orderCancelled, saga, authID
+		return nil
+	})
+
+	if err := processOrderMessage(ctx, orderMessage(t, order), 1); err != nil {
+		t.Fatalf("expected compensation to finish, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	if stored.Status != orderCancelled || stored.Saga.Status != orders.SagaCompensated || gateway.voided != 1 {
+		t.Fatalf("unexpected order: %s %+v (voided %d)", stored.Status, stored.Saga, gateway.voided)
+	}
+	if left, _ := productStock.Available(ctx, "7"); left != 10 {
+		t.Errorf("stock not released: %d left", left)
+	}
+}
+
+func TestSaga_CrashMidCaptureNeedsReview(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	order := sagaOrder(ctx, "saga-capture-crash", 1)
+
+	// A worker asked the gateway to capture, then died before saving the result
+	productStock.Reserve(ctx, order.OrderID, order.Items)
+	authID, _ := gateway.PaymentProcessor.Authorize(ctx, order)
+	gateway.PaymentProcessor.Capture(ctx, authID)
+	saga := newFulfillmentSaga()
+	saga.Step(orders.StepReserveStock).Status = orders.SagaDone
+	saga.Step(orders.StepAuthorize).Status = orders.SagaDone
+	saga.Step(orders.StepCapture).Status = orders.SagaRunning
+	orderStore.Update(ctx, order.OrderID, func(o *Order) error {
+		o.Status, o.Saga, o.AuthorizationID = orderCapturing, saga, authID
+		return nil
+	})
+
+	message := orderMessage(t, order)
+	message.ReceiveCount = 2
+	if err := processOrderMessage(ctx, message, 1); err != nil {
+		t.Fatalf("expected redelivery to be acknowledged, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	if stored.Status != orderNeedsReview || gateway.captured != 0 || gateway.voided != 0 {
+		t.Fatalf("expected order left for review without touching payment, got %s (captured %d, voided %d)",
+			stored.Status, gateway.captured, gateway.voided)
+	}
+}
+
+func TestSaga_CheckoutFailsPermanentlyAfterCapture(t *testing.T) {
+	ctx := withOrderStore(t)
+	gateway := withSagaGateway(t, 10)
+	fake := withFakeSQL(t)
+	fake.onExec("UPDATE carts", 0, errors.New("connection lost"))
+	order := sagaOrder(ctx, "saga-refund", 2)
+	order.CartID = "cart-refund"
+
+	// Last delivery, so the failed checkout step gives up and compensates
+	message := orderMessage(t, order)
+	message.ReceiveCount = orderRetryPolicy.maxReceives
+	if err := processOrderMessage(ctx, message, 1); failureReason(err) != "cart_update_failed" {
+		t.Fatalf("expected cart_update_failed, got %v", err)
+	}
+	stored, _ := orderStore.Get(ctx, order.OrderID)
+	statuses := stepStatuses(stored.Saga)
+	if stored.Status != orderFailed || statuses[orders.StepCapture] != orders.SagaCompensated ||
+		statuses[orders.StepAuthorize] != orders.SagaCompensated {
+		t.Fatalf("unexpected order: %s %+v", stored.Status, stored.Saga)
+	}
+	// The capture is refunded; voiding the captured authorization is skipped
+	if gateway.captured != 1 || gateway.refunded != 1 || gateway.voided != 0 {
+		t.Errorf("captured %d, refunded %d, voided %d", gateway.captured, gateway.refunded, gateway.voided)
+	}
+	if left, _ := productStock.Available(ctx, "7"); left != 10 {
+		t.Errorf("stock not released: %d left", left)
+	}
+}
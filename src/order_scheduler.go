@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Orders of one customer share a message group: FIFO topics and queues
+// deliver a group in submission order, and the worker's scheduler runs at
+// most one order per group at a time. Premium customers' orders go in the
+// premium lane, which the scheduler serves ahead of the standard lane
+// during bursts (ORDER_PREMIUM_WEIGHT premium orders per standard one).
+
+const (
+	laneStandard = "standard"
+	lanePremium  = "premium"
+)
+
+// Message attributes carrying FIFO parameters. FIFO publishers (".fifo"
+// topic ARNs and queue URLs) send them as MessageGroupId and
+// MessageDeduplicationId.
+const (
+	attrMessageGroupID  = "message_group_id"
+	attrDeduplicationID = "deduplication_id"
+	attrLane            = "lane"
+)
+
+// premiumCustomers are customer keys (numeric ID or cart customer ID) from PREMIUM_CUSTOMERS
+var premiumCustomers = parseCustomerSet(os.Getenv("PREMIUM_CUSTOMERS"))
+
+func parseCustomerSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			set[key] = true
+		}
+	}
+	return set
+}
+
+// orderLane is decided by the server, never taken from the client
+func orderLane(order *Order) string {
+	if premiumCustomers[customerKey(order)] {
+		return lanePremium
+	}
+	return laneStandard
+}
+
+// orderGroupID is the message group for the order's customer. Orders
+// without a customer have nothing to be ordered against, so each is its own group.
+func orderGroupID(order *Order) string {
+	if order.CustomerRef == "" && order.CustomerID == 0 {
+		return "order-" + order.OrderID
+	}
+	return "customer-" + customerKey(order)
+}
+
+// orderMessageAttributes are published with every order message
+func orderMessageAttributes(order *Order) map[string]string {
+	return map[string]string{
+		attrMessageGroupID:  orderGroupID(order),
+		attrDeduplicationID: order.OrderID,
+		attrLane:            order.Lane,
+	}
+}
+
+// scheduledMessage is a received message waiting for a worker
+type scheduledMessage struct {
+	message QueuedMessage
+	group   string
+}
+
+// groupHold keeps a group busy while its message waits out a retry delay
+type groupHold struct {
+	messageID string
+	until     time.Time
+}
+
+// orderScheduler holds received messages until a worker is free. It hands
+// out the oldest message whose group has nothing in flight, choosing
+// between lanes by weight. A message that will be retried keeps its group
+// blocked until it is redelivered, so later orders of the customer can't
+// overtake it; the hold lapses after the retry delay plus a visibility
+// timeout, in case the redelivery went to another worker or never comes.
+type orderScheduler struct {
+	mu            sync.Mutex
+	capacity      int
+	premiumWeight int
+	premiumRun    int // premium messages dispatched since the last standard one
+	lanes         map[string][]*scheduledMessage
+	inFlight      map[string]string // message ID -> group
+	busyGroups    map[string]bool
+	held          map[string]groupHold // group -> message being retried
+	wake          chan struct{}
+}
+
+func newOrderScheduler(capacity, premiumWeight int) *orderScheduler {
+	return &orderScheduler{
+		capacity:      capacity,
+		premiumWeight: premiumWeight,
+		lanes:         make(map[string][]*scheduledMessage),
+		inFlight:      make(map[string]string),
+		busyGroups:    make(map[string]bool),
+		held:          make(map[string]groupHold),
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// classify reads the group and lane from the order in the message.
+// Messages that can't be parsed get a group of their own and fail in the worker.
+func classify(message QueuedMessage) (group, lane string) {
+	var envelope snsEnvelope
+	var order Order
+	if json.Unmarshal([]byte(message.Body), &envelope) != nil || json.Unmarshal([]byte(envelope.Message), &order) != nil || order.OrderID == "" {
+		return "message-" + message.ID, laneStandard
+	}
+	lane = order.Lane
+	if lane != lanePremium {
+		lane = laneStandard
+	}
+	return orderGroupID(&order), lane
+}
+
+func (s *orderScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push queues a received message behind earlier messages of its group. A
+// redelivery of a message that is still waiting only refreshes its receipt
+// handle, which replaced the old one, instead of queueing it twice.
+func (s *orderScheduler) push(message QueuedMessage) {
+	group, lane := classify(message)
+	s.mu.Lock()
+	if m := s.find(message.ID); m != nil {
+		m.message = message
+		s.mu.Unlock()
+		return
+	}
+	s.lanes[lane] = append(s.lanes[lane], &scheduledMessage{message: message, group: group})
+	s.mu.Unlock()
+	s.signal()
+}
+
+// find returns the waiting message with id, or nil; the caller holds mu
+func (s *orderScheduler) find(id string) *scheduledMessage {
+	for _, lane := range []string{lanePremium, laneStandard} {
+		for _, m := range s.lanes[lane] {
+			if m.message.ID == id {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// remove drops a waiting message and reports whether it was still waiting
+func (s *orderScheduler) remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, lane := range []string{lanePremium, laneStandard} {
+		for i, m := range s.lanes[lane] {
+			if m.message.ID == id {
+				s.lanes[lane] = append(s.lanes[lane][:i], s.lanes[lane][i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// waitingMessages returns the messages not yet handed to a worker
+func (s *orderScheduler) waitingMessages() []QueuedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []QueuedMessage
+	for _, lane := range []string{lanePremium, laneStandard} {
+		for _, m := range s.lanes[lane] {
+			messages = append(messages, m.message)
+		}
+	}
+	return messages
+}
+
+// ready returns the index of the lane's oldest message whose group is idle
+func (s *orderScheduler) ready(lane string) int {
+	for i, m := range s.lanes[lane] {
+		if !s.busy(m) {
+			return i
+		}
+	}
+	return -1
+}
+
+// busy reports whether m must wait because another message of its group is
+// in flight or held for a retry; the caller holds mu
+func (s *orderScheduler) busy(m *scheduledMessage) bool {
+	if hold, ok := s.held[m.group]; ok {
+		if hold.messageID == m.message.ID {
+			return false
+		}
+		if time.Now().Before(hold.until) {
+			return true
+		}
+		delete(s.held, m.group)
+		delete(s.busyGroups, m.group)
+	}
+	return s.busyGroups[m.group]
+}
+
+// take picks the next message to run, or returns false if none is ready
+func (s *orderScheduler) take() (QueuedMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	premium, standard := s.ready(lanePremium), s.ready(laneStandard)
+	lane, i := lanePremium, premium
+	switch {
+	case premium < 0 && standard < 0:
+		return QueuedMessage{}, false
+	case premium < 0 || (standard >= 0 && s.premiumRun >= s.premiumWeight):
+		lane, i = laneStandard, standard
+	}
+	if lane == lanePremium {
+		s.premiumRun++
+	} else {
+		s.premiumRun = 0
+	}
+
+	m := s.lanes[lane][i]
+	s.lanes[lane] = append(s.lanes[lane][:i], s.lanes[lane][i+1:]...)
+	delete(s.held, m.group)
+	s.busyGroups[m.group] = true
+	s.inFlight[m.message.ID] = m.group
+	return m.message, true
+}
+
+// next blocks until a message is ready or ctx is cancelled
+func (s *orderScheduler) next(ctx context.Context) (QueuedMessage, bool) {
+	for {
+		if message, ok := s.take(); ok {
+			return message, true
+		}
+		select {
+		case <-s.wake:
+		case <-ctx.Done():
+			return QueuedMessage{}, false
+		}
+	}
+}
+
+// done frees the message's group for its next message, or, when the
+// message will be retried in retryIn, holds the group for its redelivery
+func (s *orderScheduler) done(message QueuedMessage, retryIn time.Duration) {
+	s.mu.Lock()
+	if group, ok := s.inFlight[message.ID]; ok {
+		delete(s.inFlight, message.ID)
+		if retryIn > 0 {
+			hold := retryIn + orderVisibilityTimeout
+			s.held[group] = groupHold{messageID: message.ID, until: time.Now().Add(hold)}
+			time.AfterFunc(hold, s.signal)
+		} else {
+			delete(s.busyGroups, group)
+		}
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// dispatch feeds ready messages to idle workers until ctx is cancelled
+func (s *orderScheduler) dispatch(ctx context.Context, out chan<- QueuedMessage) {
+	for {
+		message, ok := s.next(ctx)
+		if !ok {
+			return
+		}
+		select {
+		case out <- message:
+		case <-ctx.Done():
+			releaseMessage(message)
+			s.done(message, 0)
+			return
+		}
+	}
+}
+
+// waiting is the number of messages not yet handed to a worker
+func (s *orderScheduler) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lanes[lanePremium]) + len(s.lanes[laneStandard])
+}
+
+func (s *orderScheduler) full() bool {
+	return s.waiting() >= s.capacity
+}
+
+// drain removes and returns every waiting message
+func (s *orderScheduler) drain() []QueuedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []QueuedMessage
+	for _, lane := range []string{lanePremium, laneStandard} {
+		for _, m := range s.lanes[lane] {
+			messages = append(messages, m.message)
+		}
+		s.lanes[lane] = nil
+	}
+	return messages
+}
+
+// snapshot reports waiting messages per lane and busy groups
+func (s *orderScheduler) snapshot() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]int{
+		"premium_waiting":  len(s.lanes[lanePremium]),
+		"standard_waiting": len(s.lanes[laneStandard]),
+		"busy_groups":      len(s.busyGroups),
+	}
+}
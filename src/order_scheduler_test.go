@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// scheduledOrder is a delivery of an order from customer in lane
+func scheduledOrder(t *testing.T, id string, customer int, lane string) QueuedMessage {
+	return orderMessage(t, &Order{OrderID: id, CustomerID: customer, Lane: lane})
+}
+
+func takeIDs(s *orderScheduler) []string {
+	var ids []string
+	for {
+		message, ok := s.take()
+		if !ok {
+			return ids
+		}
+		ids = append(ids, message.ID)
+	}
+}
+
+func TestOrderScheduler_OneInFlightPerCustomer(t *testing.T) {
+	s := newOrderScheduler(100, 3)
+	first := scheduledOrder(t, "a1", 1, laneStandard)
+	s.push(first)
+	s.push(scheduledOrder(t, "a2", 1, laneStandard))
+	s.push(scheduledOrder(t, "b1", 2, laneStandard))
+	s.push(scheduledOrder(t, "anon1", 0, laneStandard))
+	s.push(scheduledOrder(t, "anon2", 0, laneStandard))
+
+	// a2 waits behind a1; anonymous orders don't wait for each other
+	if got := takeIDs(s); len(got) != 4 || got[0] != "m-a1" || got[1] != "m-b1" {
+		t.Fatalf("unexpected dispatch order: %v", got)
+	}
+	s.done(first, 0)
+	if got := takeIDs(s); len(got) != 1 || got[0] != "m-a2" {
+		t.Fatalf("expected a2 once a1 finished, got %v", got)
+	}
+}
+
+func TestOrderScheduler_RetryKeepsCustomerOrder(t *testing.T) {
+	s := newOrderScheduler(100, 3)
+	first := scheduledOrder(t, "a1", 1, laneStandard)
+	s.push(first)
+	s.push(scheduledOrder(t, "a2", 1, laneStandard))
+	takeIDs(s)
+
+	// a1 failed transiently: a2 must not overtake it while it waits to be redelivered
+	s.done(first, time.Second)
+	if got := takeIDs(s); len(got) != 0 {
+		t.Fatalf("expected the group held for a1's retry, got %v", got)
+	}
+	s.push(first)
+	if got := takeIDs(s); len(got) != 1 || got[0] != "m-a1" {
+		t.Fatalf("expected a1's redelivery first, got %v", got)
+	}
+	s.done(first, 0)
+	if got := takeIDs(s); len(got) != 1 || got[0] != "m-a2" {
+		t.Fatalf("expected a2 once a1 finished, got %v", got)
+	}
+
+	// A redelivery that never comes back only holds the group until the hold lapses
+	second := scheduledOrder(t, "b1", 2, laneStandard)
+	s.push(second)
+	s.push(scheduledOrder(t, "b2", 2, laneStandard))
+	takeIDs(s)
+	s.done(second, time.Second)
+	s.mu.Lock()
+	s.held["customer-2"] = groupHold{messageID: second.ID, until: time.Now()}
+	s.mu.Unlock()
+	if got := takeIDs(s); len(got) != 1 || got[0] != "m-b2" {
+		t.Fatalf("expected b2 after the hold lapsed, got %v", got)
+	}
+}
+
+func TestOrderScheduler_WeightsPremiumLane(t *testing.T) {
+	s := newOrderScheduler(100, 2)
+	for i, id := range []string{"s1", "s2", "s3"} {
+		s.push(scheduledOrder(t, id, 10+i, laneStandard))
+	}
+	for i, id := range []string{"p1", "p2", "p3", "p4"} {
+		s.push(scheduledOrder(t, id, 20+i, lanePremium))
+	}
+
+	want := []string{"m-p1", "m-p2", "m-s1", "m-p3", "m-p4", "m-s2", "m-s3"}
+	got := takeIDs(s)
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestOrderScheduler_DispatchWaitsForGroup(t *testing.T) {
+	s := newOrderScheduler(100, 3)
+	out := make(chan QueuedMessage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.dispatch(ctx, out)
+
+	s.push(scheduledOrder(t, "a1", 1, laneStandard))
+	s.push(scheduledOrder(t, "a2", 1, laneStandard))
+	first := <-out
+	select {
+	case m := <-out:
+		t.Fatalf("%s dispatched while %s was in flight", m.ID, first.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.done(first, 0)
+	select {
+	case m := <-out:
+		if m.ID != "m-a2" {
+			t.Fatalf("expected a2, got %s", m.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a2 was not dispatched after a1 finished")
+	}
+}
+
+func TestSubmitOrder_PublishesGroupAndLane(t *testing.T) {
+	ctx := withOrderStore(t)
+	topic, queue := newMemoryTopic("orders"), newMemoryQueue("orders-queue")
+	topic.subscribe(queue)
+	previousPublisher, previousPremium := orderPublisher, premiumCustomers
+	orderPublisher, premiumCustomers = topic, parseCustomerSet(" 42, vip-7 ")
+	t.Cleanup(func() { orderPublisher, premiumCustomers = previousPublisher, previousPremium })
+
+	submitOrder(ctx, &Order{OrderID: "o-premium", CustomerID: 42})
+	// Clients can't pick their own lane
+	submitOrder(ctx, &Order{OrderID: "o-standard", CustomerRef: "shopper-1", Lane: lanePremium})
+
+	messages, _ := queue.Receive(ctx, 10, 0, time.Minute)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	want := map[string][2]string{
+		"o-premium":  {"customer-42", lanePremium},
+		"o-standard": {"customer-shopper-1", laneStandard},
+	}
+	for _, message := range messages {
+		var envelope snsEnvelope
+		var order Order
+		json.Unmarshal([]byte(message.Body), &envelope)
+		json.Unmarshal([]byte(envelope.Message), &order)
+		expected := want[order.OrderID]
+		if envelope.MessageAttributes[attrMessageGroupID].Value != expected[0] || envelope.MessageAttributes[attrLane].Value != expected[1] {
+			t.Errorf("order %s published with %+v", order.OrderID, envelope.MessageAttributes)
+		}
+		if group, lane := classify(message); group != expected[0] || lane != expected[1] || order.Lane != expected[1] {
+			t.Errorf("order %s classified as %s/%s (lane %q)", order.OrderID, group, lane, order.Lane)
+		}
+	}
+}
+
+func TestExtendWaitingVisibility(t *testing.T) {
+	queue := newMemoryQueue("visibility-queue")
+	previous := orderSubscriber
+	orderSubscriber = queue
+	t.Cleanup(func() { orderSubscriber = previous })
+	for _, id := range []string{"a1", "a2"} {
+		message := scheduledOrder(t, id, 1, laneStandard)
+		queue.add(message.ID, message.Body, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newOrderScheduler(100, 3)
+	received, _ := queue.Receive(ctx, 10, 0, 30*time.Millisecond)
+	for _, message := range received {
+		s.push(message)
+	}
+	// a1 runs; a2 waits behind it for longer than its visibility timeout
+	first, _ := s.take()
+	s.push(QueuedMessage{ID: "m-stale", Body: first.Body, ReceiptHandle: "rcpt-gone"})
+	stopped := make(chan struct{})
+	go func() {
+		extendWaitingVisibility(ctx, s, 10*time.Millisecond)
+		close(stopped)
+	}()
+	time.Sleep(80 * time.Millisecond)
+	cancel()
+	<-stopped
+
+	redelivered, _ := queue.Receive(context.Background(), 10, 0, time.Minute)
+	if len(redelivered) != 1 || redelivered[0].ID != first.ID {
+		t.Fatalf("waiting message was redelivered: %+v", redelivered)
+	}
+	// A stale receipt drops the message; a redelivery refreshes the waiting copy
+	waiting := s.waitingMessages()
+	if len(waiting) != 1 || waiting[0].ID != "m-a2" {
+		t.Fatalf("expected only a2 waiting, got %+v", waiting)
+	}
+	s.push(QueuedMessage{ID: "m-a2", Body: waiting[0].Body, ReceiptHandle: "rcpt-new"})
+	if waiting := s.waitingMessages(); len(waiting) != 1 || waiting[0].ReceiptHandle != "rcpt-new" {
+		t.Fatalf("redelivery should replace the waiting copy, got %+v", waiting)
+	}
+}
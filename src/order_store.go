@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// insertOrder stores a new order inside the caller's transaction
+func insertOrder(tx *sql.Tx, order *Order) error {
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to serialize order: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO orders (order_id, customer_id, cart_id, customer_ref, status, total, payload, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		order.OrderID, order.CustomerID, nullableString(order.CartID), nullableString(order.CustomerRef),
+		order.Status, order.Total(), payload, order.CreatedAt, order.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert order: %w", err)
+	}
+	return nil
+}
+
+// enqueueOrder stores the order and its order.created outbox event in the
+// caller's transaction, so payment starts only if the transaction commits
+func enqueueOrder(tx *sql.Tx, order *Order) error {
+	order.Lane = orderLane(order)
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to serialize order: %w", err)
+	}
+	if err := insertOrder(tx, order); err != nil {
+		return err
+	}
+	return enqueueOutboxEvent(tx, outboxOrders, "order.created", order.OrderID, orderJSON, orderMessageAttributes(order))
+}
+
+// submitOrder hands a pending order to the async payment path: through the
+// outbox when MySQL is configured, otherwise straight to the order publisher
+func submitOrder(ctx context.Context, order *Order) error {
+	if db == nil {
+		order.Lane = orderLane(order)
+		if err := orderStore.Put(ctx, order); err != nil {
+			return fmt.Errorf("failed to record order: %w", err)
+		}
+		orderJSON, err := json.Marshal(order)
+		if err != nil {
+			return fmt.Errorf("failed to serialize order: %w", err)
+		}
+		_, err = orderPublisher.Publish(ctx, string(orderJSON), orderMessageAttributes(order))
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := enqueueOrder(tx, order); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+var errOrderNotFound = errors.New("order not found")
+
+// OrderStore keeps the current state of every order so the API, the
+// worker and later stages agree on where an order is in its lifecycle.
+// Update is an atomic read-modify-write: fn sees the latest order and its
+// changes are saved unless it returns an error.
+type OrderStore interface {
+	Get(ctx context.Context, orderID string) (*Order, error)
+	Put(ctx context.Context, order *Order) error
+	Update(ctx context.Context, orderID string, fn func(*Order) error) (*Order, error)
+}
+
+// orderStore defaults to process memory; initOrderStore switches to MySQL.
+// Both are wrapped so live status streams hear about writes.
+var orderStore OrderStore = watchedOrderStore{newMemoryOrderStore()}
+
+func initOrderStore() {
+	if db == nil {
+		fmt.Println("⚠️  Order state kept in memory - cancellations only reach an in-process worker")
+		return
+	}
+	orderStore = watchedOrderStore{sqlOrderStore{}}
+	fmt.Println("✅ Order state stored in MySQL")
+}
+
+// memoryOrderStore keeps deep copies so callers can't mutate stored orders
+type memoryOrderStore struct {
+	mu     sync.Mutex
+	orders map[string][]byte
+}
+
+func newMemoryOrderStore() *memoryOrderStore {
+	return &memoryOrderStore{orders: make(map[string][]byte)}
+}
+
+func (s *memoryOrderStore) Get(ctx context.Context, orderID string) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(orderID)
+}
+
+func (s *memoryOrderStore) load(orderID string) (*Order, error) {
+	data, ok := s.orders[orderID]
+	if !ok {
+		return nil, errOrderNotFound
+	}
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func (s *memoryOrderStore) Put(ctx context.Context, order *Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.orders[order.OrderID] = data
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryOrderStore) Update(ctx context.Context, orderID string, fn func(*Order) error) (*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, err := s.load(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(order); err != nil {
+		return order, err
+	}
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	s.orders[orderID] = data
+	return order, nil
+}
+
+// sqlOrderStore keeps orders in the MySQL orders table. Update locks the
+// row for the duration of fn.
+type sqlOrderStore struct{}
+
+func (sqlOrderStore) Get(ctx context.Context, orderID string) (*Order, error) {
+	return loadOrder(db.QueryRowContext(ctx, "SELECT payload FROM orders WHERE order_id = ?", orderID))
+}
+
+func loadOrder(row *sql.Row) (*Order, error) {
+	var payload []byte
+	if err := row.Scan(&payload); err == sql.ErrNoRows {
+		return nil, errOrderNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var order Order
+	if err := json.Unmarshal(payload, &order); err != nil {
+		return nil, fmt.Errorf("failed to parse stored order: %w", err)
+	}
+	return &order, nil
+}
+
+func (sqlOrderStore) Put(ctx context.Context, order *Order) error {
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO orders (order_id, customer_id, cart_id, customer_ref, status, total, payload, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW())
+		ON DUPLICATE KEY UPDATE status = VALUES(status), total = VALUES(total), payload = VALUES(payload), updated_at = NOW()`,
+		order.OrderID, order.CustomerID, nullableString(order.CartID), nullableString(order.CustomerRef),
+		order.Status, order.Total(), payload, order.CreatedAt)
+	return err
+}
+
+func (sqlOrderStore) Update(ctx context.Context, orderID string, fn func(*Order) error) (*Order, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	order, err := loadOrder(tx.QueryRowContext(ctx, "SELECT payload FROM orders WHERE order_id = ? FOR UPDATE", orderID))
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(order); err != nil {
+		return order, err
+	}
+
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE orders SET status = ?, total = ?, payload = ?, updated_at = NOW()
+		WHERE order_id = ?`,
+		order.Status, order.Total(), payload, orderID); err != nil {
+		return nil, err
+	}
+	return order, tx.Commit()
+}
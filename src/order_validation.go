@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"text/main/orders"
+)
+
+// Per-line and per-order limits for incoming orders
+var orderLimits = orders.Limits{
+	MaxLines:        getEnvInt("ORDER_MAX_LINES", orders.DefaultLimits.MaxLines),
+	MaxLineQuantity: getEnvInt("ORDER_MAX_LINE_QUANTITY", orders.DefaultLimits.MaxLineQuantity),
+}
+
+// orderLineError explains why one line of an order was rejected
+type orderLineError = orders.LineError
+
+// Price makes the product store the catalog orders are validated against
+func (s *productStore) Price(productID string) (float64, bool) {
+	p, ok := s.lookup(productID)
+	return p.Price, ok
+}
+
+// validateOrder checks every line against the catalog and replaces line
+// prices with catalog prices (see orders.Validate)
+func validateOrder(catalog *productStore, order *Order) []orderLineError {
+	return orders.Validate(order, catalog, orderLimits)
+}
+
+// prepareOrder validates the order against the catalog and attaches its
+// price breakdown, which is what payment will charge. promos are extra
+// promotions such as redeemed coupons.
+func prepareOrder(order *Order, promos ...promotion) []orderLineError {
+	if errs := validateOrder(store, order); len(errs) > 0 {
+		return errs
+	}
+	order.Pricing = orderPricing.quote(order.Items, order.Region, promos...)
+	return nil
+}
+
+// priceCartItem checks an item being added to a cart against the catalog and
+// fills in the catalog price (and name, if missing). Carts then only hold
+// prices checkout will accept; a client price that differs is rejected.
+func priceCartItem(req *AddItemRequest) []orderLineError {
+	line := Order{Items: []Item{{ProductID: req.ProductID, Quantity: req.Quantity, Price: req.PricePerUnit}}}
+	if errs := validateOrder(store, &line); len(errs) > 0 {
+		return errs
+	}
+	req.PricePerUnit = line.Items[0].Price
+	if req.ProductName == "" {
+		p, _ := store.lookup(req.ProductID)
+		req.ProductName = p.Name
+	}
+	return nil
+}
+
+// rejectInvalidCartItem writes the 422 response for an item priceCartItem rejected
+func rejectInvalidCartItem(c *gin.Context, errs []orderLineError) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":       errs[0].Code,
+		"message":     errs[0].Message,
+		"line_errors": errs,
+	})
+}
+
+// rejectInvalidOrder writes the 422 response for a failed validation
+func rejectInvalidOrder(c *gin.Context, errs []orderLineError) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":       "invalid order",
+		"line_errors": errs,
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestValidateOrder(t *testing.T) {
+	catalog := newProductStore()
+	catalog.generateProducts()
+	p1, _ := catalog.lookup("1")
+	p2, _ := catalog.lookup("2")
+
+	order := &Order{Items: []Item{
+		{ProductID: "1", Quantity: 2},                  // priced from the catalog
+		{ProductID: "2", Quantity: 1, Price: p2.Price}, // matching client price
+	}}
+	if errs := validateOrder(catalog, order); len(errs) != 0 {
+		t.Fatalf("expected valid order, got %+v", errs)
+	}
+	if order.Items[0].Price != p1.Price || order.Total() != 2*p1.Price+p2.Price {
+		t.Fatalf("expected catalog prices, got %+v", order.Items)
+	}
+
+	bad := &Order{Items: []Item{
+		{ProductID: "1", Quantity: 1, Price: p1.Price + 1},
+		{ProductID: "missing", Quantity: 1},
+		{ProductID: "2", Quantity: 0},
+		{ProductID: "3", Quantity: orderLimits.MaxLineQuantity + 1},
+	}}
+	errs := validateOrder(catalog, bad)
+	want := []string{"price_changed", "unknown_product", "invalid_quantity", "invalid_quantity"}
+	if len(errs) != len(want) {
+		t.Fatalf("expected %d line errors, got %+v", len(want), errs)
+	}
+	for i, code := range want {
+		if errs[i].Code != code || errs[i].Line != i+1 {
+			t.Fatalf("line %d: expected %s, got %+v", i+1, code, errs[i])
+		}
+	}
+	if errs[0].CatalogPrice != p1.Price {
+		t.Fatalf("expected catalog price in drift error, got %+v", errs[0])
+	}
+
+	if errs := validateOrder(catalog, &Order{}); len(errs) != 1 || errs[0].Code != "no_items" {
+		t.Fatalf("expected no_items for empty order, got %+v", errs)
+	}
+}
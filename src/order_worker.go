@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"text/main/orders"
+)
+
+// orderProcessingError classifies a worker failure. Permanent failures
+// (malformed messages, declined payments) go straight to the DLQ;
+// transient ones are retried with backoff.
+type orderProcessingError struct {
+	reason     string
+	permanent  bool
+	retryAfter time.Duration // set when the message must wait out an earlier attempt's claim
+	err        error
+}
+
+func (e *orderProcessingError) Error() string {
+	return fmt.Sprintf("%s: %v", e.reason, e.err)
+}
+
+func (e *orderProcessingError) Unwrap() error {
+	return e.err
+}
+
+func permanentError(reason string, err error) error {
+	return &orderProcessingError{reason: reason, permanent: true, err: err}
+}
+
+func transientError(reason string, err error) error {
+	return &orderProcessingError{reason: reason, permanent: false, err: err}
+}
+
+// claimedError means an earlier attempt of the same message still holds
+// its dedup claim; the message waits out the lease without using up a receive
+func claimedError(retryAfter time.Duration, err error) error {
+	return &orderProcessingError{reason: "order_claimed", retryAfter: retryAfter, err: err}
+}
+
+// claimWait returns how long to wait for a live claim, if err is a claimedError
+func claimWait(err error) (time.Duration, bool) {
+	var procErr *orderProcessingError
+	if errors.As(err, &procErr) && procErr.reason == "order_claimed" {
+		return procErr.retryAfter, true
+	}
+	return 0, false
+}
+
+// isPermanent reports whether err should skip retries. Unclassified errors are transient.
+func isPermanent(err error) bool {
+	var procErr *orderProcessingError
+	return errors.As(err, &procErr) && procErr.permanent
+}
+
+// failureReason returns the classification label used in DLQ metadata
+func failureReason(err error) string {
+	var procErr *orderProcessingError
+	if errors.As(err, &procErr) {
+		return procErr.reason
+	}
+	return "unknown"
+}
+
+// retryPolicy decides how long a failed message stays invisible and when it is dead-lettered
+type retryPolicy struct {
+	maxReceives int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+func newRetryPolicyFromEnv() retryPolicy {
+	return retryPolicy{
+		maxReceives: getEnvInt("ORDER_MAX_RECEIVES", 5),
+		baseDelay:   time.Duration(getEnvInt("ORDER_RETRY_BASE_SECONDS", 2)) * time.Second,
+		maxDelay:    time.Duration(getEnvInt("ORDER_RETRY_MAX_SECONDS", 300)) * time.Second,
+	}
+}
+
+// backoff returns baseDelay * 2^(receiveCount-1), capped at maxDelay
+func (p retryPolicy) backoff(receiveCount int) time.Duration {
+	delay := p.baseDelay
+	for i := 1; i < receiveCount && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	return delay
+}
+
+func (p retryPolicy) exhausted(receiveCount int) bool {
+	return receiveCount >= p.maxReceives
+}
+
+// workerCounters tracks the outcome of every message the worker handles
+type workerCounters struct {
+	mu               sync.Mutex
+	received         int
+	succeeded        int
+	retried          int
+	deadLettered     int
+	deadLetterFailed int
+	deleted          int
+	deleteRetried    int
+	deleteFailed     int
+	heartbeats       int
+	heartbeatFailed  int
+	skipped          int // cancelled or already settled orders
+	compensated      int // sagas rolled back after a failed step
+	duplicates       int // deliveries skipped by the dedup store
+}
+
+func (wc *workerCounters) add(field *int) {
+	wc.mu.Lock()
+	*field++
+	wc.mu.Unlock()
+}
+
+func (wc *workerCounters) snapshot() map[string]int {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return map[string]int{
+		"received":           wc.received,
+		"succeeded":          wc.succeeded,
+		"retried":            wc.retried,
+		"dead_lettered":      wc.deadLettered,
+		"dead_letter_failed": wc.deadLetterFailed,
+		"deleted":            wc.deleted,
+		"delete_retried":     wc.deleteRetried,
+		"delete_failed":      wc.deleteFailed,
+		"heartbeats":         wc.heartbeats,
+		"heartbeat_failed":   wc.heartbeatFailed,
+		"skipped":            wc.skipped,
+		"compensated":        wc.compensated,
+		"duplicates":         wc.duplicates,
+	}
+}
+
+var (
+	orderWorkerStats = &workerCounters{}
+	orderRetryPolicy = newRetryPolicyFromEnv()
+	orderAcks        *ackBatcher // batches deletes while the worker is running
+)
+
+// Background worker that polls the order queue and processes orders until ctx is cancelled.
+// On shutdown it stops polling, returns buffered messages to the queue and
+// gives in-progress orders up to shutdownGracePeriod to finish.
+func startOrderProcessor(ctx context.Context) {
+	// Get number of worker goroutines from environment (default: 1).
+	// MIN_WORKERS/MAX_WORKERS let the pool follow queue depth.
+	numWorkers := getEnvInt("NUM_WORKERS", 1)
+	policy := newScalingPolicyFromEnv(numWorkers)
+	numWorkers = policy.clamp(numWorkers)
+
+	fmt.Printf("Order processor started with %d worker goroutines, polling %s queue...\n", numWorkers, orderBusKind)
+	fmt.Printf("Retry policy: max %d receives, backoff %v..%v\n",
+		orderRetryPolicy.maxReceives, orderRetryPolicy.baseDelay, orderRetryPolicy.maxDelay)
+
+	// Received messages wait in the scheduler, which keeps one order per
+	// customer in flight and favors the premium lane; workers take them
+	// from the unbuffered channel as they free up
+	scheduler := newOrderScheduler(getEnvInt("ORDER_SCHEDULER_BUFFER", 100), getEnvInt("ORDER_PREMIUM_WEIGHT", 3))
+	messagesChan := make(chan QueuedMessage)
+
+	// In-progress orders keep running after ctx is cancelled; this context
+	// only aborts them once the grace period is exhausted
+	processCtx, abortProcessing := context.WithCancel(context.Background())
+	defer abortProcessing()
+
+	// Deletes are batched; close flushes them after the workers stop
+	orderAcks = newAckBatcher(orderSubscriber)
+	orderAcks.start()
+
+	// Start worker goroutines
+	pool := newWorkerPool(messagesChan, func(message QueuedMessage, workerID int) {
+		var retryIn time.Duration
+		defer func() { scheduler.done(message, retryIn) }()
+		if ctx.Err() != nil {
+			// Shutting down: hand unstarted messages back to the queue immediately
+			releaseMessage(message)
+			return
+		}
+		stopHeartbeat := startVisibilityHeartbeat(message, workerID)
+		err := processOrderMessage(processCtx, message, workerID)
+		stopHeartbeat()
+		retryIn = handleMessageResult(message, workerID, err)
+	})
+	pool.resize(numWorkers)
+
+	if policy.enabled() {
+		fmt.Printf("Autoscaling between %d and %d workers (target backlog %d per worker, every %v)\n",
+			policy.minWorkers, policy.maxWorkers, policy.targetPerWorker, policy.interval)
+		go newAutoscaler(policy).run(ctx, pool, scheduler.waiting)
+	}
+
+	// Periodically report outcome counts and drop expired dedup keys
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("Worker stats: %v (workers=%d in_flight=%d scheduler=%v)\n",
+					orderWorkerStats.snapshot(), pool.size(), pool.inFlight.Load(), scheduler.snapshot())
+				if err := orderDedup.Purge(ctx); err != nil {
+					fmt.Printf("Error purging expired dedup keys: %v\n", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+	dispatched := make(chan struct{})
+	go func() {
+		scheduler.dispatch(dispatchCtx, messagesChan)
+		close(dispatched)
+	}()
+	// Messages waiting for a worker need their visibility extended too
+	extended := make(chan struct{})
+	go func() {
+		extendWaitingVisibility(dispatchCtx, scheduler, orderVisibilityTimeout/3)
+		close(extended)
+	}()
+
+	pollMessages(ctx, scheduler)
+
+	// Stop accepting work, return waiting messages and wait for in-progress orders
+	stopDispatch()
+	<-dispatched
+	<-extended
+	for _, message := range scheduler.drain() {
+		releaseMessage(message)
+	}
+	close(messagesChan)
+	fmt.Printf("Shutdown signal received, waiting up to %v for in-progress orders...\n", shutdownGracePeriod)
+
+	done := make(chan struct{})
+	go func() {
+		pool.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("All in-progress orders finished")
+	case <-time.After(shutdownGracePeriod):
+		fmt.Println("Grace period expired, aborting remaining orders (they will be redelivered)")
+		abortProcessing()
+		<-done
+	}
+	orderAcks.close()
+	orderAcks = nil
+	fmt.Printf("Order processor stopped. Final stats: %v\n", orderWorkerStats.snapshot())
+}
+
+// pollMessages long-polls the order queue and feeds the scheduler until ctx
+// is cancelled, pausing while the scheduler is full
+func pollMessages(ctx context.Context, scheduler *orderScheduler) {
+	for ctx.Err() == nil {
+		if scheduler.full() {
+			sleepContext(ctx, 100*time.Millisecond)
+			continue
+		}
+
+		// Long polling - wait up to 20 seconds for messages
+		messages, err := orderSubscriber.Receive(ctx, 10, 20*time.Second, orderVisibilityTimeout)
+
+		if ctx.Err() != nil {
+			for _, message := range messages {
+				releaseMessage(message)
+			}
+			return
+		}
+
+		if err != nil {
+			fmt.Printf("Error receiving messages from queue: %v\n", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		for _, message := range messages {
+			orderWorkerStats.add(&orderWorkerStats.received)
+			scheduler.push(message)
+		}
+	}
+}
+
+// processOrderMessage parses and charges one order. The returned error is
+// classified so the caller can decide between delete, retry and dead-letter.
+func processOrderMessage(ctx context.Context, message QueuedMessage, workerID int) error {
+	// Parse SNS message wrapper
+	var snsMessage snsEnvelope
+	if err := json.Unmarshal([]byte(message.Body), &snsMessage); err != nil {
+		return permanentError("invalid_envelope", err)
+	}
+
+	// Parse the actual order
+	var order Order
+	if err := json.Unmarshal([]byte(snsMessage.Message), &order); err != nil {
+		return permanentError("invalid_order", err)
+	}
+	if order.OrderID == "" {
+		return permanentError("invalid_order", errors.New("order_id is required"))
+	}
+
+	// Claim the SNS message and the order so redeliveries and duplicate
+	// fan-outs never reach payment twice
+	delivery := newOrderDelivery(message, snsMessage.MessageID, order.OrderID)
+	decision, reason, err := delivery.claim(ctx)
+	if err != nil {
+		return transientError("dedup_store_failed", err)
+	}
+	switch decision {
+	case deliverySkip:
+		orderWorkerStats.add(&orderWorkerStats.duplicates)
+		fmt.Printf("[Worker %d] Skipping duplicate delivery of order %s: %s\n", workerID, order.OrderID, reason)
+		return nil
+	case deliveryRetry:
+		return claimedError(time.Until(delivery.heldUntil), errors.New(reason))
+	}
+
+	err = fulfillOrder(ctx, message, &order, workerID)
+	// Record the outcome even if processing was aborted at shutdown
+	delivery.finish(context.WithoutCancel(ctx), err)
+	return err
+}
+
+// fulfillOrder runs the saga for a claimed order and records how it ended
+func fulfillOrder(ctx context.Context, message QueuedMessage, order *Order, workerID int) error {
+	// A cancelled or already settled order is acknowledged without charging
+	claimed, err := claimOrder(ctx, order.OrderID)
+	if err != nil {
+		return transientError("order_store_failed", err)
+	}
+	if err := loadSaga(ctx, order); err != nil {
+		return transientError("order_store_failed", err)
+	}
+	// ...unless an earlier attempt crashed while compensating it
+	resuming := order.Saga != nil && order.Saga.Status == orders.SagaCompensating
+	if !claimed && !resuming {
+		orderWorkerStats.add(&orderWorkerStats.skipped)
+		fmt.Printf("[Worker %d] Skipping order %s: cancelled or already processed\n", workerID, order.OrderID)
+		return nil
+	}
+
+	fmt.Printf("[Worker %d] Processing order: %s (customer: %d)\n", workerID, order.OrderID, order.CustomerID)
+
+	if !order.CreatedAt.IsZero() && order.Saga == nil {
+		paymentMetrics.recordQueueWait(time.Since(order.CreatedAt))
+	}
+
+	// Reserve stock, authorize, capture and check out the cart (this takes 3 seconds)
+	order.Status = orderProcessing
+	err = runFulfillment(ctx, order, deliveryCount(message), workerID)
+
+	switch order.Saga.Status {
+	case orders.SagaCompleted:
+		order.Status = orderCompleted
+		recordPaymentResult(ctx, order, orderCompleted)
+		fmt.Printf("[Worker %d] Payment completed for order %s (auth: %s, capture: %s)\n",
+			workerID, order.OrderID, order.AuthorizationID, order.CaptureID)
+		notifyOrderFinished(ctx, order, "order.completed")
+	case orders.SagaCompensated:
+		orderWorkerStats.add(&orderWorkerStats.compensated)
+		if order.Saga.Reason == sagaCancelled {
+			orderWorkerStats.add(&orderWorkerStats.skipped)
+			fmt.Printf("[Worker %d] Order %s cancelled during processing, authorization voided and stock released\n", workerID, order.OrderID)
+			order.Status = orderCancelled
+			notifyOrderFinished(ctx, order, "order.cancelled")
+			break
+		}
+		fmt.Printf("[Worker %d] Order %s failed (%s), completed steps compensated\n", workerID, order.OrderID, order.Saga.Reason)
+		order.Status = orderFailed
+		recordPaymentResult(ctx, order, orderFailed)
+		notifyOrderFinished(ctx, order, "order.failed")
+	}
+	return err
+}
+
+// handleMessageResult deletes successful messages, dead-letters permanent or
+// exhausted failures and schedules a backoff retry for transient ones. It
+// returns the retry delay, or zero when the message is done with.
+func handleMessageResult(message QueuedMessage, workerID int, err error) time.Duration {
+	if err == nil {
+		orderWorkerStats.add(&orderWorkerStats.succeeded)
+		deleteMessage(message)
+		return 0
+	}
+
+	receiveCount := deliveryCount(message)
+	if wait, claimed := claimWait(err); claimed {
+		// The lease always runs out, so this never loops; counting these
+		// receives would dead-letter the order before it could be resumed
+		if wait < orderRetryPolicy.baseDelay {
+			wait = orderRetryPolicy.baseDelay
+		}
+		fmt.Printf("[Worker %d] Message %s waits %v for an earlier attempt's claim: %v\n",
+			workerID, message.ID, wait, err)
+		orderWorkerStats.add(&orderWorkerStats.retried)
+		if visErr := orderSubscriber.ChangeVisibility(context.TODO(), message, wait); visErr != nil {
+			fmt.Printf("[Worker %d] Error setting retry backoff: %v\n", workerID, visErr)
+		}
+		return wait
+	}
+	if isPermanent(err) || orderRetryPolicy.exhausted(receiveCount) {
+		fmt.Printf("[Worker %d] Dead-lettering message %s after %d receive(s): %v\n",
+			workerID, message.ID, receiveCount, err)
+		if dlqErr := sendToDeadLetterQueue(message, workerID, receiveCount, err); dlqErr != nil {
+			// Leave the message on the queue; it will be redelivered and retried
+			orderWorkerStats.add(&orderWorkerStats.deadLetterFailed)
+			fmt.Printf("[Worker %d] Error forwarding message to DLQ: %v\n", workerID, dlqErr)
+			return 0
+		}
+		orderWorkerStats.add(&orderWorkerStats.deadLettered)
+		deleteMessage(message)
+		return 0
+	}
+
+	delay := orderRetryPolicy.backoff(receiveCount)
+	fmt.Printf("[Worker %d] Retrying message %s in %v (receive %d/%d): %v\n",
+		workerID, message.ID, delay, receiveCount, orderRetryPolicy.maxReceives, err)
+	orderWorkerStats.add(&orderWorkerStats.retried)
+
+	if visErr := orderSubscriber.ChangeVisibility(context.TODO(), message, delay); visErr != nil {
+		fmt.Printf("[Worker %d] Error setting retry backoff: %v\n", workerID, visErr)
+	}
+	return delay
+}
+
+// deliveryCount is the number of times the message has been received (1 on first delivery)
+func deliveryCount(message QueuedMessage) int {
+	if message.ReceiveCount > 0 {
+		return message.ReceiveCount
+	}
+	return 1
+}
+
+// sendToDeadLetterQueue forwards the original body with failure metadata attached
+func sendToDeadLetterQueue(message QueuedMessage, workerID int, receiveCount int, cause error) error {
+	_, err := deadLetterPublisher.Publish(context.TODO(), message.Body, map[string]string{
+		"failure_reason":    failureReason(cause),
+		"failure_error":     cause.Error(),
+		"permanent":         strconv.FormatBool(isPermanent(cause)),
+		"receive_count":     strconv.Itoa(receiveCount),
+		"worker_id":         strconv.Itoa(workerID),
+		"source_message_id": message.ID,
+		"failed_at":         time.Now().UTC().Format(time.RFC3339),
+		attrDeduplicationID: message.ID, // a FIFO DLQ drops repeats of the same failure
+	})
+	return err
+}
+
+// releaseMessage makes a message visible again right away so another consumer can take it
+func releaseMessage(message QueuedMessage) {
+	if err := orderSubscriber.ChangeVisibility(context.TODO(), message, 0); err != nil {
+		fmt.Printf("Error releasing message %s: %v\n", message.ID, err)
+	}
+}
+
+// deleteMessage acknowledges a message so the queue stops redelivering it.
+// While the worker runs, deletes go through the batcher.
+func deleteMessage(message QueuedMessage) {
+	if orderAcks != nil {
+		orderAcks.ack(message)
+		return
+	}
+
+	failures, err := orderSubscriber.DeleteBatch(context.TODO(), []QueuedMessage{message})
+	if err == nil && len(failures) > 0 {
+		err = fmt.Errorf("%s: %s", failures[0].Code, failures[0].Message)
+	}
+	if err != nil {
+		orderWorkerStats.add(&orderWorkerStats.deleteFailed)
+		fmt.Printf("Error deleting message from queue: %v\n", err)
+		return
+	}
+	orderWorkerStats.add(&orderWorkerStats.deleted)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := retryPolicy{maxReceives: 5, baseDelay: 2 * time.Second, maxDelay: 10 * time.Second}
+
+	expected := map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 4: 10 * time.Second, 9: 10 * time.Second}
+	for receiveCount, want := range expected {
+		if got := policy.backoff(receiveCount); got != want {
+			t.Fatalf("backoff(%d) = %v, want %v", receiveCount, got, want)
+		}
+	}
+	if policy.exhausted(4) || !policy.exhausted(5) {
+		t.Fatal("expected policy to be exhausted at exactly maxReceives")
+	}
+}
+
+func TestProcessOrderMessage_ClassifiesErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		reason string
+	}{
+		{"not json", "garbage", "invalid_envelope"},
+		{"bad order", `{"Message":"not an order"}`, "invalid_order"},
+	}
+
+	for _, tc := range cases {
+		err := processOrderMessage(context.Background(), QueuedMessage{Body: tc.body}, 1)
+		if !isPermanent(err) || failureReason(err) != tc.reason {
+			t.Fatalf("%s: expected permanent %s error, got %v", tc.name, tc.reason, err)
+		}
+	}
+
+	if isPermanent(fmt.Errorf("network blip")) {
+		t.Fatal("unclassified errors must be treated as transient")
+	}
+	if isPermanent(transientError("payment_failed", fmt.Errorf("timeout"))) {
+		t.Fatal("transient error reported as permanent")
+	}
+}
+
+func TestDeliveryCount(t *testing.T) {
+	if got := deliveryCount(QueuedMessage{ReceiveCount: 3}); got != 3 {
+		t.Fatalf("expected 3, got %d", got)
+	}
+	if got := deliveryCount(QueuedMessage{}); got != 1 {
+		t.Fatalf("expected default of 1, got %d", got)
+	}
+}
+
+// flakySubscriber fails the "flaky" handle once (retryable) and "stale" always (not retryable)
+type flakySubscriber struct {
+	noopSubscriber
+	batches [][]string
+}
+
+func (f *flakySubscriber) DeleteBatch(ctx context.Context, messages []QueuedMessage) ([]DeleteFailure, error) {
+	var handles []string
+	var failures []DeleteFailure
+	for i, m := range messages {
+		handles = append(handles, m.ReceiptHandle)
+		switch {
+		case m.ReceiptHandle == "flaky" && len(f.batches) == 0:
+			failures = append(failures, DeleteFailure{Index: i, Code: "InternalError", Retryable: true})
+		case m.ReceiptHandle == "stale":
+			failures = append(failures, DeleteFailure{Index: i, Code: "ReceiptHandleIsInvalid"})
+		}
+	}
+	f.batches = append(f.batches, handles)
+	return failures, nil
+}
+
+func TestAckBatcher_RetriesPartialFailures(t *testing.T) {
+	subscriber := &flakySubscriber{}
+	b := newAckBatcher(subscriber)
+	b.flushInterval = time.Hour // only size and close trigger flushes
+
+	before := orderWorkerStats.snapshot()
+	b.start()
+	for _, handle := range []string{"ok", "flaky", "stale"} {
+		b.ack(QueuedMessage{ReceiptHandle: handle})
+	}
+	b.close()
+	after := orderWorkerStats.snapshot()
+
+	batches := subscriber.batches
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 || batches[1][0] != "flaky" {
+		t.Fatalf("expected one batch of 3 then a retry of the flaky entry, got %v", batches)
+	}
+	if got := after["deleted"] - before["deleted"]; got != 2 {
+		t.Fatalf("expected 2 deletes, got %d", got)
+	}
+	if got := after["delete_failed"] - before["delete_failed"]; got != 1 {
+		t.Fatalf("expected 1 permanent delete failure, got %d", got)
+	}
+}
@@ -0,0 +1,155 @@
+package orders
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The order JSON is published by the API service and consumed by the
+// worker and the Lambda, which may be deployed at different versions.
+// testdata/order_full.json pins the wire format: if these tests fail, a
+// field was renamed or changed type and old consumers would misread it.
+
+func contractOrder() Order {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	finished := created.Add(3 * time.Second)
+	return Order{
+		OrderID:         "order-0123456789abcdef",
+		CustomerID:      42,
+		Status:          StatusPartiallyRefunded,
+		Items:           []Item{{ProductID: "17", Quantity: 2, Price: 16.99}},
+		CreatedAt:       created,
+		AuthorizationID: "auth-0123456789abcdef",
+		CaptureID:       "cap-0123456789abcdef",
+		CartID:          "cart-1",
+		CustomerRef:     "customer-1",
+		Region:          "CA",
+		Pricing: &PriceBreakdown{
+			Lines:      []LinePrice{{ProductID: "17", Quantity: 2, UnitPrice: 16.99, Subtotal: 33.98, Discount: 3.4, Tax: 2.22, Total: 32.8}},
+			Subtotal:   33.98,
+			Discount:   3.4,
+			Shipping:   5.99,
+			Tax:        2.22,
+			Total:      38.79,
+			Region:     "CA",
+			TaxRate:    0.0725,
+			Promotions: []string{"WELCOME10"},
+		},
+		Refunds: []Refund{{
+			RefundID: "rfd-0123456789abcdef", Amount: 16.4, Lines: []Item{{ProductID: "17", Quantity: 1, Price: 16.4}},
+			Status: "succeeded", TransactionID: "ref-0123456789abcdef", CreatedAt: finished,
+		}},
+		CallbackURL: "https://example.com/hooks/orders",
+		Processing: &OrderProcessing{
+			Processor: "lambda", InvocationID: "req-1", ColdStart: true, InitDurationMs: 120, Attempts: 1,
+			ClaimedAt: created, ClaimExpiresAt: created.Add(time.Minute), FinishedAt: &finished, DurationMs: 3000,
+		},
+		Saga: &Saga{Status: SagaCompleted, Steps: []SagaStep{
+			{Name: StepReserveStock, Status: SagaDone, Attempts: 1, UpdatedAt: created},
+			{Name: StepAuthorize, Status: SagaDone, Attempts: 2, Error: "gateway /authorize returned 503: unavailable", UpdatedAt: finished},
+		}},
+		Lane: "premium",
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestContract_EncodesFixture(t *testing.T) {
+	order := contractOrder()
+	encoded, err := json.Marshal(&order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got, want map[string]interface{}
+	json.Unmarshal(encoded, &got)
+	json.Unmarshal(readFixture(t, "order_full.json"), &want)
+	if !reflect.DeepEqual(got, want) {
+		pretty, _ := json.MarshalIndent(got, "", "  ")
+		t.Errorf("wire format changed; encoded order:\n%s", pretty)
+	}
+}
+
+func TestContract_DecodesFixture(t *testing.T) {
+	var decoded Order
+	if err := json.Unmarshal(readFixture(t, "order_full.json"), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if want := contractOrder(); !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded fixture differs:\n got %+v\nwant %+v", decoded, want)
+	}
+}
+
+// Messages from publishers that predate pricing, refunds and callbacks
+// must still be processed
+func TestContract_DecodesMinimalOrder(t *testing.T) {
+	var decoded Order
+	if err := json.Unmarshal(readFixture(t, "order_minimal.json"), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.OrderID != "order-minimal" || decoded.CustomerID != 7 || len(decoded.Items) != 1 || decoded.Total() != 5.98 {
+		t.Errorf("unexpected minimal order: %+v", decoded)
+	}
+	if errs := Validate(&decoded, nil, DefaultLimits); len(errs) > 0 {
+		t.Errorf("minimal order should be valid: %+v", errs)
+	}
+}
+
+// Consumers must ignore fields added by newer publishers
+func TestContract_IgnoresUnknownFields(t *testing.T) {
+	body := `{"order_id":"order-new","customer_id":1,"status":"pending","items":[],"created_at":"2026-01-02T03:04:05Z","loyalty_tier":"gold"}`
+	var decoded Order
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil || decoded.OrderID != "order-new" {
+		t.Errorf("unknown field broke decoding: %v", err)
+	}
+}
+
+func TestValidate_WithoutCatalog(t *testing.T) {
+	order := Order{Items: []Item{{ProductID: "1", Quantity: 1, Price: 2}, {ProductID: "2", Quantity: 0}, {ProductID: "3", Quantity: 1, Price: -1}}}
+	errs := Validate(&order, nil, DefaultLimits)
+	if len(errs) != 2 || errs[0].Code != "invalid_quantity" || errs[1].Code != "invalid_price" {
+		t.Errorf("unexpected errors: %+v", errs)
+	}
+}
+
+func TestClaimAndCapture(t *testing.T) {
+	o := &Order{Status: StatusPending}
+	if !Claim(o) || BeginCapture(o) != nil || o.Status != StatusCapturing {
+		t.Fatalf("pending order should be claimed and captured, got %s", o.Status)
+	}
+
+	o = &Order{Status: StatusProcessing}
+	if err := Cancel(o); err != nil || o.Status != StatusCancelRequested {
+		t.Fatalf("cancel while processing: %v, %s", err, o.Status)
+	}
+	if err := BeginCapture(o); err != ErrCancelled || o.Status != StatusCancelled {
+		t.Errorf("capture after cancel request: %v, %s", err, o.Status)
+	}
+
+	if Claim(&Order{Status: StatusCompleted}) {
+		t.Error("completed order must not be claimed again")
+	}
+
+	// Interrupted mid-capture: the charge may have gone through
+	o = &Order{Status: StatusCapturing, AuthorizationID: "auth-1"}
+	if Claim(o) || o.Status != StatusNeedsReview {
+		t.Errorf("interrupted capture must not be claimed again, got %s", o.Status)
+	}
+	o = &Order{Status: StatusCapturing, AuthorizationID: "auth-1", CaptureID: "cap-1"}
+	if !Claim(o) || o.Status != StatusCapturing {
+		t.Errorf("recorded capture should resume its remaining steps, got %s", o.Status)
+	}
+	if err := Cancel(&Order{Status: StatusCompleted}); err == nil {
+		t.Error("completed order must not be cancellable")
+	}
+}
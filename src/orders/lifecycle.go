@@ -0,0 +1,113 @@
+package orders
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Order lifecycle. Cancellation is only possible until capture starts;
+// refunds only once payment has completed.
+//
+//	pending -> processing -> capturing -> completed -> partially_refunded -> refunded
+//	pending -> cancelled
+//	processing -> cancel_requested -> cancelled (authorization voided by the processor)
+//	processing -> failed
+//	capturing -> needs_review (interrupted mid-capture; reconciled with the gateway by hand)
+const (
+	StatusPending           = "pending"
+	StatusProcessing        = "processing"
+	StatusCapturing         = "capturing"
+	StatusCompleted         = "completed"
+	StatusFailed            = "failed"
+	StatusCancelRequested   = "cancel_requested"
+	StatusCancelled         = "cancelled"
+	StatusPartiallyRefunded = "partially_refunded"
+	StatusRefunded          = "refunded"
+	StatusNeedsReview       = "needs_review"
+)
+
+var (
+	// ErrCancelled stops payment of an order cancelled mid-processing
+	ErrCancelled = errors.New("order cancelled")
+	// ErrInvalidRefund marks refund requests that can't be honoured as asked
+	ErrInvalidRefund = errors.New("invalid refund")
+)
+
+// LifecycleError rejects an action the order's current status doesn't allow
+type LifecycleError struct {
+	Action string
+	Status string
+}
+
+func (e *LifecycleError) Error() string {
+	return fmt.Sprintf("cannot %s an order that is %s", e.Action, e.Status)
+}
+
+// Settled reports whether payment for the order is over, one way or another
+func Settled(status string) bool {
+	switch status {
+	case StatusCompleted, StatusFailed, StatusCancelled, StatusPartiallyRefunded, StatusRefunded:
+		return true
+	}
+	return false
+}
+
+// Claim moves the order to processing before it is charged and reports
+// whether it should be charged. A pending cancellation is completed instead,
+// and settled orders (redelivered messages) are left alone. An order still
+// capturing without a recorded capture was interrupted after asking the
+// gateway to capture, so the charge may have gone through: it needs review
+// rather than a second capture.
+func Claim(o *Order) bool {
+	switch o.Status {
+	case StatusPending, StatusProcessing:
+		// processing again means an earlier attempt died before capture
+		o.Status = StatusProcessing
+	case StatusCapturing:
+		if o.CaptureID == "" {
+			o.Status = StatusNeedsReview
+		}
+	case StatusCancelRequested:
+		o.Status = StatusCancelled
+	}
+	return o.Status == StatusProcessing || o.Status == StatusCapturing
+}
+
+// BeginCapture is the last point a cancellation can win: it returns
+// ErrCancelled if one was requested, otherwise moves the order to capturing
+func BeginCapture(o *Order) error {
+	switch o.Status {
+	case StatusCancelRequested:
+		o.Status = StatusCancelled
+		return ErrCancelled
+	case StatusCancelled:
+		return ErrCancelled
+	case StatusProcessing:
+		o.Status = StatusCapturing
+	}
+	return nil
+}
+
+// AbortCapture moves an order back to processing after the gateway
+// rejected its capture, so a retry may capture it again
+func AbortCapture(o *Order) {
+	if o.Status == StatusCapturing {
+		o.Status = StatusProcessing
+	}
+}
+
+// Cancel cancels a pending order outright, or asks the processor to cancel
+// one it is already processing
+func Cancel(o *Order) error {
+	switch o.Status {
+	case StatusPending:
+		o.Status = StatusCancelled
+	case StatusProcessing:
+		o.Status = StatusCancelRequested
+	case StatusCancelRequested, StatusCancelled:
+		// already on its way; cancelling again is a no-op
+	default:
+		return &LifecycleError{Action: "cancel", Status: o.Status}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package orders is the order domain shared by the API service and the
+// Lambda order processor: the wire format published to SNS/SQS, order
+// validation, the lifecycle state machine and the simulated payment
+// provider. Both binaries import it so publisher and consumer can't drift.
+package orders
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Item is one order line
+type Item struct {
+	ProductID string  `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"`
+}
+
+// Order is published as the SNS message body and stored as the order
+// payload. Field names are a wire contract (see contract_test.go): add
+// fields freely, but never rename or repurpose one.
+type Order struct {
+	OrderID         string           `json:"order_id"`
+	CustomerID      int              `json:"customer_id"`
+	Status          string           `json:"status"` // see lifecycle.go
+	Items           []Item           `json:"items"`
+	CreatedAt       time.Time        `json:"created_at"`
+	AuthorizationID string           `json:"authorization_id,omitempty"`
+	CaptureID       string           `json:"capture_id,omitempty"`
+	CartID          string           `json:"cart_id,omitempty"`      // set when created by cart checkout
+	CustomerRef     string           `json:"customer_ref,omitempty"` // cart customer ID (carts use string IDs)
+	Region          string           `json:"region,omitempty"`       // tax region, e.g. "CA"
+	Pricing         *PriceBreakdown  `json:"pricing,omitempty"`
+	Refunds         []Refund         `json:"refunds,omitempty"`
+	CallbackURL     string           `json:"callback_url,omitempty"` // receives the signed order.* webhook
+	Processing      *OrderProcessing `json:"processing,omitempty"`   // set by the Lambda processor
+	Saga            *Saga            `json:"saga,omitempty"`         // fulfillment progress, see saga.go
+	Lane            string           `json:"lane,omitempty"`         // "premium" or "standard", set by the server
+}
+
+// Total returns the amount to charge: the priced total when the order has
+// been through the pricing engine, otherwise the sum of its line items
+func (o *Order) Total() float64 {
+	if o.Pricing != nil {
+		return o.Pricing.Total
+	}
+	total := 0.0
+	for _, item := range o.Items {
+		total += float64(item.Quantity) * item.Price
+	}
+	return total
+}
+
+// LinePrice is the priced form of one order or cart line
+type LinePrice struct {
+	ProductID string  `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	Subtotal  float64 `json:"subtotal"`
+	Discount  float64 `json:"discount"`
+	Tax       float64 `json:"tax"`
+	Total     float64 `json:"total"`
+}
+
+// PriceBreakdown is the full price of an order or cart. Total is what the
+// customer is charged.
+type PriceBreakdown struct {
+	Lines      []LinePrice `json:"lines"`
+	Subtotal   float64     `json:"subtotal"`
+	Discount   float64     `json:"discount"`
+	Shipping   float64     `json:"shipping"`
+	Tax        float64     `json:"tax"`
+	Total      float64     `json:"total"`
+	Region     string      `json:"region,omitempty"`
+	TaxRate    float64     `json:"tax_rate"`
+	Promotions []string    `json:"promotions,omitempty"`
+}
+
+// Refund is one refund against an order's capture. A pending refund already
+// counts against the refundable amount, so concurrent refunds can't exceed it;
+// one whose outcome was never recorded is later marked unknown.
+type Refund struct {
+	RefundID      string    `json:"refund_id"`
+	Amount        float64   `json:"amount"`
+	Lines         []Item    `json:"lines,omitempty"` // refunded quantities; Price is the refunded unit amount
+	Status        string    `json:"status"`          // pending, succeeded, failed, unknown
+	TransactionID string    `json:"transaction_id,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// OrderProcessing is written by the Lambda order processor: which
+// invocation claimed the order, whether it was a cold start and timings
+type OrderProcessing struct {
+	Processor      string     `json:"processor"`
+	InvocationID   string     `json:"invocation_id,omitempty"`
+	ColdStart      bool       `json:"cold_start"`
+	InitDurationMs int64      `json:"init_duration_ms,omitempty"`
+	Attempts       int        `json:"attempts"`
+	ClaimedAt      time.Time  `json:"claimed_at"`
+	ClaimExpiresAt time.Time  `json:"claim_expires_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	DurationMs     int64      `json:"duration_ms,omitempty"`
+}
+
+// RoundCents rounds a money amount to whole cents
+func RoundCents(x float64) float64 {
+	return math.Round(x*100) / 100
+}
+
+// NewID returns a random ID such as "order-1f2e3d4c5b6a7988"
+func NewID(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(b)[:16])
+}
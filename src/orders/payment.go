@@ -0,0 +1,219 @@
+package orders
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PaymentGateway is the payment provider. Authorize holds funds, Capture
+// settles them, Void releases an uncaptured authorization and Refund
+// returns money from a capture.
+type PaymentGateway interface {
+	Authorize(ctx context.Context, order *Order) (string, error)
+	Capture(ctx context.Context, authorizationID string) (string, error)
+	Void(ctx context.Context, authorizationID string) error
+	Refund(ctx context.Context, captureID string, amount float64) (string, error)
+}
+
+// Charge authorizes and captures the order, recording the gateway
+// transaction IDs on it. If beforeCapture returns an error, or the capture
+// fails, the authorization is voided so nothing is captured.
+func Charge(ctx context.Context, gateway PaymentGateway, order *Order, beforeCapture func() error) error {
+	authID, err := gateway.Authorize(ctx, order)
+	if err != nil {
+		return fmt.Errorf("authorize: %w", err)
+	}
+	order.AuthorizationID = authID
+
+	if beforeCapture != nil {
+		if err := beforeCapture(); err != nil {
+			if voidErr := gateway.Void(ctx, authID); voidErr != nil {
+				fmt.Printf("Warning: failed to void authorization %s: %v\n", authID, voidErr)
+			}
+			return err
+		}
+	}
+
+	captureID, err := gateway.Capture(ctx, authID)
+	if err != nil {
+		if voidErr := gateway.Void(ctx, authID); voidErr != nil {
+			fmt.Printf("Warning: failed to void authorization %s: %v\n", authID, voidErr)
+		}
+		return fmt.Errorf("capture: %w", err)
+	}
+	order.CaptureID = captureID
+
+	return nil
+}
+
+// PaymentProcessor simulates a payment service with limited throughput:
+// at most cap(semaphore) authorizations run at once, each taking Delay.
+// It remembers only the last MaxTracked authorizations, and forgets voided
+// and fully refunded ones right away, so long load tests don't grow memory;
+// forgotten IDs fail like unknown ones.
+type PaymentProcessor struct {
+	Delay      time.Duration
+	MaxTracked int
+
+	semaphore      chan struct{}
+	mu             sync.Mutex
+	processed      int
+	failed         int
+	authorizations map[string]*simulatedAuthorization
+	captures       map[string]*simulatedAuthorization
+	tracked        []string // authorization IDs, oldest first
+}
+
+// simulatedAuthorization tracks one authorization through capture, void and refunds
+type simulatedAuthorization struct {
+	id        string
+	captureID string
+	orderID   string
+	amount    float64
+	status    string // authorized, captured, voided
+	refunded  float64
+}
+
+// NewPaymentProcessor returns a simulator taking 3 seconds per payment
+func NewPaymentProcessor(maxConcurrent int) *PaymentProcessor {
+	return &PaymentProcessor{
+		Delay:          3 * time.Second,
+		MaxTracked:     10000,
+		semaphore:      make(chan struct{}, maxConcurrent),
+		authorizations: make(map[string]*simulatedAuthorization),
+		captures:       make(map[string]*simulatedAuthorization),
+	}
+}
+
+// Authorize holds funds for the order. This is the slow, throughput-limited step.
+func (pp *PaymentProcessor) Authorize(ctx context.Context, order *Order) (string, error) {
+	// Try to acquire semaphore (this will block if at capacity)
+	select {
+	case pp.semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-pp.semaphore }()
+
+	// Simulate the payment verification delay
+	select {
+	case <-time.After(pp.Delay):
+	case <-ctx.Done():
+		pp.recordFailure()
+		return "", ctx.Err()
+	}
+
+	authID := NewID("auth")
+	pp.mu.Lock()
+	pp.authorizations[authID] = &simulatedAuthorization{
+		id:      authID,
+		orderID: order.OrderID,
+		amount:  order.Total(),
+		status:  "authorized",
+	}
+	pp.tracked = append(pp.tracked, authID)
+	for len(pp.tracked) > pp.MaxTracked {
+		if oldest, ok := pp.authorizations[pp.tracked[0]]; ok {
+			pp.forget(oldest)
+		}
+		pp.tracked = pp.tracked[1:]
+	}
+	pp.mu.Unlock()
+
+	return authID, nil
+}
+
+// Capture settles a previous authorization
+func (pp *PaymentProcessor) Capture(ctx context.Context, authorizationID string) (string, error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	auth, ok := pp.authorizations[authorizationID]
+	if !ok {
+		pp.failed++
+		return "", fmt.Errorf("authorization %s not found", authorizationID)
+	}
+	if auth.status != "authorized" {
+		pp.failed++
+		return "", fmt.Errorf("authorization %s is %s", authorizationID, auth.status)
+	}
+
+	captureID := NewID("cap")
+	auth.status = "captured"
+	auth.captureID = captureID
+	pp.captures[captureID] = auth
+	pp.processed++
+
+	return captureID, nil
+}
+
+// Void releases an authorization that has not been captured
+func (pp *PaymentProcessor) Void(ctx context.Context, authorizationID string) error {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	auth, ok := pp.authorizations[authorizationID]
+	if !ok {
+		return fmt.Errorf("authorization %s not found", authorizationID)
+	}
+	if auth.status != "authorized" {
+		return fmt.Errorf("authorization %s is %s", authorizationID, auth.status)
+	}
+
+	auth.status = "voided"
+	pp.forget(auth)
+	return nil
+}
+
+// Refund returns part or all of a captured amount
+func (pp *PaymentProcessor) Refund(ctx context.Context, captureID string, amount float64) (string, error) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	auth, ok := pp.captures[captureID]
+	if !ok {
+		return "", fmt.Errorf("capture %s not found", captureID)
+	}
+	if amount <= 0 || auth.refunded+amount > auth.amount+0.005 {
+		return "", fmt.Errorf("refund of %.2f exceeds refundable amount %.2f", amount, auth.amount-auth.refunded)
+	}
+
+	auth.refunded += amount
+	if auth.refunded >= auth.amount-0.005 {
+		pp.forget(auth)
+	}
+	return NewID("ref"), nil
+}
+
+// forget drops a settled authorization; the caller holds mu
+func (pp *PaymentProcessor) forget(auth *simulatedAuthorization) {
+	delete(pp.authorizations, auth.id)
+	if auth.captureID != "" {
+		delete(pp.captures, auth.captureID)
+	}
+}
+
+func (pp *PaymentProcessor) recordFailure() {
+	pp.mu.Lock()
+	pp.failed++
+	pp.mu.Unlock()
+}
+
+// Stats returns how many payments were captured and how many failed
+func (pp *PaymentProcessor) Stats() (processed, failed int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.processed, pp.failed
+}
+
+// InUse is the number of authorizations currently running
+func (pp *PaymentProcessor) InUse() int {
+	return len(pp.semaphore)
+}
+
+// Capacity is the maximum number of concurrent authorizations
+func (pp *PaymentProcessor) Capacity() int {
+	return cap(pp.semaphore)
+}
@@ -0,0 +1,36 @@
+package orders
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPaymentProcessor_ForgetsSettledAuthorizations(t *testing.T) {
+	ctx := context.Background()
+	pp := NewPaymentProcessor(1)
+	pp.Delay = 0
+	pp.MaxTracked = 3
+	order := &Order{OrderID: "o1", Items: []Item{{ProductID: "1", Quantity: 1, Price: 10}}}
+
+	voided, _ := pp.Authorize(ctx, order)
+	pp.Void(ctx, voided)
+	refunded, _ := pp.Authorize(ctx, order)
+	capture, _ := pp.Capture(ctx, refunded)
+	pp.Refund(ctx, capture, 10)
+	if len(pp.authorizations) != 0 || len(pp.captures) != 0 {
+		t.Fatalf("voided and refunded payments kept: %d authorizations, %d captures", len(pp.authorizations), len(pp.captures))
+	}
+
+	var last string
+	for i := 0; i < 10; i++ {
+		last, _ = pp.Authorize(ctx, order)
+		pp.Capture(ctx, last)
+	}
+	if len(pp.authorizations) != 3 || len(pp.captures) != 3 || len(pp.tracked) != 3 {
+		t.Fatalf("expected 3 tracked payments, got %d authorizations, %d captures, %d IDs",
+			len(pp.authorizations), len(pp.captures), len(pp.tracked))
+	}
+	if auth, ok := pp.authorizations[last]; !ok || auth.status != "captured" {
+		t.Fatal("newest authorization should still be tracked")
+	}
+}
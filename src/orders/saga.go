@@ -0,0 +1,59 @@
+package orders
+
+import "time"
+
+// Fulfillment saga steps, in the order they run. Each completed step is
+// recorded on the order so a processor that crashes part way through
+// resumes after the last completed step instead of starting over.
+const (
+	StepReserveStock = "reserve_stock"
+	StepAuthorize    = "authorize_payment"
+	StepCapture      = "capture_payment"
+	StepCheckoutCart = "checkout_cart"
+)
+
+// Step and saga states
+const (
+	SagaPending      = "pending"      // step not run yet, or failed and will be retried
+	SagaRunning      = "running"      // step started; a crash leaves it here and it is run again
+	SagaDone         = "done"         // step completed
+	SagaCompensated  = "compensated"  // step undone after a later step failed
+	SagaCompleted    = "completed"    // every step done
+	SagaCompensating = "compensating" // undoing completed steps
+)
+
+// SagaStep is the persisted state of one step
+type SagaStep struct {
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Saga is the fulfillment progress of an order. Status is running,
+// compensating, completed or compensated; Reason says why it compensated.
+type Saga struct {
+	Status string     `json:"status"`
+	Reason string     `json:"reason,omitempty"`
+	Steps  []SagaStep `json:"steps"`
+}
+
+// NewSaga starts a saga with every step pending
+func NewSaga(steps ...string) *Saga {
+	s := &Saga{Status: SagaRunning}
+	for _, name := range steps {
+		s.Steps = append(s.Steps, SagaStep{Name: name, Status: SagaPending})
+	}
+	return s
+}
+
+// Step returns the named step, or nil if the saga has no such step
+func (s *Saga) Step(name string) *SagaStep {
+	for i := range s.Steps {
+		if s.Steps[i].Name == name {
+			return &s.Steps[i]
+		}
+	}
+	return nil
+}
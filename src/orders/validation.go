@@ -0,0 +1,82 @@
+package orders
+
+import (
+	"fmt"
+	"math"
+)
+
+// Limits bounds the size of an order
+type Limits struct {
+	MaxLines        int
+	MaxLineQuantity int
+}
+
+// DefaultLimits are used when no other limits are configured
+var DefaultLimits = Limits{MaxLines: 50, MaxLineQuantity: 100}
+
+// PriceTolerance absorbs float rounding between client and catalog prices
+const PriceTolerance = 0.005
+
+// Catalog looks up the current price of a product
+type Catalog interface {
+	Price(productID string) (float64, bool)
+}
+
+// LineError explains why one line (1-based) of an order was rejected.
+// Line is omitted for errors about the order as a whole.
+type LineError struct {
+	Line         int     `json:"line,omitempty"`
+	ProductID    string  `json:"product_id,omitempty"`
+	Code         string  `json:"code"`
+	Message      string  `json:"message"`
+	CatalogPrice float64 `json:"catalog_price,omitempty"`
+}
+
+// Validate checks every line and, given a catalog, replaces line prices
+// with catalog prices. A line without a price is simply priced; a client
+// price that differs from the catalog is rejected so the customer never
+// pays an amount they weren't shown. Without a catalog (the Lambda) only
+// the shape of the order is checked.
+func Validate(o *Order, catalog Catalog, limits Limits) []LineError {
+	if len(o.Items) == 0 {
+		return []LineError{{Code: "no_items", Message: "order must contain at least one item"}}
+	}
+	if len(o.Items) > limits.MaxLines {
+		return []LineError{{Code: "too_many_lines", Message: fmt.Sprintf("order may contain at most %d lines", limits.MaxLines)}}
+	}
+
+	var errs []LineError
+	for i := range o.Items {
+		item := &o.Items[i]
+		line := i + 1
+
+		price, known := 0.0, true
+		if catalog != nil {
+			price, known = catalog.Price(item.ProductID)
+		}
+		if !known {
+			errs = append(errs, LineError{Line: line, ProductID: item.ProductID, Code: "unknown_product",
+				Message: "product does not exist"})
+			continue
+		}
+		if item.Quantity < 1 || item.Quantity > limits.MaxLineQuantity {
+			errs = append(errs, LineError{Line: line, ProductID: item.ProductID, Code: "invalid_quantity",
+				Message: fmt.Sprintf("quantity must be between 1 and %d", limits.MaxLineQuantity)})
+			continue
+		}
+		if catalog == nil {
+			if item.Price < 0 {
+				errs = append(errs, LineError{Line: line, ProductID: item.ProductID, Code: "invalid_price",
+					Message: "price must not be negative"})
+			}
+			continue
+		}
+		if item.Price != 0 && math.Abs(item.Price-price) > PriceTolerance {
+			errs = append(errs, LineError{Line: line, ProductID: item.ProductID, Code: "price_changed",
+				Message: fmt.Sprintf("price %.2f does not match catalog price %.2f", item.Price, price), CatalogPrice: price})
+			continue
+		}
+		item.Price = price
+	}
+	return errs
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Outbox destinations. Each maps to the Publisher the relay delivers to.
+const (
+	outboxOrders     = "orders"
+	outboxCartEvents = "cart-events"
+)
+
+// cartEventPublisher receives cart lifecycle events. It is nil unless
+// CART_EVENTS_TOPIC_ARN is set, and checkout only records cart events when
+// it isn't, so they are never relayed into the void.
+var cartEventPublisher Publisher
+
+func outboxPublisher(destination string) (Publisher, bool) {
+	switch destination {
+	case outboxOrders:
+		return orderPublisher, true
+	case outboxCartEvents:
+		return cartEventPublisher, cartEventPublisher != nil
+	default:
+		return nil, false
+	}
+}
+
+// enqueueOutboxEvent records an event in the caller's transaction. The relay
+// publishes it only after the transaction commits.
+func enqueueOutboxEvent(tx *sql.Tx, destination, eventType, aggregateID string, payload []byte, attributes map[string]string) error {
+	var attrJSON []byte
+	if len(attributes) > 0 {
+		var err error
+		if attrJSON, err = json.Marshal(attributes); err != nil {
+			return fmt.Errorf("failed to serialize event attributes: %w", err)
+		}
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO outbox (destination, event_type, aggregate_id, payload, attributes)
+		VALUES (?, ?, ?, ?, ?)`,
+		destination, eventType, aggregateID, string(payload), nullableJSON(attrJSON))
+	if err != nil {
+		return fmt.Errorf("failed to write outbox event: %w", err)
+	}
+	return nil
+}
+
+func nullableJSON(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+// outboxRelay publishes pending outbox rows in id order. Only one relay
+// across all API tasks is active at a time, elected with a MySQL named lock.
+//
+// AUTO_INCREMENT ids are assigned at insert, not at commit, so a row can
+// become visible after a row with a higher id. The relay therefore tracks
+// the highest id it has handled (the watermark) and waits up to gapTimeout
+// for a missing id above it before moving on; gaps left by rolled back
+// transactions cost that wait once.
+type outboxRelay struct {
+	store        outboxStore
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	gapTimeout   time.Duration
+	retention    time.Duration
+
+	watermark int64     // highest id published, failed or rescheduled; -1 until loaded
+	gapSince  time.Time // when the relay started waiting for watermark+1
+	lastPurge time.Time
+
+	mu        sync.Mutex
+	leader    bool
+	published int
+	retried   int
+	failed    int
+	skipped   int // gaps given up on
+	purged    int64
+}
+
+const outboxLockName = "order_outbox_relay"
+
+var orderOutbox = &outboxRelay{
+	store:        sqlOutboxStore{},
+	pollInterval: time.Duration(getEnvInt("OUTBOX_POLL_MS", 500)) * time.Millisecond,
+	batchSize:    getEnvInt("OUTBOX_BATCH_SIZE", 50),
+	maxAttempts:  getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+	baseDelay:    time.Second,
+	maxDelay:     time.Minute,
+	gapTimeout:   time.Duration(getEnvInt("OUTBOX_GAP_MS", 5000)) * time.Millisecond,
+	retention:    time.Duration(getEnvInt("OUTBOX_RETENTION_HOURS", 24)) * time.Hour,
+	watermark:    -1,
+}
+
+func (r *outboxRelay) snapshot() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return map[string]interface{}{
+		"leader":    r.leader,
+		"published": r.published,
+		"retried":   r.retried,
+		"failed":    r.failed,
+		"skipped":   r.skipped,
+		"purged":    r.purged,
+	}
+}
+
+func (r *outboxRelay) count(field *int) {
+	r.mu.Lock()
+	*field++
+	r.mu.Unlock()
+}
+
+func (r *outboxRelay) setLeader(leader bool) {
+	r.mu.Lock()
+	r.leader = leader
+	r.mu.Unlock()
+}
+
+// startOutboxRelay runs the relay until ctx is cancelled. The returned
+// channel is closed once it has stopped.
+func startOutboxRelay(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		orderOutbox.run(ctx)
+	}()
+	return done
+}
+
+func (r *outboxRelay) run(ctx context.Context) {
+	fmt.Printf("📤 Outbox relay started (poll every %v)\n", r.pollInterval)
+
+	for ctx.Err() == nil {
+		conn, err := r.acquireLeadership(ctx, 0)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("Outbox relay: leadership check failed: %v\n", err)
+			}
+		}
+		if conn == nil {
+			sleepContext(ctx, 5*r.pollInterval)
+			continue
+		}
+
+		r.setLeader(true)
+		r.watermark = -1 // another relay may have run in between
+		r.lead(ctx, conn)
+		r.setLeader(false)
+
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", outboxLockName)
+		conn.Close()
+	}
+}
+
+// acquireLeadership returns a connection holding the relay lock, or nil if
+// another task still has it after waiting up to wait
+func (r *outboxRelay) acquireLeadership(ctx context.Context, wait time.Duration) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", outboxLockName, wait.Seconds()).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if acquired.Int64 != 1 {
+		conn.Close()
+		return nil, nil
+	}
+	return conn, nil
+}
+
+// flushOutbox publishes pending rows before a Lambda invocation returns:
+// between invocations the runtime freezes the process, so a background
+// relay would stall with the lock held. It waits briefly for a relay that
+// holds the lock; one that is done flushing releases it right away, and rows
+// it missed are published here.
+func flushOutbox(ctx context.Context) error {
+	r := orderOutbox
+	conn, err := r.acquireLeadership(ctx, time.Second)
+	if err != nil || conn == nil {
+		return err
+	}
+	defer func() {
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", outboxLockName)
+		conn.Close()
+	}()
+
+	// Other invocations relay in between. The gap timer keeps running while
+	// the watermark stays put, so a rolled back row is only waited for once.
+	watermark, err := r.store.Watermark(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load outbox watermark: %w", err)
+	}
+	if watermark != r.watermark {
+		r.watermark, r.gapSince = watermark, time.Time{}
+	}
+	for {
+		published, err := r.relayBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if published < r.batchSize {
+			return r.purgeSent(ctx)
+		}
+	}
+}
+
+// lead relays batches while the lock connection stays healthy
+func (r *outboxRelay) lead(ctx context.Context, conn *sql.Conn) {
+	for ctx.Err() == nil {
+		if err := conn.PingContext(ctx); err != nil {
+			fmt.Printf("Outbox relay: lost lock connection: %v\n", err)
+			return
+		}
+
+		published, err := r.relayBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Outbox relay: %v\n", err)
+		}
+		if err := r.purgeSent(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("Outbox relay: %v\n", err)
+		}
+		if published < r.batchSize {
+			sleepContext(ctx, r.pollInterval)
+		}
+	}
+}
+
+type outboxRow struct {
+	id          int64
+	destination string
+	eventType   string
+	aggregateID string
+	payload     string
+	attributes  map[string]string
+	attempts    int
+	ready       bool
+}
+
+// relayBatch publishes pending rows oldest first. A row that fails is
+// rescheduled with backoff and the batch stops there, so later events are
+// never published ahead of it; the batch also stops at an id gap until it
+// fills or times out. Rows that exhaust their attempts are marked failed
+// and skipped.
+func (r *outboxRelay) relayBatch(ctx context.Context) (int, error) {
+	if r.watermark < 0 {
+		watermark, err := r.store.Watermark(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load outbox watermark: %w", err)
+		}
+		r.watermark, r.gapSince = watermark, time.Time{}
+	}
+
+	batch, err := r.store.Pending(ctx, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, row := range batch {
+		if !row.ready {
+			break
+		}
+		if row.id > r.watermark+1 {
+			if r.gapSince.IsZero() {
+				r.gapSince = time.Now()
+			}
+			if time.Since(r.gapSince) < r.gapTimeout {
+				// An earlier transaction may still commit its row
+				return published, nil
+			}
+			r.count(&r.skipped)
+			fmt.Printf("Outbox relay: ids %d..%d never appeared, moving on\n", r.watermark+1, row.id-1)
+		}
+
+		pubErr := r.publish(ctx, row)
+		if pubErr == nil {
+			if err := r.store.MarkSent(ctx, row.id); err != nil {
+				// The event may be published again; consumers must tolerate duplicates
+				return published, fmt.Errorf("failed to mark outbox row %d sent: %w", row.id, err)
+			}
+			r.advance(row.id)
+			r.count(&r.published)
+			published++
+			continue
+		}
+
+		attempts := row.attempts + 1
+		if attempts >= r.maxAttempts {
+			fmt.Printf("Outbox relay: giving up on %s event %d after %d attempts: %v\n", row.eventType, row.id, attempts, pubErr)
+			if err := r.store.MarkFailed(ctx, row.id, attempts, truncate(pubErr.Error(), 500)); err != nil {
+				return published, fmt.Errorf("failed to mark outbox row %d failed: %w", row.id, err)
+			}
+			r.advance(row.id)
+			r.count(&r.failed)
+			continue
+		}
+
+		delay := retryPolicy{maxReceives: r.maxAttempts, baseDelay: r.baseDelay, maxDelay: r.maxDelay}.backoff(attempts)
+		if err := r.store.Reschedule(ctx, row.id, attempts, truncate(pubErr.Error(), 500), delay); err != nil {
+			return published, fmt.Errorf("failed to reschedule outbox row %d: %w", row.id, err)
+		}
+		r.advance(row.id)
+		r.count(&r.retried)
+		return published, fmt.Errorf("publish of %s event %d failed, retrying in %v: %w", row.eventType, row.id, delay, pubErr)
+	}
+	return published, nil
+}
+
+// advance moves the watermark past a handled row. Rows below it (late
+// commits after a gap timed out) don't move it back.
+func (r *outboxRelay) advance(id int64) {
+	if id > r.watermark {
+		r.watermark, r.gapSince = id, time.Time{}
+	}
+}
+
+// purgeSent deletes sent rows older than the retention, at most every
+// few minutes. The watermark row is kept so a new leader can load it.
+func (r *outboxRelay) purgeSent(ctx context.Context) error {
+	if time.Since(r.lastPurge) < 5*time.Minute || r.watermark <= 0 {
+		return nil
+	}
+	r.lastPurge = time.Now()
+	n, err := r.store.Purge(ctx, time.Now().Add(-r.retention), r.watermark)
+	if err != nil {
+		return fmt.Errorf("failed to purge sent outbox rows: %w", err)
+	}
+	r.mu.Lock()
+	r.purged += n
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *outboxRelay) publish(ctx context.Context, row outboxRow) error {
+	publisher, ok := outboxPublisher(row.destination)
+	if !ok {
+		return fmt.Errorf("unknown outbox destination %q", row.destination)
+	}
+
+	attributes := map[string]string{"event_type": row.eventType}
+	for k, v := range row.attributes {
+		attributes[k] = v
+	}
+	_, err := publisher.Publish(ctx, row.payload, attributes)
+	return err
+}
+
+// outboxStore is where the relay reads and updates outbox rows
+type outboxStore interface {
+	// Watermark is the highest id already handled by a relay, 0 if none
+	Watermark(ctx context.Context) (int64, error)
+	// Pending returns up to limit pending rows in id order
+	Pending(ctx context.Context, limit int) ([]outboxRow, error)
+	MarkSent(ctx context.Context, id int64) error
+	MarkFailed(ctx context.Context, id int64, attempts int, lastError string) error
+	Reschedule(ctx context.Context, id int64, attempts int, lastError string, delay time.Duration) error
+	// Purge deletes rows sent before the cutoff with ids below belowID
+	Purge(ctx context.Context, sentBefore time.Time, belowID int64) (int64, error)
+}
+
+// sqlOutboxStore is the MySQL outbox table
+type sqlOutboxStore struct{}
+
+func (sqlOutboxStore) Watermark(ctx context.Context) (int64, error) {
+	var id sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MAX(id) FROM outbox WHERE status <> 'pending' OR attempts > 0").Scan(&id)
+	return id.Int64, err
+}
+
+func (sqlOutboxStore) Pending(ctx context.Context, limit int) ([]outboxRow, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, destination, event_type, aggregate_id, payload, attributes, attempts,
+			available_at <= NOW(3) AS ready
+		FROM outbox
+		WHERE status = 'pending'
+		ORDER BY id
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	var batch []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		var attrJSON sql.NullString
+		if err := rows.Scan(&row.id, &row.destination, &row.eventType, &row.aggregateID,
+			&row.payload, &attrJSON, &row.attempts, &row.ready); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox row: %w", err)
+		}
+		if attrJSON.Valid {
+			json.Unmarshal([]byte(attrJSON.String), &row.attributes)
+		}
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
+func (sqlOutboxStore) MarkSent(ctx context.Context, id int64) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE outbox SET status = 'sent', attempts = attempts + 1, sent_at = NOW(), last_error = NULL
+		WHERE id = ?`, id)
+	return err
+}
+
+func (sqlOutboxStore) MarkFailed(ctx context.Context, id int64, attempts int, lastError string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE outbox SET status = 'failed', attempts = ?, last_error = ? WHERE id = ?`,
+		attempts, lastError, id)
+	return err
+}
+
+func (sqlOutboxStore) Reschedule(ctx context.Context, id int64, attempts int, lastError string, delay time.Duration) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE outbox SET attempts = ?, last_error = ?, available_at = NOW(3) + INTERVAL ? MICROSECOND
+		WHERE id = ?`,
+		attempts, lastError, delay.Microseconds(), id)
+	return err
+}
+
+func (sqlOutboxStore) Purge(ctx context.Context, sentBefore time.Time, belowID int64) (int64, error) {
+	result, err := db.ExecContext(ctx, `
+		DELETE FROM outbox WHERE status = 'sent' AND sent_at < ? AND id < ? LIMIT 1000`,
+		sentBefore, belowID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
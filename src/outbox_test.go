@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// fakeOutboxStore keeps outbox rows in memory; rows are "committed" by add
+type fakeOutboxStore struct {
+	rows       map[int64]*fakeOutboxRow
+	failWrites error
+}
+
+type fakeOutboxRow struct {
+	outboxRow
+	status      string
+	availableAt time.Time
+	sentAt      time.Time
+}
+
+func newFakeOutboxStore() *fakeOutboxStore {
+	return &fakeOutboxStore{rows: make(map[int64]*fakeOutboxRow)}
+}
+
+func (s *fakeOutboxStore) add(id int64, destination, aggregateID string) {
+	s.rows[id] = &fakeOutboxRow{
+		outboxRow: outboxRow{id: id, destination: destination, eventType: "test.event", aggregateID: aggregateID, payload: fmt.Sprintf(`{"id":%d}`, id)},
+		status:    "pending",
+	}
+}
+
+func (s *fakeOutboxStore) Watermark(ctx context.Context) (int64, error) {
+	var max int64
+	for id, row := range s.rows {
+		if (row.status != "pending" || row.attempts > 0) && id > max {
+			max = id
+		}
+	}
+	return max, nil
+}
+
+func (s *fakeOutboxStore) Pending(ctx context.Context, limit int) ([]outboxRow, error) {
+	var batch []outboxRow
+	for _, row := range s.rows {
+		if row.status == "pending" {
+			r := row.outboxRow
+			r.ready = !row.availableAt.After(time.Now())
+			batch = append(batch, r)
+		}
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].id < batch[j].id })
+	if len(batch) > limit {
+		batch = batch[:limit]
+	}
+	return batch, nil
+}
+
+func (s *fakeOutboxStore) MarkSent(ctx context.Context, id int64) error {
+	if s.failWrites != nil {
+		return s.failWrites
+	}
+	s.rows[id].status, s.rows[id].sentAt = "sent", time.Now()
+	s.rows[id].attempts++
+	return nil
+}
+
+func (s *fakeOutboxStore) MarkFailed(ctx context.Context, id int64, attempts int, lastError string) error {
+	if s.failWrites != nil {
+		return s.failWrites
+	}
+	s.rows[id].status, s.rows[id].attempts = "failed", attempts
+	return nil
+}
+
+func (s *fakeOutboxStore) Reschedule(ctx context.Context, id int64, attempts int, lastError string, delay time.Duration) error {
+	if s.failWrites != nil {
+		return s.failWrites
+	}
+	s.rows[id].attempts, s.rows[id].availableAt = attempts, time.Now().Add(delay)
+	return nil
+}
+
+func (s *fakeOutboxStore) Purge(ctx context.Context, sentBefore time.Time, belowID int64) (int64, error) {
+	var n int64
+	for id, row := range s.rows {
+		if row.status == "sent" && row.sentAt.Before(sentBefore) && id < belowID {
+			delete(s.rows, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// recordingPublisher records published bodies and fails while err is set
+type recordingPublisher struct {
+	bodies []string
+	err    error
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	p.bodies = append(p.bodies, body)
+	return fmt.Sprintf("msg-%d", len(p.bodies)), nil
+}
+
+func withOutbox(t *testing.T) (*outboxRelay, *fakeOutboxStore, *recordingPublisher) {
+	store, publisher := newFakeOutboxStore(), &recordingPublisher{}
+	previousOrders, previousCarts := orderPublisher, cartEventPublisher
+	orderPublisher, cartEventPublisher = publisher, nil
+	t.Cleanup(func() { orderPublisher, cartEventPublisher = previousOrders, previousCarts })
+	relay := &outboxRelay{
+		store: store, batchSize: 10, maxAttempts: 3,
+		baseDelay: time.Millisecond, maxDelay: time.Millisecond,
+		gapTimeout: 50 * time.Millisecond, retention: time.Hour, watermark: -1,
+	}
+	return relay, store, publisher
+}
+
+func TestOutboxRelay_PublishesInOrder(t *testing.T) {
+	ctx := context.Background()
+	relay, store, publisher := withOutbox(t)
+	store.add(1, outboxOrders, "o1")
+	store.add(2, outboxOrders, "o2")
+
+	if n, err := relay.relayBatch(ctx); n != 2 || err != nil {
+		t.Fatalf("expected 2 published, got %d (%v)", n, err)
+	}
+	if len(publisher.bodies) != 2 || publisher.bodies[0] != `{"id":1}` || store.rows[2].status != "sent" {
+		t.Fatalf("unexpected publish: %v", publisher.bodies)
+	}
+}
+
+func TestOutboxRelay_WaitsForUncommittedRow(t *testing.T) {
+	ctx := context.Background()
+	relay, store, publisher := withOutbox(t)
+	store.add(1, outboxOrders, "o1")
+	relay.relayBatch(ctx)
+
+	// Row 3 committed while row 2's transaction is still open
+	store.add(3, outboxOrders, "o3")
+	if n, _ := relay.relayBatch(ctx); n != 0 {
+		t.Fatal("row 3 published ahead of row 2")
+	}
+	store.add(2, outboxOrders, "o2")
+	relay.relayBatch(ctx)
+	if len(publisher.bodies) != 3 || publisher.bodies[1] != `{"id":2}` || publisher.bodies[2] != `{"id":3}` {
+		t.Fatalf("expected commit gap to be filled in order, got %v", publisher.bodies)
+	}
+
+	// Row 4 rolled back: the relay moves on once the gap times out
+	store.add(5, outboxOrders, "o5")
+	relay.relayBatch(ctx)
+	time.Sleep(60 * time.Millisecond)
+	if n, _ := relay.relayBatch(ctx); n != 1 || relay.snapshot()["skipped"] != 1 {
+		t.Fatalf("expected row 5 after the gap timeout, got %v", publisher.bodies)
+	}
+}
+
+func TestOutboxRelay_RetriesThenFails(t *testing.T) {
+	ctx := context.Background()
+	relay, store, publisher := withOutbox(t)
+	store.add(1, outboxOrders, "o1")
+	store.add(2, outboxOrders, "o2")
+	publisher.err = errors.New("topic unavailable")
+
+	if _, err := relay.relayBatch(ctx); err == nil || store.rows[1].attempts != 1 || store.rows[2].attempts != 0 {
+		t.Fatalf("expected row 1 rescheduled and row 2 held back, got %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	relay.relayBatch(ctx)
+	time.Sleep(5 * time.Millisecond)
+	relay.relayBatch(ctx)
+	// Row 1 gave up after 3 attempts, so row 2 is no longer held back
+	if store.rows[1].status != "failed" || store.rows[2].status != "pending" || store.rows[2].attempts != 1 {
+		t.Fatalf("unexpected rows: %+v %+v", *store.rows[1], *store.rows[2])
+	}
+}
+
+func TestOutboxRelay_ReportsStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	relay, store, publisher := withOutbox(t)
+	store.add(1, outboxOrders, "o1")
+	publisher.err = errors.New("topic unavailable")
+	store.failWrites = errors.New("connection lost")
+
+	if _, err := relay.relayBatch(ctx); err == nil || !errors.Is(err, store.failWrites) {
+		t.Fatalf("expected reschedule failure to be returned, got %v", err)
+	}
+}
+
+func TestOutboxRelay_CartEventsNeedAPublisher(t *testing.T) {
+	ctx := context.Background()
+	relay, store, _ := withOutbox(t)
+	store.add(1, outboxCartEvents, "cart-1")
+
+	// Without a publisher the event is retried, never marked sent
+	if _, err := relay.relayBatch(ctx); err == nil || store.rows[1].status != "pending" {
+		t.Fatalf("cart event without a publisher was dropped: %v", err)
+	}
+
+	carts := &recordingPublisher{}
+	cartEventPublisher = carts
+	time.Sleep(5 * time.Millisecond)
+	relay.relayBatch(ctx)
+	if len(carts.bodies) != 1 || store.rows[1].status != "sent" {
+		t.Fatalf("expected cart event published, got %v", carts.bodies)
+	}
+}
+
+func TestOutboxRelay_PurgesSentRows(t *testing.T) {
+	ctx := context.Background()
+	relay, store, _ := withOutbox(t)
+	for id := int64(1); id <= 3; id++ {
+		store.add(id, outboxOrders, "o")
+	}
+	relay.relayBatch(ctx)
+	relay.retention = 0
+
+	if err := relay.purgeSent(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The newest sent row stays behind as the watermark
+	if _, ok := store.rows[3]; len(store.rows) != 1 || !ok {
+		t.Fatalf("expected only the watermark row left, got %d rows", len(store.rows))
+	}
+	if watermark, _ := store.Watermark(ctx); watermark != 3 {
+		t.Fatalf("watermark lost after purge: %d", watermark)
+	}
+}
+
+func TestFlushOutbox_PublishesWithinTheRequest(t *testing.T) {
+	ctx := context.Background()
+	_, store, publisher := withOutbox(t)
+	fake := withFakeSQL(t)
+	fake.onQuery("GET_LOCK", []string{"acquired"}, []driver.Value{int64(1)})
+	previousStore, previousGap, previousWatermark := orderOutbox.store, orderOutbox.gapTimeout, orderOutbox.watermark
+	orderOutbox.store, orderOutbox.gapTimeout, orderOutbox.watermark = store, 20*time.Millisecond, -1
+	t.Cleanup(func() {
+		orderOutbox.store, orderOutbox.gapTimeout, orderOutbox.watermark = previousStore, previousGap, previousWatermark
+	})
+
+	// Row 2 was rolled back
+	store.add(1, outboxOrders, "o1")
+	store.add(3, outboxOrders, "o3")
+	if err := flushOutbox(ctx); err != nil || len(publisher.bodies) != 1 {
+		t.Fatalf("expected row 1 published, got %v (%v)", publisher.bodies, err)
+	}
+	if len(fake.executed("RELEASE_LOCK")) != 1 {
+		t.Fatal("relay lock not released after the flush")
+	}
+
+	// Later invocations keep timing the same gap
+	flushOutbox(ctx)
+	time.Sleep(30 * time.Millisecond)
+	if err := flushOutbox(ctx); err != nil || len(publisher.bodies) != 2 {
+		t.Fatalf("expected row 3 after the gap timed out, got %v (%v)", publisher.bodies, err)
+	}
+}
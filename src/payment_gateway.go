@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"text/main/orders"
+)
+
+// PaymentGateway is the payment provider used by both the sync endpoint and
+// the SQS worker (see orders.PaymentGateway)
+type PaymentGateway = orders.PaymentGateway
+
+// paymentGateway is the active gateway; defaults to the in-process simulator
+var paymentGateway PaymentGateway = paymentProcessor
+
+// initPaymentGateway switches to the HTTP gateway when PAYMENT_GATEWAY_URL is set
+func initPaymentGateway() {
+	endpoint := os.Getenv("PAYMENT_GATEWAY_URL")
+	if endpoint == "" {
+		fmt.Printf("💳 Using simulated payment gateway (max %d concurrent)\n", paymentProcessor.Capacity())
+		return
+	}
+
+	paymentGateway = newHTTPPaymentGateway(endpoint)
+	fmt.Printf("💳 Using HTTP payment gateway at %s\n", endpoint)
+}
+
+// chargeOrder authorizes and captures the order, recording the gateway
+// transaction IDs on it. A failed capture voids the authorization.
+func chargeOrder(ctx context.Context, gateway PaymentGateway, order *Order) error {
+	return chargeOrderChecked(ctx, gateway, order, nil)
+}
+
+// chargeOrderChecked is chargeOrder with a check between authorize and
+// capture. If beforeCapture returns an error the authorization is voided
+// and that error returned, so nothing is captured.
+func chargeOrderChecked(ctx context.Context, gateway PaymentGateway, order *Order, beforeCapture func() error) error {
+	return orders.Charge(ctx, gateway, order, beforeCapture)
+}
+
+// httpPaymentGateway talks to an external payment service over JSON/HTTP
+type httpPaymentGateway struct {
+	endpoint string
+	client   *http.Client
+}
+
+type gatewayRequest struct {
+	OrderID         string  `json:"order_id,omitempty"`
+	CustomerID      int     `json:"customer_id,omitempty"`
+	AuthorizationID string  `json:"authorization_id,omitempty"`
+	CaptureID       string  `json:"capture_id,omitempty"`
+	Amount          float64 `json:"amount,omitempty"`
+}
+
+// gatewayError is a non-2xx answer from the payment service
+type gatewayError struct {
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *gatewayError) Error() string {
+	return fmt.Sprintf("gateway %s returned %d: %s", e.Path, e.StatusCode, e.Message)
+}
+
+// declined reports whether the gateway rejected the request itself (4xx),
+// as opposed to being unavailable
+func (e *gatewayError) declined() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests
+}
+
+type gatewayResponse struct {
+	TransactionID string `json:"transaction_id"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+func newHTTPPaymentGateway(endpoint string) *httpPaymentGateway {
+	return &httpPaymentGateway{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (g *httpPaymentGateway) Authorize(ctx context.Context, order *Order) (string, error) {
+	return g.call(ctx, "/authorize", gatewayRequest{
+		OrderID:    order.OrderID,
+		CustomerID: order.CustomerID,
+		Amount:     order.Total(),
+	})
+}
+
+func (g *httpPaymentGateway) Capture(ctx context.Context, authorizationID string) (string, error) {
+	return g.call(ctx, "/capture", gatewayRequest{AuthorizationID: authorizationID})
+}
+
+func (g *httpPaymentGateway) Void(ctx context.Context, authorizationID string) error {
+	_, err := g.call(ctx, "/void", gatewayRequest{AuthorizationID: authorizationID})
+	return err
+}
+
+func (g *httpPaymentGateway) Refund(ctx context.Context, captureID string, amount float64) (string, error) {
+	return g.call(ctx, "/refund", gatewayRequest{CaptureID: captureID, Amount: amount})
+}
+
+// call POSTs the request and returns the transaction ID from the response
+func (g *httpPaymentGateway) call(ctx context.Context, path string, body gatewayRequest) (string, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode gateway request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to build gateway request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("gateway %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	var result gatewayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode < 300 {
+		return "", fmt.Errorf("gateway %s returned invalid response: %w", path, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		if result.Error == "" {
+			result.Error = http.StatusText(resp.StatusCode)
+		}
+		return "", &gatewayError{Path: path, StatusCode: resp.StatusCode, Message: result.Error}
+	}
+
+	return result.TransactionID, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stub payment service recording the calls it receives
+func newStubGatewayServer(t *testing.T, failCapture bool) (*httptest.Server, *[]string) {
+	calls := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req gatewayRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("stub gateway got invalid body: %v", err)
+		}
+		calls = append(calls, r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/capture" && failCapture {
+			w.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(w).Encode(gatewayResponse{Error: "insufficient funds"})
+			return
+		}
+		json.NewEncoder(w).Encode(gatewayResponse{TransactionID: "txn" + r.URL.Path, Status: "ok"})
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestChargeOrder_HTTPGateway(t *testing.T) {
+	server, calls := newStubGatewayServer(t, false)
+	gateway := newHTTPPaymentGateway(server.URL)
+
+	order := &Order{OrderID: "o1", CustomerID: 7, Items: []Item{{ProductID: "1", Quantity: 2, Price: 5}}}
+	if err := chargeOrder(context.Background(), gateway, order); err != nil {
+		t.Fatalf("expected charge to succeed, got %v", err)
+	}
+	if order.AuthorizationID != "txn/authorize" || order.CaptureID != "txn/capture" {
+		t.Fatalf("unexpected transaction IDs: %+v", order)
+	}
+	if len(*calls) != 2 {
+		t.Fatalf("expected authorize and capture calls, got %v", *calls)
+	}
+
+	refundID, err := gateway.Refund(context.Background(), order.CaptureID, 10)
+	if err != nil || refundID != "txn/refund" {
+		t.Fatalf("unexpected refund result: %q, %v", refundID, err)
+	}
+}
+
+func TestChargeOrder_CaptureFailureVoids(t *testing.T) {
+	server, calls := newStubGatewayServer(t, true)
+	gateway := newHTTPPaymentGateway(server.URL)
+
+	order := &Order{OrderID: "o2", Items: []Item{{ProductID: "1", Quantity: 1, Price: 5}}}
+	if err := chargeOrder(context.Background(), gateway, order); err == nil {
+		t.Fatal("expected capture failure")
+	}
+	if order.CaptureID != "" {
+		t.Fatalf("capture ID should be empty, got %q", order.CaptureID)
+	}
+	if got := *calls; len(got) != 3 || got[2] != "/void" {
+		t.Fatalf("expected authorize, capture, void; got %v", got)
+	}
+}
+
+func TestPaymentProcessor_Lifecycle(t *testing.T) {
+	pp := newPaymentProcessor(1)
+	pp.Delay = 0
+
+	order := &Order{OrderID: "o3", Items: []Item{{ProductID: "1", Quantity: 1, Price: 20}}}
+	if err := chargeOrder(context.Background(), pp, order); err != nil {
+		t.Fatalf("expected charge to succeed, got %v", err)
+	}
+	if err := pp.Void(context.Background(), order.AuthorizationID); err == nil {
+		t.Fatal("expected void of captured authorization to fail")
+	}
+	if _, err := pp.Refund(context.Background(), order.CaptureID, 15); err != nil {
+		t.Fatalf("expected partial refund to succeed, got %v", err)
+	}
+	if _, err := pp.Refund(context.Background(), order.CaptureID, 10); err == nil {
+		t.Fatal("expected refund beyond captured amount to fail")
+	}
+	if processed, _ := pp.Stats(); processed != 1 {
+		t.Fatalf("expected 1 processed payment, got %d", processed)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"text/main/orders"
+)
+
+// LinePrice and PriceBreakdown are part of the order wire format
+type (
+	LinePrice      = orders.LinePrice
+	PriceBreakdown = orders.PriceBreakdown
+)
+
+// promotion is a pluggable discount rule. apply adds to Lines[i].Discount
+// and reports whether it applied.
+type promotion interface {
+	name() string
+	apply(b *PriceBreakdown) bool
+}
+
+// percentOff takes a percentage off every line once the subtotal reaches MinSubtotal
+type percentOff struct {
+	Name        string
+	Percent     float64
+	MinSubtotal float64
+}
+
+func (p percentOff) name() string { return p.Name }
+
+func (p percentOff) apply(b *PriceBreakdown) bool {
+	if p.Percent <= 0 || b.Subtotal < p.MinSubtotal {
+		return false
+	}
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		line.Discount += roundCents(math.Min(line.Subtotal-line.Discount, line.Subtotal*p.Percent/100))
+	}
+	return true
+}
+
+// fixedOff takes a fixed amount off the order, spread across lines by value
+// so each line's tax is computed on what was actually paid for it
+type fixedOff struct {
+	Name        string
+	Amount      float64
+	MinSubtotal float64
+}
+
+func (f fixedOff) name() string { return f.Name }
+
+func (f fixedOff) apply(b *PriceBreakdown) bool {
+	if f.Amount <= 0 || b.Subtotal <= 0 || b.Subtotal < f.MinSubtotal {
+		return false
+	}
+	spreadDiscount(b, f.Amount)
+	return true
+}
+
+// buyXGetY makes Get of every Buy+Get units free on matching lines (any
+// product when ProductID is empty)
+type buyXGetY struct {
+	Name        string
+	ProductID   string
+	Buy, Get    int
+	MinSubtotal float64
+}
+
+func (p buyXGetY) name() string { return p.Name }
+
+func (p buyXGetY) apply(b *PriceBreakdown) bool {
+	if p.Buy <= 0 || p.Get <= 0 || b.Subtotal < p.MinSubtotal {
+		return false
+	}
+	applied := false
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		if p.ProductID != "" && line.ProductID != p.ProductID {
+			continue
+		}
+		free := line.Quantity / (p.Buy + p.Get) * p.Get
+		if free == 0 {
+			continue
+		}
+		line.Discount = roundCents(line.Discount + math.Min(line.Subtotal-line.Discount, float64(free)*line.UnitPrice))
+		applied = true
+	}
+	return applied
+}
+
+// spreadDiscount allocates amount across lines in proportion to what is
+// still payable on each, never discounting a line below zero
+func spreadDiscount(b *PriceBreakdown, amount float64) {
+	payable := 0.0
+	for _, line := range b.Lines {
+		payable += line.Subtotal - line.Discount
+	}
+	amount = math.Min(amount, payable)
+	if amount <= 0 {
+		return
+	}
+
+	remaining := roundCents(amount)
+	last := -1
+	for i := range b.Lines {
+		if b.Lines[i].Subtotal-b.Lines[i].Discount > 0 {
+			last = i
+		}
+	}
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		open := line.Subtotal - line.Discount
+		if open <= 0 {
+			continue
+		}
+		share := roundCents(amount * open / payable)
+		if i == last {
+			share = remaining // rounding leftovers land on the last line
+		}
+		share = math.Min(share, open)
+		line.Discount = roundCents(line.Discount + share)
+		remaining = roundCents(remaining - share)
+	}
+}
+
+// shippingRule charges a flat rate below the free-shipping threshold
+type shippingRule struct {
+	FlatRate      float64
+	FreeThreshold float64
+}
+
+func (s shippingRule) cost(discountedSubtotal float64) float64 {
+	if discountedSubtotal <= 0 || (s.FreeThreshold > 0 && discountedSubtotal >= s.FreeThreshold) {
+		return 0
+	}
+	return s.FlatRate
+}
+
+// pricingEngine computes price breakdowns. Tax applies to discounted line
+// amounts; shipping is not taxed.
+type pricingEngine struct {
+	taxRates       map[string]float64 // region code -> rate
+	defaultTaxRate float64
+	shipping       shippingRule
+	promotions     []promotion
+}
+
+var orderPricing = &pricingEngine{
+	taxRates: map[string]float64{
+		"CA": 0.0725,
+		"NY": 0.04,
+		"TX": 0.0625,
+		"WA": 0.065,
+		"OR": 0,
+	},
+	shipping: shippingRule{
+		FlatRate:      float64(getEnvInt("SHIPPING_FLAT_CENTS", 599)) / 100,
+		FreeThreshold: float64(getEnvInt("FREE_SHIPPING_THRESHOLD", 50)),
+	},
+}
+
+func (e *pricingEngine) taxRate(region string) float64 {
+	if rate, ok := e.taxRates[strings.ToUpper(region)]; ok {
+		return rate
+	}
+	return e.defaultTaxRate
+}
+
+// quote prices items for region. extra promotions (e.g. coupons) apply after
+// the engine's own, in order.
+func (e *pricingEngine) quote(items []Item, region string, extra ...promotion) *PriceBreakdown {
+	b := &PriceBreakdown{
+		Lines:   make([]LinePrice, 0, len(items)),
+		Region:  strings.ToUpper(region),
+		TaxRate: e.taxRate(region),
+	}
+	for _, item := range items {
+		subtotal := roundCents(float64(item.Quantity) * item.Price)
+		b.Lines = append(b.Lines, LinePrice{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			UnitPrice: item.Price,
+			Subtotal:  subtotal,
+		})
+		b.Subtotal += subtotal
+	}
+	b.Subtotal = roundCents(b.Subtotal)
+
+	for _, promo := range append(append([]promotion{}, e.promotions...), extra...) {
+		if promo.apply(b) {
+			b.Promotions = append(b.Promotions, promo.name())
+		}
+	}
+
+	for i := range b.Lines {
+		line := &b.Lines[i]
+		line.Tax = roundCents((line.Subtotal - line.Discount) * b.TaxRate)
+		line.Total = roundCents(line.Subtotal - line.Discount + line.Tax)
+		b.Discount += line.Discount
+		b.Tax += line.Tax
+	}
+	b.Discount = roundCents(b.Discount)
+	b.Tax = roundCents(b.Tax)
+	b.Shipping = e.shipping.cost(b.Subtotal - b.Discount)
+	b.Total = roundCents(b.Subtotal - b.Discount + b.Shipping + b.Tax)
+	return b
+}
+
+func roundCents(x float64) float64 {
+	return orders.RoundCents(x)
+}
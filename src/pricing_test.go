@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestPricingEngine_Quote(t *testing.T) {
+	engine := &pricingEngine{
+		taxRates: map[string]float64{"CA": 0.10},
+		shipping: shippingRule{FlatRate: 5, FreeThreshold: 100},
+	}
+	items := []Item{{ProductID: "a", Quantity: 2, Price: 10}, {ProductID: "b", Quantity: 1, Price: 20}}
+
+	// 40 subtotal, below free shipping, 10% tax
+	b := engine.quote(items, "ca")
+	if b.Subtotal != 40 || b.Shipping != 5 || b.Tax != 4 || b.Total != 49 || b.Region != "CA" {
+		t.Fatalf("unexpected breakdown: %+v", b)
+	}
+	if b.Lines[0].Subtotal != 20 || b.Lines[0].Tax != 2 || b.Lines[0].Total != 22 {
+		t.Fatalf("unexpected line: %+v", b.Lines[0])
+	}
+
+	// Unknown regions use the default rate
+	if b := engine.quote(items, "ZZ"); b.Tax != 0 || b.Total != 45 {
+		t.Fatalf("expected untaxed quote, got %+v", b)
+	}
+
+	// 25% off then 10 off: tax is charged on the discounted lines
+	b = engine.quote(items, "CA", percentOff{Name: "QUARTER", Percent: 25}, fixedOff{Name: "TENOFF", Amount: 10})
+	if b.Discount != 20 || b.Tax != 2 || b.Total != 27 || len(b.Promotions) != 2 {
+		t.Fatalf("unexpected discounted breakdown: %+v", b)
+	}
+	if b.Lines[0].Discount != 10 || b.Lines[1].Discount != 10 {
+		t.Fatalf("expected discounts spread by line value, got %+v", b.Lines)
+	}
+
+	// Promotions below their minimum spend don't apply
+	if b := engine.quote(items, "CA", fixedOff{Name: "BIG", Amount: 5, MinSubtotal: 50}); len(b.Promotions) != 0 || b.Discount != 0 {
+		t.Fatalf("expected promotion to be skipped, got %+v", b)
+	}
+
+	// Free shipping above the threshold; discounts never go below zero
+	b = engine.quote([]Item{{ProductID: "c", Quantity: 1, Price: 150}}, "", fixedOff{Name: "HUGE", Amount: 500})
+	if b.Discount != 150 || b.Total != 0 || b.Shipping != 0 {
+		t.Fatalf("expected fully discounted order, got %+v", b)
+	}
+}
+
+func TestBuyXGetY(t *testing.T) {
+	engine := &pricingEngine{}
+	items := []Item{{ProductID: "a", Quantity: 7, Price: 2}, {ProductID: "b", Quantity: 3, Price: 10}}
+
+	// Buy 2 get 1 on product a: 7 units -> 2 free
+	b := engine.quote(items, "", buyXGetY{Name: "A3FOR2", ProductID: "a", Buy: 2, Get: 1})
+	if b.Lines[0].Discount != 4 || b.Lines[1].Discount != 0 || b.Promotions[0] != "A3FOR2" {
+		t.Fatalf("unexpected buy-x-get-y discount: %+v", b)
+	}
+
+	// Any product: b gets one free too
+	b = engine.quote(items, "", buyXGetY{Name: "ANY", Buy: 2, Get: 1})
+	if b.Discount != 14 {
+		t.Fatalf("expected 14 off, got %+v", b)
+	}
+}
@@ -51,6 +51,144 @@ CREATE TABLE IF NOT EXISTS cart_items (
     CONSTRAINT chk_price CHECK (price_per_unit >= 0)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
 
+-- Table 4: Orders (full order snapshot kept as JSON alongside queryable columns)
+CREATE TABLE IF NOT EXISTS orders (
+    order_id VARCHAR(50) PRIMARY KEY,
+    customer_id INT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    total DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    payload JSON NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    
+    INDEX idx_customer_created (customer_id, created_at),
+    INDEX idx_status (status)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Migrations: this script runs on every start, and MySQL has no
+-- ADD COLUMN IF NOT EXISTS, so each change checks information_schema first
+
+-- Orders created by cart checkout (cart_id is unique so a cart makes one order)
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.columns
+        WHERE table_schema = DATABASE() AND table_name = 'orders' AND column_name = 'cart_id') = 0,
+    'ALTER TABLE orders ADD COLUMN cart_id VARCHAR(50) NULL AFTER customer_id', 'DO 0');
+PREPARE migration FROM @ddl; EXECUTE migration; DEALLOCATE PREPARE migration;
+
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.columns
+        WHERE table_schema = DATABASE() AND table_name = 'orders' AND column_name = 'customer_ref') = 0,
+    'ALTER TABLE orders ADD COLUMN customer_ref VARCHAR(50) NULL AFTER cart_id', 'DO 0');
+PREPARE migration FROM @ddl; EXECUTE migration; DEALLOCATE PREPARE migration;
+
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.statistics
+        WHERE table_schema = DATABASE() AND table_name = 'orders' AND index_name = 'unique_cart_order') = 0,
+    'ALTER TABLE orders ADD UNIQUE KEY unique_cart_order (cart_id)', 'DO 0');
+PREPARE migration FROM @ddl; EXECUTE migration; DEALLOCATE PREPARE migration;
+
+-- Table 5: Outbox (events written in the same transaction as the change they describe)
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    destination VARCHAR(50) NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    aggregate_id VARCHAR(50) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    attributes JSON NULL,
+    status ENUM('pending', 'sent', 'failed') NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error VARCHAR(500) NULL,
+    available_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    sent_at TIMESTAMP NULL,
+    
+    INDEX idx_status_id (status, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 6: Coupons (promotion codes customers apply to carts)
+CREATE TABLE IF NOT EXISTS coupons (
+    code VARCHAR(50) PRIMARY KEY,
+    kind ENUM('percent', 'fixed', 'buy_x_get_y') NOT NULL,
+    value DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    product_id VARCHAR(50) NULL,
+    buy_quantity INT NOT NULL DEFAULT 0,
+    get_quantity INT NOT NULL DEFAULT 0,
+    min_spend DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NULL,
+    per_customer_limit INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 7: Coupons applied to a cart (redeemed at checkout)
+CREATE TABLE IF NOT EXISTS cart_coupons (
+    cart_id VARCHAR(50) NOT NULL,
+    code VARCHAR(50) NOT NULL,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    
+    PRIMARY KEY (cart_id, code),
+    
+    FOREIGN KEY (cart_id) REFERENCES carts(cart_id) 
+        ON DELETE CASCADE,
+    FOREIGN KEY (code) REFERENCES coupons(code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 8: Coupon redemptions (one row per coupon per order, counted for usage limits)
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    code VARCHAR(50) NOT NULL,
+    customer_id VARCHAR(50) NOT NULL,
+    order_id VARCHAR(50) NOT NULL,
+    redeemed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    
+    INDEX idx_code_customer (code, customer_id),
+    UNIQUE KEY unique_code_order (code, order_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 9: Webhook endpoints customers registered for order events
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id VARCHAR(50) PRIMARY KEY,
+    customer_id VARCHAR(50) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    
+    INDEX idx_customer_id (customer_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 10: Stock levels; products get a row (with PRODUCT_STOCK units) on first reservation
+CREATE TABLE IF NOT EXISTS product_stock (
+    product_id VARCHAR(50) PRIMARY KEY,
+    available INT NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 11: Stock held by orders being fulfilled (released_at set when the saga compensates)
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    order_id VARCHAR(50) NOT NULL,
+    product_id VARCHAR(50) NOT NULL,
+    quantity INT NOT NULL,
+    reserved_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    released_at TIMESTAMP NULL,
+    
+    PRIMARY KEY (order_id, product_id),
+    INDEX idx_product_id (product_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Table 12: Worker deduplication keys ("message:<SNS MessageId>", "order:<order_id>")
+CREATE TABLE IF NOT EXISTS dedup_keys (
+    dedup_key VARCHAR(191) PRIMARY KEY,
+    owner VARCHAR(100) NOT NULL,
+    status ENUM('claimed', 'completed') NOT NULL,
+    expires_at DATETIME(3) NOT NULL,
+    
+    INDEX idx_expires_at (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Sample promotions
+INSERT IGNORE INTO coupons (code, kind, value, min_spend, per_customer_limit) VALUES
+    ('WELCOME10', 'percent', 10, 0, 1),
+    ('SAVE5', 'fixed', 5, 25, 0);
+INSERT IGNORE INTO coupons (code, kind, product_id, buy_quantity, get_quantity) VALUES
+    ('BUY2GET1', 'buy_x_get_y', NULL, 2, 1);
+
 -- Set recommended transaction isolation level for shopping carts
 SET SESSION TRANSACTION ISOLATION LEVEL READ COMMITTED;
 
@@ -28,14 +28,16 @@ type CreateShoppingCartResponse struct {
 
 // ShoppingCartResponse represents full cart with items
 type ShoppingCartResponse struct {
-	CartID     string           `json:"cart_id"`
-	CustomerID string           `json:"customer_id"`
-	Status     string           `json:"status"`
+	CartID     string             `json:"cart_id"`
+	CustomerID string             `json:"customer_id"`
+	Status     string             `json:"status"`
 	Items      []ShoppingCartItem `json:"items"`
-	Total      float64          `json:"total"`
-	ItemCount  int              `json:"item_count"`
-	CreatedAt  time.Time        `json:"created_at"`
-	UpdatedAt  time.Time        `json:"updated_at"`
+	Total      float64            `json:"total"` // amount due, same as Pricing.Total
+	Pricing    *PriceBreakdown    `json:"pricing"`
+	Coupons    []string           `json:"coupons,omitempty"` // applied codes; see Pricing.Promotions for those in effect
+	ItemCount  int                `json:"item_count"`
+	CreatedAt  time.Time          `json:"created_at"`
+	UpdatedAt  time.Time          `json:"updated_at"`
 }
 
 // ShoppingCartItem represents an item in the cart
@@ -48,6 +50,39 @@ type ShoppingCartItem struct {
 	Subtotal     float64 `json:"subtotal"`
 }
 
+// quoteShoppingCart prices cart lines for display, using the same engine as orders
+func quoteShoppingCart(items []ShoppingCartItem, region string, promos ...promotion) *PriceBreakdown {
+	lines := make([]Item, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, Item{ProductID: item.ProductID, Quantity: item.Quantity, Price: item.PricePerUnit})
+	}
+	return orderPricing.quote(lines, region, promos...)
+}
+
+// shoppingCartLines loads just the items of a MySQL cart
+func shoppingCartLines(q sqlQueryer, cartID string) ([]ShoppingCartItem, error) {
+	rows, err := q.Query(`
+		SELECT item_id, product_id, product_name, quantity, price_per_unit
+		FROM cart_items
+		WHERE cart_id = ?
+		ORDER BY item_id`, cartID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ShoppingCartItem{}
+	for rows.Next() {
+		var item ShoppingCartItem
+		if err := rows.Scan(&item.ItemID, &item.ProductID, &item.ProductName, &item.Quantity, &item.PricePerUnit); err != nil {
+			return nil, err
+		}
+		item.Subtotal = float64(item.Quantity) * item.PricePerUnit
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
 // POST /shopping-carts - Create new shopping cart
 func createShoppingCart(c *gin.Context) {
 	if db == nil {
@@ -181,7 +216,6 @@ func getShoppingCart(c *gin.Context) {
 
 	var response *ShoppingCartResponse
 	items := []ShoppingCartItem{}
-	total := 0.0
 
 	// Process all rows (cart metadata + items)
 	for rows.Next() {
@@ -245,7 +279,6 @@ func getShoppingCart(c *gin.Context) {
 				Subtotal:     subtotal,
 			}
 			items = append(items, item)
-			total += subtotal
 		}
 	}
 
@@ -267,9 +300,22 @@ func getShoppingCart(c *gin.Context) {
 		return
 	}
 
+	coupons, err := cartCoupons(db, cartID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "query_failed",
+			"message": "Failed to retrieve cart coupons",
+		})
+		return
+	}
+	for _, cp := range coupons {
+		response.Coupons = append(response.Coupons, cp.Code)
+	}
+
 	// Populate items and totals
 	response.Items = items
-	response.Total = total
+	response.Pricing = quoteShoppingCart(items, c.Query("region"), couponPromotions(coupons)...)
+	response.Total = response.Pricing.Total
 	response.ItemCount = len(items)
 
 	c.JSON(http.StatusOK, response)
@@ -303,6 +349,11 @@ func addItemToShoppingCart(c *gin.Context) {
 		return
 	}
 
+	if errs := priceCartItem(&req); len(errs) > 0 {
+		rejectInvalidCartItem(c, errs)
+		return
+	}
+
 	// Start transaction
 	tx, err := db.Begin()
 	if err != nil {
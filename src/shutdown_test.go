@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func withGracePeriod(t *testing.T, d time.Duration) {
+	previous := shutdownGracePeriod
+	shutdownGracePeriod = d
+	t.Cleanup(func() { shutdownGracePeriod = previous })
+}
+
+// startTestServer runs runServer on a free port and returns its address and
+// a channel closed when runServer returns
+func startTestServer(t *testing.T, ctx context.Context, handler http.Handler) (string, <-chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		runServer(ctx, &http.Server{Addr: addr, Handler: handler})
+		close(stopped)
+	}()
+	for deadline := time.Now().Add(time.Second); ; {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, stopped
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunServer_DrainsInFlightRequests(t *testing.T) {
+	withGracePeriod(t, 2*time.Second)
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, stopped := startTestServer(t, ctx, handler)
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-started
+	cancel()
+
+	if err := <-result; err != nil {
+		t.Fatalf("in-flight request was cut off: %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("runServer did not return after draining")
+	}
+	if _, err := http.Get("http://" + addr + "/"); err == nil {
+		t.Fatal("server still accepting requests after shutdown")
+	}
+}
+
+func TestRunServer_GivesUpAfterGracePeriod(t *testing.T) {
+	withGracePeriod(t, 50*time.Millisecond)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, stopped := startTestServer(t, ctx, handler)
+
+	go http.Get("http://" + addr + "/")
+	<-started
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("runServer waited past the grace period")
+	}
+}
+
+// withMemoryWorker points the order worker at an in-memory queue and
+// payment simulator and starts it; stop cancels it and waits for it to return
+func withMemoryWorker(t *testing.T, pp *PaymentProcessor, bodies ...QueuedMessage) (queue *memoryQueue, stop func() time.Duration) {
+	withOrderStore(t)
+	withSagaGateway(t, 100)
+	queue = newMemoryQueue("shutdown-queue")
+	previousSub, previousDLQ, previousGateway := orderSubscriber, deadLetterPublisher, paymentGateway
+	orderSubscriber, deadLetterPublisher, paymentGateway = queue, newMemoryQueue("shutdown-dlq"), pp
+	t.Cleanup(func() {
+		orderSubscriber, deadLetterPublisher, paymentGateway = previousSub, previousDLQ, previousGateway
+	})
+	for _, message := range bodies {
+		queue.Publish(context.Background(), message.Body, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		startOrderProcessor(ctx)
+		close(done)
+	}()
+	return queue, func() time.Duration {
+		start := time.Now()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("order processor did not stop")
+		}
+		return time.Since(start)
+	}
+}
+
+func waitForPayment(t *testing.T, pp *PaymentProcessor) {
+	for deadline := time.Now().Add(2 * time.Second); pp.InUse() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no payment started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOrderProcessor_DrainsAndReleasesOnShutdown(t *testing.T) {
+	withGracePeriod(t, 2*time.Second)
+	pp := newPaymentProcessor(1)
+	pp.Delay = 200 * time.Millisecond
+	// One customer, so only the first order starts before shutdown
+	var messages []QueuedMessage
+	for _, id := range []string{"sd-1", "sd-2", "sd-3"} {
+		messages = append(messages, orderMessage(t, &Order{OrderID: id, CustomerID: 5, Items: []Item{{ProductID: "7", Quantity: 1, Price: 10}}}))
+	}
+	queue, stop := withMemoryWorker(t, pp, messages...)
+
+	waitForPayment(t, pp)
+	stop()
+
+	if processed, _ := pp.Stats(); processed != 1 {
+		t.Fatalf("expected the in-progress order to finish, processed %d", processed)
+	}
+	visible, inFlight, _ := queue.Depth(context.Background())
+	if visible != 2 || inFlight != 0 {
+		t.Fatalf("expected unstarted orders back on the queue, got visible=%d inFlight=%d", visible, inFlight)
+	}
+}
+
+func TestOrderProcessor_AbortsAfterGracePeriod(t *testing.T) {
+	withGracePeriod(t, 100*time.Millisecond)
+	pp := newPaymentProcessor(1)
+	pp.Delay = time.Minute
+	queue, stop := withMemoryWorker(t, pp, orderMessage(t, &Order{OrderID: "sd-slow", CustomerID: 6, Items: []Item{{ProductID: "7", Quantity: 1, Price: 10}}}))
+
+	waitForPayment(t, pp)
+	if took := stop(); took > 2*time.Second {
+		t.Fatalf("shutdown took %v despite the grace period", took)
+	}
+
+	if processed, _ := pp.Stats(); processed != 0 {
+		t.Fatalf("aborted order should not be charged, processed %d", processed)
+	}
+	// Not acknowledged, so the queue redelivers it
+	if visible, inFlight, _ := queue.Depth(context.Background()); visible+inFlight != 1 {
+		t.Fatalf("aborted order left the queue: visible=%d inFlight=%d", visible, inFlight)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// admissionController bounds the synchronous order path: at most
+// `concurrency` payments run at once, at most maxQueue requests wait for a
+// slot and none waits longer than maxWait. Anything beyond that is shed
+// immediately instead of tying up the HTTP server.
+type admissionController struct {
+	slots    chan struct{}
+	maxQueue int
+	maxWait  time.Duration
+
+	mu            sync.Mutex
+	waiting       int
+	avgService    time.Duration // moving average of how long a slot is held
+	admitted      int
+	rejectedFull  int
+	rejectedWait  int
+	rejectedTotal int
+}
+
+// rejection reasons reported to clients and in stats
+const (
+	rejectQueueFull   = "queue_full"
+	rejectWaitTimeout = "wait_timeout"
+)
+
+func newAdmissionController(concurrency, maxQueue int, maxWait, initialService time.Duration) *admissionController {
+	return &admissionController{
+		slots:      make(chan struct{}, concurrency),
+		maxQueue:   maxQueue,
+		maxWait:    maxWait,
+		avgService: initialService,
+	}
+}
+
+var syncAdmission = newAdmissionController(
+	getEnvInt("SYNC_MAX_CONCURRENT", 5),
+	getEnvInt("SYNC_MAX_QUEUE", 20),
+	time.Duration(getEnvInt("SYNC_MAX_WAIT_MS", 2000))*time.Millisecond,
+	paymentProcessor.Delay,
+)
+
+// acquire waits for a slot. On success it returns a release func that must
+// be called when the payment finishes; otherwise it returns the rejection
+// reason and how long the client should wait before retrying.
+func (a *admissionController) acquire(ctx context.Context) (release func(), reason string, retryAfter time.Duration) {
+	select {
+	case a.slots <- struct{}{}:
+		return a.admit(), "", 0
+	default:
+	}
+
+	a.mu.Lock()
+	if a.waiting >= a.maxQueue {
+		retryAfter = a.retryAfterLocked()
+		a.rejectLocked(rejectQueueFull)
+		a.mu.Unlock()
+		return nil, rejectQueueFull, retryAfter
+	}
+	a.waiting++
+	a.mu.Unlock()
+
+	timer := time.NewTimer(a.maxWait)
+	defer timer.Stop()
+
+	select {
+	case a.slots <- struct{}{}:
+		a.mu.Lock()
+		a.waiting--
+		a.mu.Unlock()
+		return a.admit(), "", 0
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	a.mu.Lock()
+	a.waiting--
+	retryAfter = a.retryAfterLocked()
+	a.rejectLocked(rejectWaitTimeout)
+	a.mu.Unlock()
+	return nil, rejectWaitTimeout, retryAfter
+}
+
+func (a *admissionController) admit() func() {
+	start := time.Now()
+	a.mu.Lock()
+	a.admitted++
+	a.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-a.slots
+			a.mu.Lock()
+			// EWMA with alpha 0.2 smooths out single slow payments
+			a.avgService = time.Duration(0.8*float64(a.avgService) + 0.2*float64(time.Since(start)))
+			a.mu.Unlock()
+		})
+	}
+}
+
+func (a *admissionController) rejectLocked(reason string) {
+	a.rejectedTotal++
+	if reason == rejectQueueFull {
+		a.rejectedFull++
+	} else {
+		a.rejectedWait++
+	}
+}
+
+// retryAfterLocked estimates when a slot frees up for a new request: the
+// waiters ahead of it drain `concurrency` at a time, one service time each
+func (a *admissionController) retryAfterLocked() time.Duration {
+	rounds := math.Ceil(float64(a.waiting+1) / float64(cap(a.slots)))
+	estimate := time.Duration(rounds * float64(a.avgService))
+	if estimate < time.Second {
+		return time.Second
+	}
+	return estimate
+}
+
+func (a *admissionController) snapshot() map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return map[string]interface{}{
+		"max_concurrent":        cap(a.slots),
+		"in_flight":             len(a.slots),
+		"waiting":               a.waiting,
+		"max_queue":             a.maxQueue,
+		"max_wait_ms":           a.maxWait.Milliseconds(),
+		"admitted":              a.admitted,
+		"rejected":              a.rejectedTotal,
+		"rejected_queue_full":   a.rejectedFull,
+		"rejected_wait_timeout": a.rejectedWait,
+		"avg_service_ms":        a.avgService.Milliseconds(),
+	}
+}
+
+// rejectOverloaded writes the 503 for a shed request
+func rejectOverloaded(c *gin.Context, reason string, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":               "payment capacity exhausted",
+		"reason":              reason,
+		"retry_after_seconds": seconds,
+	})
+}
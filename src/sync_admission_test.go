@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmissionController_ShedsLoad(t *testing.T) {
+	a := newAdmissionController(1, 1, 50*time.Millisecond, 3*time.Second)
+	ctx := context.Background()
+
+	release, _, _ := a.acquire(ctx)
+	if release == nil {
+		t.Fatal("expected first request to be admitted")
+	}
+
+	// One request may wait; it times out because the slot is never freed
+	waited := make(chan string)
+	go func() {
+		_, reason, _ := a.acquire(ctx)
+		waited <- reason
+	}()
+	for {
+		a.mu.Lock()
+		waiting := a.waiting
+		a.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so the next one is rejected without waiting
+	if r, reason, retryAfter := a.acquire(ctx); r != nil || reason != rejectQueueFull || retryAfter != 6*time.Second {
+		t.Fatalf("expected queue_full with 6s retry, got %v %s %v", r != nil, reason, retryAfter)
+	}
+	if reason := <-waited; reason != rejectWaitTimeout {
+		t.Fatalf("expected wait_timeout, got %s", reason)
+	}
+
+	release()
+	release() // safe to call twice
+	if r, _, _ := a.acquire(ctx); r == nil {
+		t.Fatal("expected admission after release")
+	}
+
+	stats := a.snapshot()
+	if stats["admitted"] != 2 || stats["rejected"] != 2 || stats["rejected_queue_full"] != 1 || stats["rejected_wait_timeout"] != 1 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
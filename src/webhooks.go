@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Order webhooks. When the worker finishes an order it POSTs a signed event
+// to the order's callback_url and to every endpoint its customer
+// registered. Deliveries are retried with backoff in this process; the
+// outcome of every attempt is kept in a bounded delivery log.
+
+// webhookEvent is the JSON body of every delivery
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"` // order.completed, order.failed, order.cancelled
+	CreatedAt time.Time `json:"created_at"`
+	Order     *Order    `json:"order"`
+}
+
+// webhookEndpoint is a URL a customer registered for their order events
+type webhookEndpoint struct {
+	ID         string    `json:"id"`
+	CustomerID string    `json:"customer_id"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// webhookRegistry stores customer endpoints
+type webhookRegistry interface {
+	add(ctx context.Context, ep webhookEndpoint) error
+	list(ctx context.Context, customerID string) ([]webhookEndpoint, error)
+	remove(ctx context.Context, customerID, id string) (bool, error)
+}
+
+var webhookEndpoints webhookRegistry = &memoryWebhookRegistry{}
+
+type memoryWebhookRegistry struct {
+	mu        sync.Mutex
+	endpoints []webhookEndpoint
+}
+
+func (r *memoryWebhookRegistry) add(ctx context.Context, ep webhookEndpoint) error {
+	r.mu.Lock()
+	r.endpoints = append(r.endpoints, ep)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *memoryWebhookRegistry) list(ctx context.Context, customerID string) ([]webhookEndpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []webhookEndpoint
+	for _, ep := range r.endpoints {
+		if ep.CustomerID == customerID {
+			found = append(found, ep)
+		}
+	}
+	return found, nil
+}
+
+func (r *memoryWebhookRegistry) remove(ctx context.Context, customerID, id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, ep := range r.endpoints {
+		if ep.ID == id && ep.CustomerID == customerID {
+			r.endpoints = append(r.endpoints[:i], r.endpoints[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type sqlWebhookRegistry struct{}
+
+func (sqlWebhookRegistry) add(ctx context.Context, ep webhookEndpoint) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO webhook_endpoints (id, customer_id, url, secret, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		ep.ID, ep.CustomerID, ep.URL, ep.Secret, ep.CreatedAt)
+	return err
+}
+
+func (sqlWebhookRegistry) list(ctx context.Context, customerID string) ([]webhookEndpoint, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, customer_id, url, secret, created_at
+		FROM webhook_endpoints
+		WHERE customer_id = ?
+		ORDER BY created_at`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []webhookEndpoint
+	for rows.Next() {
+		var ep webhookEndpoint
+		if err := rows.Scan(&ep.ID, &ep.CustomerID, &ep.URL, &ep.Secret, &ep.CreatedAt); err != nil {
+			return nil, err
+		}
+		found = append(found, ep)
+	}
+	return found, rows.Err()
+}
+
+func (sqlWebhookRegistry) remove(ctx context.Context, customerID, id string) (bool, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM webhook_endpoints WHERE id = ? AND customer_id = ?", id, customerID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// customerKey identifies the order's customer for webhook lookups: the cart
+// customer ID when the order came from a cart, else the numeric ID
+func customerKey(order *Order) string {
+	if order.CustomerRef != "" {
+		return order.CustomerRef
+	}
+	return strconv.Itoa(order.CustomerID)
+}
+
+// signWebhook returns the X-Webhook-Signature header value: the unix
+// timestamp and an HMAC-SHA256 of "timestamp.body". Receivers recompute it
+// with their secret and reject stale timestamps to prevent replays.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// verifyWebhookSignature checks a signature header produced by signWebhook
+func verifyWebhookSignature(secret, header string, body []byte, maxAge time.Duration, now time.Time) bool {
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == 0 || now.Sub(time.Unix(timestamp, 0)) > maxAge {
+		return false
+	}
+	expected := signWebhook(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(fmt.Sprintf("t=%d,v1=%s", timestamp, signature)))
+}
+
+// webhookDelivery is one event on its way to one URL
+type webhookDelivery struct {
+	id      string
+	event   webhookEvent
+	url     string
+	secret  string
+	attempt int
+}
+
+// webhookAttempt is one entry of the delivery log
+type webhookAttempt struct {
+	DeliveryID string    `json:"delivery_id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	OrderID    string    `json:"order_id"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	GaveUp     bool      `json:"gave_up,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	At         time.Time `json:"at"`
+}
+
+const webhookLogSize = 500
+
+// webhookDispatcher delivers events from a queue with a few goroutines.
+// Retries are re-queued after their backoff, so a slow endpoint never
+// holds up deliveries to other endpoints.
+type webhookDispatcher struct {
+	client  *http.Client
+	secret  string // signs callback_url deliveries
+	workers int
+	policy  retryPolicy
+
+	queue   chan webhookDelivery
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	stopped bool
+	log     []webhookAttempt
+	next    int // ring position in log
+
+	delivered, failed, retried, dropped int
+}
+
+var orderWebhooks = newWebhookDispatcher(os.Getenv("WEBHOOK_SIGNING_SECRET"))
+
+// webhookAllowPrivate lets webhooks reach loopback and private networks,
+// for local development only (WEBHOOK_ALLOW_PRIVATE_NETWORKS=true)
+var webhookAllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true"
+
+// errWebhookAddressBlocked rejects deliveries to internal addresses
+var errWebhookAddressBlocked = errors.New("webhook address not allowed")
+
+// blockedWebhookIP reports addresses a webhook must never reach: loopback,
+// private (RFC 1918, IPv6 unique local), link-local (including the cloud
+// metadata endpoint 169.254.169.254), unspecified and multicast
+func blockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// newWebhookClient posts to customer-supplied URLs. The address is checked
+// after DNS resolution, right before connecting, so hostnames pointing at
+// internal addresses are refused too; redirects are not followed, since they
+// could lead anywhere.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || blockedWebhookIP(ip) {
+				return fmt.Errorf("%w: %s", errWebhookAddressBlocked, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect on our behalf, past the address check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func newWebhookDispatcher(secret string) *webhookDispatcher {
+	return &webhookDispatcher{
+		client:  newWebhookClient(webhookAllowPrivate),
+		secret:  secret,
+		workers: getEnvInt("WEBHOOK_WORKERS", 4),
+		policy: retryPolicy{
+			maxReceives: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 6),
+			baseDelay:   time.Second,
+			maxDelay:    5 * time.Minute,
+		},
+		queue: make(chan webhookDelivery, 1000),
+	}
+}
+
+// initWebhooks picks the endpoint registry to match the order store
+func initWebhooks() {
+	if db != nil {
+		webhookEndpoints = sqlWebhookRegistry{}
+	}
+	if orderWebhooks.secret == "" {
+		fmt.Println("⚠️  WEBHOOK_SIGNING_SECRET not set - callback_url deliveries will be unsigned")
+	}
+}
+
+func (d *webhookDispatcher) start() {
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for delivery := range d.queue {
+				d.deliver(delivery)
+			}
+		}()
+	}
+}
+
+// stop finishes queued deliveries; retries still waiting on their backoff are dropped
+func (d *webhookDispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	close(d.queue)
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *webhookDispatcher) enqueue(delivery webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		d.dropped++
+		return
+	}
+	select {
+	case d.queue <- delivery:
+	default:
+		d.dropped++
+		fmt.Printf("Warning: webhook queue full, dropping %s for order %s\n", delivery.event.Type, delivery.event.Order.OrderID)
+	}
+}
+
+// notify sends the event to the order's callback URL and the customer's endpoints
+func (d *webhookDispatcher) notify(ctx context.Context, order *Order, eventType string) {
+	event := webhookEvent{ID: generateID("evt"), Type: eventType, CreatedAt: time.Now().UTC(), Order: order}
+
+	var targets []webhookDelivery
+	if order.CallbackURL != "" {
+		targets = append(targets, webhookDelivery{url: order.CallbackURL, secret: d.secret})
+	}
+	endpoints, err := webhookEndpoints.list(ctx, customerKey(order))
+	if err != nil {
+		fmt.Printf("Warning: failed to load webhook endpoints for order %s: %v\n", order.OrderID, err)
+	}
+	for _, ep := range endpoints {
+		targets = append(targets, webhookDelivery{url: ep.URL, secret: ep.Secret})
+	}
+
+	for _, target := range targets {
+		target.id = generateID("dlv")
+		target.event = event
+		target.attempt = 1
+		d.enqueue(target)
+	}
+}
+
+func (d *webhookDispatcher) deliver(delivery webhookDelivery) {
+	body, _ := json.Marshal(delivery.event)
+	record := webhookAttempt{
+		DeliveryID: delivery.id,
+		EventID:    delivery.event.ID,
+		EventType:  delivery.event.Type,
+		OrderID:    delivery.event.Order.OrderID,
+		URL:        delivery.url,
+		Attempt:    delivery.attempt,
+		At:         time.Now().UTC(),
+	}
+
+	retryable := true
+	req, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Id", delivery.event.ID)
+		req.Header.Set("X-Webhook-Event", delivery.event.Type)
+		req.Header.Set("X-Webhook-Attempt", strconv.Itoa(delivery.attempt))
+		if delivery.secret != "" {
+			req.Header.Set("X-Webhook-Signature", signWebhook(delivery.secret, time.Now().Unix(), body))
+		}
+
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if errors.Is(err, errWebhookAddressBlocked) {
+			retryable = false
+		} else if err == nil {
+			resp.Body.Close()
+			record.StatusCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("endpoint returned %d", resp.StatusCode)
+				// Client errors won't fix themselves, except timeouts and throttling
+				retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+			}
+		}
+	} else {
+		retryable = false
+	}
+	record.DurationMs = time.Since(record.At).Milliseconds()
+
+	if err == nil {
+		record.Delivered = true
+		d.record(record, &d.delivered)
+		return
+	}
+
+	record.Error = err.Error()
+	if !retryable || d.policy.exhausted(delivery.attempt) {
+		record.GaveUp = true
+		d.record(record, &d.failed)
+		fmt.Printf("Webhook %s to %s failed permanently after %d attempt(s): %v\n", delivery.event.Type, delivery.url, delivery.attempt, err)
+		return
+	}
+
+	d.record(record, &d.retried)
+	delay := d.policy.backoff(delivery.attempt)
+	delivery.attempt++
+	time.AfterFunc(delay, func() { d.enqueue(delivery) })
+}
+
+func (d *webhookDispatcher) record(attempt webhookAttempt, counter *int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*counter++
+	if len(d.log) < webhookLogSize {
+		d.log = append(d.log, attempt)
+		return
+	}
+	d.log[d.next] = attempt
+	d.next = (d.next + 1) % webhookLogSize
+}
+
+// attempts returns logged attempts for an order, oldest first
+func (d *webhookDispatcher) attempts(orderID string) []webhookAttempt {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	found := []webhookAttempt{}
+	for i := range d.log {
+		a := d.log[(d.next+i)%len(d.log)]
+		if a.OrderID == orderID {
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+func (d *webhookDispatcher) snapshot() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return map[string]interface{}{
+		"queued":    len(d.queue),
+		"delivered": d.delivered,
+		"retried":   d.retried,
+		"failed":    d.failed,
+		"dropped":   d.dropped,
+	}
+}
+
+// notifyOrderFinished queues the webhook for an order the worker has settled.
+// The stored order is sent when available since it carries the full record.
+func notifyOrderFinished(ctx context.Context, order *Order, eventType string) {
+	if stored, err := orderStore.Get(ctx, order.OrderID); err == nil {
+		order = stored
+	}
+	orderWebhooks.notify(ctx, order, eventType)
+}
+
+// validCallbackURL accepts absolute http(s) URLs only. Hosts that are
+// obviously internal are refused up front; the webhook client checks every
+// address again when it connects.
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if webhookAllowPrivate {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !blockedWebhookIP(ip)
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// POST /customers/:customer_id/webhooks - Register an endpoint for order events
+func registerWebhook(c *gin.Context) {
+	var req struct {
+		URL string `json:"url" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validCallbackURL(req.URL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL on a public host"})
+		return
+	}
+
+	ep := webhookEndpoint{
+		ID:         generateID("whk"),
+		CustomerID: c.Param("customer_id"),
+		URL:        req.URL,
+		Secret:     newWebhookSecret(),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := webhookEndpoints.add(c.Request.Context(), ep); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to register webhook"})
+		return
+	}
+
+	// The secret is only ever returned here
+	c.JSON(http.StatusCreated, ep)
+}
+
+// GET /customers/:customer_id/webhooks
+func listWebhooks(c *gin.Context) {
+	endpoints, err := webhookEndpoints.list(c.Request.Context(), c.Param("customer_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list webhooks"})
+		return
+	}
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": endpoints, "count": len(endpoints)})
+}
+
+// DELETE /customers/:customer_id/webhooks/:webhook_id
+func deleteWebhook(c *gin.Context) {
+	removed, err := webhookEndpoints.remove(c.Request.Context(), c.Param("customer_id"), c.Param("webhook_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete webhook"})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted"})
+}
+
+// GET /orders/:id/webhooks - Delivery log for an order
+func getOrderWebhookDeliveries(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"order_id":   c.Param("id"),
+		"deliveries": orderWebhooks.attempts(c.Param("id")),
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook_Verify(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	now := time.Now()
+	header := signWebhook("secret", now.Unix(), body)
+
+	if !verifyWebhookSignature("secret", header, body, 5*time.Minute, now) {
+		t.Fatal("valid signature rejected")
+	}
+	if verifyWebhookSignature("other", header, body, 5*time.Minute, now) {
+		t.Error("signature accepted with the wrong secret")
+	}
+	if verifyWebhookSignature("secret", header, []byte(`{"id":"evt_2"}`), 5*time.Minute, now) {
+		t.Error("signature accepted for a different body")
+	}
+	if verifyWebhookSignature("secret", header, body, 5*time.Minute, now.Add(10*time.Minute)) {
+		t.Error("stale signature accepted")
+	}
+}
+
+// webhookReceiver answers with the given status codes in turn, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+	got      chan struct{}
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.bodies = append(r.bodies, body)
+	r.headers = append(r.headers, req.Header.Clone())
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	r.mu.Unlock()
+	w.WriteHeader(status)
+	r.got <- struct{}{}
+}
+
+// newTestDispatcher delivers to local test servers, which the default
+// client refuses
+func newTestDispatcher(maxAttempts int) *webhookDispatcher {
+	d := newWebhookDispatcher("callback-secret")
+	d.client = newWebhookClient(true)
+	d.policy = retryPolicy{maxReceives: maxAttempts, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond}
+	d.start()
+	return d
+}
+
+func waitForRequests(t *testing.T, r *webhookReceiver, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d of %d webhook requests", i, n)
+		}
+	}
+}
+
+func TestWebhookDispatcher_RetriesUntilDelivered(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{500, 503}, got: make(chan struct{}, 10)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	d := newTestDispatcher(5)
+	order := &Order{OrderID: "order-wh-1", CustomerID: 7, Status: orderCompleted, CallbackURL: server.URL}
+	d.notify(context.Background(), order, "order.completed")
+	waitForRequests(t, receiver, 3)
+	d.stop()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for i, h := range receiver.headers {
+		if !verifyWebhookSignature("callback-secret", h.Get("X-Webhook-Signature"), receiver.bodies[i], time.Minute, time.Now()) {
+			t.Errorf("attempt %d: signature did not verify", i+1)
+		}
+		if h.Get("X-Webhook-Event") != "order.completed" {
+			t.Errorf("attempt %d: event header = %q", i+1, h.Get("X-Webhook-Event"))
+		}
+	}
+	if receiver.headers[0].Get("X-Webhook-Id") != receiver.headers[2].Get("X-Webhook-Id") {
+		t.Error("retries should reuse the event ID so receivers can deduplicate")
+	}
+
+	log := d.attempts("order-wh-1")
+	if len(log) != 3 || !log[2].Delivered || log[0].StatusCode != 500 || log[2].Attempt != 3 {
+		t.Errorf("unexpected delivery log: %+v", log)
+	}
+}
+
+func TestWebhookDispatcher_ClientErrorIsPermanent(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusGone}, got: make(chan struct{}, 10)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	d := newTestDispatcher(5)
+	d.notify(context.Background(), &Order{OrderID: "order-wh-2", CallbackURL: server.URL}, "order.failed")
+	waitForRequests(t, receiver, 1)
+
+	select {
+	case <-receiver.got:
+		t.Fatal("a 410 response should not be retried")
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.stop()
+
+	log := d.attempts("order-wh-2")
+	if len(log) != 1 || !log[0].GaveUp {
+		t.Errorf("unexpected delivery log: %+v", log)
+	}
+}
+
+func TestWebhookDispatcher_CustomerEndpoints(t *testing.T) {
+	receiver := &webhookReceiver{got: make(chan struct{}, 10)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	registry := &memoryWebhookRegistry{}
+	previous := webhookEndpoints
+	webhookEndpoints = registry
+	defer func() { webhookEndpoints = previous }()
+
+	ctx := context.Background()
+	registry.add(ctx, webhookEndpoint{ID: "whk_1", CustomerID: "cust-9", URL: server.URL, Secret: "endpoint-secret"})
+	registry.add(ctx, webhookEndpoint{ID: "whk_2", CustomerID: "someone-else", URL: server.URL, Secret: "x"})
+
+	d := newTestDispatcher(1)
+	d.notify(ctx, &Order{OrderID: "order-wh-3", CustomerRef: "cust-9"}, "order.cancelled")
+	waitForRequests(t, receiver, 1)
+	d.stop()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("expected 1 delivery, got %d", len(receiver.bodies))
+	}
+	if !verifyWebhookSignature("endpoint-secret", receiver.headers[0].Get("X-Webhook-Signature"), receiver.bodies[0], time.Minute, time.Now()) {
+		t.Error("customer endpoint delivery should be signed with the endpoint's secret")
+	}
+}
+
+func TestWebhookClient_RefusesInternalAddresses(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.9", "192.168.1.1", "169.254.169.254", "0.0.0.0", "::1", "fd00::1", "fe80::1", "::ffff:127.0.0.1"} {
+		if !blockedWebhookIP(net.ParseIP(addr)) {
+			t.Errorf("%s should be blocked", addr)
+		}
+	}
+	for _, addr := range []string{"8.8.8.8", "203.0.113.10", "2001:4860:4860::8888"} {
+		if blockedWebhookIP(net.ParseIP(addr)) {
+			t.Errorf("%s should be allowed", addr)
+		}
+	}
+
+	for _, raw := range []string{"http://169.254.169.254/latest/meta-data/", "http://localhost:8080/hook", "https://10.0.0.5/", "http://[::1]/"} {
+		if validCallbackURL(raw) {
+			t.Errorf("%s accepted as a callback URL", raw)
+		}
+	}
+	if !validCallbackURL("https://hooks.example.com/orders") {
+		t.Error("public callback URL rejected")
+	}
+
+	// Hostnames are checked after resolution, when the client connects
+	receiver := &webhookReceiver{got: make(chan struct{}, 10)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	local := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if _, err := newWebhookClient(false).Post(local, "application/json", nil); !errors.Is(err, errWebhookAddressBlocked) {
+		t.Fatalf("expected the loopback connection to be refused, got %v", err)
+	}
+
+	d := newWebhookDispatcher("callback-secret")
+	d.policy = retryPolicy{maxReceives: 5, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	d.deliver(webhookDelivery{id: "whd_1", url: local, attempt: 1,
+		event: webhookEvent{ID: "evt_1", Type: "order.completed", Order: &Order{OrderID: "order-wh-ssrf"}}})
+	if log := d.attempts("order-wh-ssrf"); len(log) != 1 || !log[0].GaveUp || len(receiver.bodies) != 0 {
+		t.Fatalf("blocked delivery should fail without retrying: %+v", log)
+	}
+}
+
+func TestWebhookClient_DoesNotFollowRedirects(t *testing.T) {
+	target := &webhookReceiver{got: make(chan struct{}, 10)}
+	internal := httptest.NewServer(target)
+	defer internal.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusTemporaryRedirect))
+	defer redirector.Close()
+
+	d := newTestDispatcher(5)
+	d.notify(context.Background(), &Order{OrderID: "order-wh-redirect", CallbackURL: redirector.URL}, "order.completed")
+	for deadline := time.Now().Add(2 * time.Second); len(d.attempts("order-wh-redirect")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no delivery attempt recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.stop()
+
+	log := d.attempts("order-wh-redirect")
+	if log[0].StatusCode != http.StatusTemporaryRedirect || !log[0].GaveUp || len(target.bodies) != 0 {
+		t.Fatalf("redirect was followed: %+v", log)
+	}
+}
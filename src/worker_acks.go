@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// orderVisibilityTimeout is how long a received message stays hidden. The
+// heartbeats keep extending it while the message waits in the scheduler and
+// while a slow payment is still running.
+const orderVisibilityTimeout = 30 * time.Second
+
+// startVisibilityHeartbeat extends the message's visibility every third of
+// the timeout until the returned stop function is called
+func startVisibilityHeartbeat(message QueuedMessage, workerID int) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(orderVisibilityTimeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if err := orderSubscriber.ChangeVisibility(context.TODO(), message, orderVisibilityTimeout); err != nil {
+				// The receipt handle is stale; another consumer may get the message
+				orderWorkerStats.add(&orderWorkerStats.heartbeatFailed)
+				fmt.Printf("[Worker %d] Heartbeat failed for message %s: %v\n", workerID, message.ID, err)
+				return
+			}
+			orderWorkerStats.add(&orderWorkerStats.heartbeats)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// extendWaitingVisibility keeps messages waiting in the scheduler hidden
+// until ctx is cancelled, extending them every interval. Without it a
+// message stuck behind a busy customer would reappear on the queue and be
+// received again. A message whose receipt went stale is dropped from the
+// scheduler; the queue redelivers it, possibly to another consumer.
+func extendWaitingVisibility(ctx context.Context, scheduler *orderScheduler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, message := range scheduler.waitingMessages() {
+			if err := orderSubscriber.ChangeVisibility(ctx, message, orderVisibilityTimeout); err != nil {
+				if scheduler.remove(message.ID) {
+					orderWorkerStats.add(&orderWorkerStats.heartbeatFailed)
+					fmt.Printf("Heartbeat failed for waiting message %s, leaving it to the queue: %v\n", message.ID, err)
+				}
+				continue
+			}
+			orderWorkerStats.add(&orderWorkerStats.heartbeats)
+		}
+	}
+}
+
+// pendingAck is a message waiting to be deleted
+type pendingAck struct {
+	message  QueuedMessage
+	attempts int
+}
+
+// ackBatcher groups deletes into DeleteBatch calls of up to 10 entries.
+// Entries that fail for a retryable reason are resent with the next batch
+// until maxAttempts is reached.
+type ackBatcher struct {
+	subscriber    Subscriber
+	entries       chan QueuedMessage
+	maxBatch      int
+	flushInterval time.Duration
+	maxAttempts   int
+	done          chan struct{}
+}
+
+func newAckBatcher(subscriber Subscriber) *ackBatcher {
+	return &ackBatcher{
+		subscriber:    subscriber,
+		entries:       make(chan QueuedMessage, 100),
+		maxBatch:      10, // SQS batch limit
+		flushInterval: time.Second,
+		maxAttempts:   3,
+		done:          make(chan struct{}),
+	}
+}
+
+// start runs the batching loop; it exits after close flushes everything
+func (b *ackBatcher) start() {
+	go b.run()
+}
+
+// ack queues the message for deletion
+func (b *ackBatcher) ack(message QueuedMessage) {
+	b.entries <- message
+}
+
+// close flushes outstanding deletes and waits for the loop to exit
+func (b *ackBatcher) close() {
+	close(b.entries)
+	<-b.done
+}
+
+func (b *ackBatcher) run() {
+	defer close(b.done)
+
+	var pending []pendingAck
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-b.entries:
+			if !ok {
+				for len(pending) > 0 {
+					pending = b.flush(pending)
+				}
+				return
+			}
+			pending = append(pending, pendingAck{message: message})
+			if len(pending) >= b.maxBatch {
+				pending = b.flush(pending)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				pending = b.flush(pending)
+			}
+		}
+	}
+}
+
+// flush deletes up to maxBatch entries and returns what is still pending,
+// including entries to retry
+func (b *ackBatcher) flush(pending []pendingAck) []pendingAck {
+	n := len(pending)
+	if n > b.maxBatch {
+		n = b.maxBatch
+	}
+	batch, rest := pending[:n], pending[n:]
+
+	messages := make([]QueuedMessage, len(batch))
+	for i, entry := range batch {
+		messages[i] = entry.message
+	}
+
+	failures, err := b.subscriber.DeleteBatch(context.TODO(), messages)
+	if err != nil {
+		fmt.Printf("Error deleting message batch of %d: %v\n", len(batch), err)
+		return append(rest, b.retry(batch, "batch call failed")...)
+	}
+
+	var retries []pendingAck
+	for _, failed := range failures {
+		if !failed.Retryable {
+			// Invalid or expired receipt handle: retrying cannot succeed
+			orderWorkerStats.add(&orderWorkerStats.deleteFailed)
+			fmt.Printf("Error deleting message %s: %s (%s)\n", batch[failed.Index].message.ID, failed.Code, failed.Message)
+			continue
+		}
+		retries = append(retries, b.retry(batch[failed.Index:failed.Index+1], failed.Code)...)
+	}
+
+	for i := 0; i < len(batch)-len(failures); i++ {
+		orderWorkerStats.add(&orderWorkerStats.deleted)
+	}
+
+	return append(rest, retries...)
+}
+
+// retry bumps the attempt count, dropping entries that have used up their attempts
+func (b *ackBatcher) retry(entries []pendingAck, reason string) []pendingAck {
+	var retries []pendingAck
+	for _, entry := range entries {
+		entry.attempts++
+		if entry.attempts >= b.maxAttempts {
+			orderWorkerStats.add(&orderWorkerStats.deleteFailed)
+			fmt.Printf("Giving up deleting message %s after %d attempts: %s\n", entry.message.ID, entry.attempts, reason)
+			continue
+		}
+		orderWorkerStats.add(&orderWorkerStats.deleteRetried)
+		retries = append(retries, entry)
+	}
+	return retries
+}
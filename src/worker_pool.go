@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workerPool runs a resizable set of goroutines consuming from one channel
+type workerPool struct {
+	mu       sync.Mutex
+	messages <-chan QueuedMessage
+	handle   func(message QueuedMessage, workerID int)
+	quit     []chan struct{} // one per running worker, newest last
+	nextID   int
+	stopped  bool
+	inFlight atomic.Int64
+	wg       sync.WaitGroup
+}
+
+func newWorkerPool(messages <-chan QueuedMessage, handle func(QueuedMessage, int)) *workerPool {
+	return &workerPool{messages: messages, handle: handle}
+}
+
+// resize starts or stops workers until n are running. Stopped workers finish
+// their current message first.
+func (p *workerPool) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	for len(p.quit) < n {
+		p.nextID++
+		quit := make(chan struct{})
+		p.quit = append(p.quit, quit)
+		p.wg.Add(1)
+		go p.run(p.nextID, quit)
+	}
+
+	for len(p.quit) > n {
+		last := len(p.quit) - 1
+		close(p.quit[last])
+		p.quit = p.quit[:last]
+	}
+}
+
+func (p *workerPool) run(workerID int, quit <-chan struct{}) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-quit:
+			return
+		case message, ok := <-p.messages:
+			if !ok {
+				return
+			}
+			p.inFlight.Add(1)
+			p.handle(message, workerID)
+			p.inFlight.Add(-1)
+		}
+	}
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.quit)
+}
+
+// wait blocks until every worker has exited. Call after closing the message channel.
+func (p *workerPool) wait() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// queueSample is one observation of queue depth and local load
+type queueSample struct {
+	visible    int // ApproximateNumberOfMessages
+	notVisible int // ApproximateNumberOfMessagesNotVisible (in flight anywhere)
+	inFlight   int // being processed by this task
+	buffered   int // received but waiting in messagesChan
+}
+
+// backlog is the work this task could pick up or is already holding
+func (s queueSample) backlog() int {
+	return s.visible + s.inFlight + s.buffered
+}
+
+// scalingPolicy bounds the pool and sets how eagerly it grows and shrinks.
+// Growing needs upSamples consecutive high readings, shrinking needs
+// downSamples consecutive low readings and removes one worker at a time.
+type scalingPolicy struct {
+	minWorkers      int
+	maxWorkers      int
+	targetPerWorker int
+	upSamples       int
+	downSamples     int
+	interval        time.Duration
+}
+
+func newScalingPolicyFromEnv(initial int) scalingPolicy {
+	policy := scalingPolicy{
+		minWorkers:      getEnvInt("MIN_WORKERS", initial),
+		maxWorkers:      getEnvInt("MAX_WORKERS", initial),
+		targetPerWorker: getEnvInt("SCALE_TARGET_BACKLOG", 5),
+		upSamples:       getEnvInt("SCALE_UP_SAMPLES", 2),
+		downSamples:     getEnvInt("SCALE_DOWN_SAMPLES", 6),
+		interval:        time.Duration(getEnvInt("SCALE_INTERVAL_SECONDS", 10)) * time.Second,
+	}
+	if policy.maxWorkers < policy.minWorkers {
+		policy.maxWorkers = policy.minWorkers
+	}
+	return policy
+}
+
+func (sp scalingPolicy) enabled() bool {
+	return sp.maxWorkers > sp.minWorkers
+}
+
+func (sp scalingPolicy) clamp(n int) int {
+	if n < sp.minWorkers {
+		return sp.minWorkers
+	}
+	if n > sp.maxWorkers {
+		return sp.maxWorkers
+	}
+	return n
+}
+
+// autoscaler turns queue samples into pool sizes with hysteresis
+type autoscaler struct {
+	policy     scalingPolicy
+	upStreak   int
+	downStreak int
+}
+
+func newAutoscaler(policy scalingPolicy) *autoscaler {
+	return &autoscaler{policy: policy}
+}
+
+// decide returns the new pool size for the sample, or current if no change is due
+func (a *autoscaler) decide(current int, sample queueSample) (int, string) {
+	backlog := sample.backlog()
+	desired := a.policy.clamp((backlog + a.policy.targetPerWorker - 1) / a.policy.targetPerWorker)
+
+	switch {
+	case desired > current:
+		a.downStreak = 0
+		a.upStreak++
+		if a.upStreak < a.policy.upSamples {
+			return current, ""
+		}
+		a.upStreak = 0
+		return desired, fmt.Sprintf("backlog %d exceeds %d per worker", backlog, a.policy.targetPerWorker)
+	case desired < current:
+		a.upStreak = 0
+		a.downStreak++
+		if a.downStreak < a.policy.downSamples {
+			return current, ""
+		}
+		a.downStreak = 0
+		return current - 1, fmt.Sprintf("backlog %d below capacity for %d samples", backlog, a.policy.downSamples)
+	default:
+		a.upStreak, a.downStreak = 0, 0
+		return current, ""
+	}
+}
+
+// run samples the queue every interval and resizes the pool until ctx is cancelled
+func (a *autoscaler) run(ctx context.Context, pool *workerPool, buffered func() int) {
+	ticker := time.NewTicker(a.policy.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sample, err := sampleQueue(ctx)
+		if err != nil {
+			fmt.Printf("Autoscaler: failed to read queue depth: %v\n", err)
+			continue
+		}
+		sample.inFlight = int(pool.inFlight.Load())
+		sample.buffered = buffered()
+
+		current := pool.size()
+		next, reason := a.decide(current, sample)
+		if next == current {
+			continue
+		}
+
+		pool.resize(next)
+		fmt.Printf("Autoscaler: %d -> %d workers (%s; visible=%d in_flight=%d buffered=%d not_visible=%d)\n",
+			current, next, reason, sample.visible, sample.inFlight, sample.buffered, sample.notVisible)
+	}
+}
+
+// sampleQueue reads the approximate depth of the order queue
+func sampleQueue(ctx context.Context) (queueSample, error) {
+	visible, notVisible, err := orderSubscriber.Depth(ctx)
+	if err != nil {
+		return queueSample{}, err
+	}
+	return queueSample{visible: visible, notVisible: notVisible}, nil
+}
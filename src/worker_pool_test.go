@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutoscaler_Hysteresis(t *testing.T) {
+	a := newAutoscaler(scalingPolicy{minWorkers: 1, maxWorkers: 8, targetPerWorker: 5, upSamples: 2, downSamples: 3})
+
+	burst := queueSample{visible: 30}
+	if next, _ := a.decide(1, burst); next != 1 {
+		t.Fatalf("first high sample should not scale yet, got %d", next)
+	}
+	if next, _ := a.decide(1, burst); next != 6 {
+		t.Fatalf("expected scale up to 6 workers, got %d", next)
+	}
+
+	idle := queueSample{}
+	for i := 0; i < 2; i++ {
+		if next, _ := a.decide(6, idle); next != 6 {
+			t.Fatalf("sample %d: should hold at 6 until downSamples reached, got %d", i, next)
+		}
+	}
+	if next, _ := a.decide(6, idle); next != 5 {
+		t.Fatalf("expected step down to 5, got %d", next)
+	}
+
+	// A spike between low samples resets the scale-down streak
+	a.decide(5, idle)
+	a.decide(5, queueSample{visible: 100})
+	if next, _ := a.decide(5, idle); next != 5 {
+		t.Fatalf("streak should have been reset, got %d", next)
+	}
+
+	if next, _ := a.decide(8, queueSample{visible: 1000}); next != 8 {
+		t.Fatalf("pool must not exceed max, got %d", next)
+	}
+}
+
+func TestWorkerPool_Resize(t *testing.T) {
+	messages := make(chan QueuedMessage)
+	var handled atomic.Int32
+	pool := newWorkerPool(messages, func(QueuedMessage, int) { handled.Add(1) })
+
+	pool.resize(4)
+	if pool.size() != 4 {
+		t.Fatalf("expected 4 workers, got %d", pool.size())
+	}
+	pool.resize(2)
+	if pool.size() != 2 {
+		t.Fatalf("expected 2 workers, got %d", pool.size())
+	}
+
+	for i := 0; i < 5; i++ {
+		messages <- QueuedMessage{}
+	}
+	close(messages)
+
+	done := make(chan struct{})
+	go func() {
+		pool.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pool did not stop after channel closed")
+	}
+	if handled.Load() != 5 {
+		t.Fatalf("expected 5 handled messages, got %d", handled.Load())
+	}
+}